@@ -0,0 +1,95 @@
+package api
+
+import (
+	"aws-llama/config"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Rejects requests whose Host isn't the daemon itself, so that a page in the
+// browser can't reach it through a DNS name rebound to 127.0.0.1.
+func requireLocalHost(c *gin.Context) {
+	port := config.Current().ListenPort
+	allowed := []string{
+		fmt.Sprintf("localhost:%d", port),
+		fmt.Sprintf("127.0.0.1:%d", port),
+		config.Current().RootUrl.Host,
+	}
+	for _, host := range allowed {
+		if strings.EqualFold(c.Request.Host, host) {
+			c.Next()
+			return
+		}
+	}
+	c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": fmt.Sprintf("Unexpected host: %s", c.Request.Host)})
+}
+
+// Only lets requests with the token through, so that other local users and
+// pages in the browser can't read credentials.
+func requireToken(c *gin.Context) {
+	token, err := LoadOrCreateToken()
+	if err != nil {
+		c.AbortWithStatusJSON(500, gin.H{"error": fmt.Sprintf("Failed to load the token: %s", err.Error())})
+		return
+	}
+
+	sent := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(sent), []byte(token)) != 1 {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Missing or wrong token"})
+		return
+	}
+	c.Next()
+}
+
+// Loads the token that authorizes credential requests, generating it on first
+// use. It's only readable by the user running the daemon.
+func LoadOrCreateToken() (string, error) {
+	tokenPath := config.Current().TokenPath
+	token, err := os.ReadFile(tokenPath)
+	if err == nil {
+		return strings.TrimSpace(string(token)), nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return "", err
+	}
+
+	random := make([]byte, 32)
+	_, err = rand.Read(random)
+	if err != nil {
+		return "", err
+	}
+
+	// Written aside and linked into place, so that concurrent callers all end
+	// up with the token of whichever one was first.
+	temp, err := os.CreateTemp(filepath.Dir(tokenPath), ".aws-llama-token-*")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(temp.Name())
+	_, err = temp.WriteString(hex.EncodeToString(random) + "\n")
+	if closeErr := temp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", err
+	}
+	err = os.Link(temp.Name(), tokenPath)
+	if err != nil && !errors.Is(err, os.ErrExist) {
+		return "", err
+	}
+
+	token, err = os.ReadFile(tokenPath)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(token)), nil
+}
@@ -1,15 +1,19 @@
 package api
 
 import (
+	"aws-llama/browser"
+	"aws-llama/chain"
 	"aws-llama/config"
 	"aws-llama/credentials"
 	"aws-llama/log"
 	"aws-llama/saml"
 	"encoding/base64"
+	"encoding/xml"
 	"fmt"
 	"net"
 	"net/http"
 	"net/url"
+	"sort"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -22,45 +26,133 @@ type SAMLResponseBody struct {
 
 type CredentialSummary struct {
 	AccountId  string
+	RoleName   string
+	Profile    string
 	Expiration *time.Time
+	// Why the latest login failed to refresh the role, if it did.
+	RefreshError string `json:",omitempty"`
 }
 
+// Upper bound for how long a credential-process request may wait for a refresh.
+const MAX_CREDENTIALS_WAIT = 10 * time.Minute
+
 func routeIndex(c *gin.Context) {
+	entries, profileNames, err := credentials.CredentialStore.ProfileEntries()
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
 	var summaries []CredentialSummary
-	for _, entry := range credentials.CredentialStore.Entries {
+	for idx := range entries {
+		entry := entries[idx]
 		summary := CredentialSummary{
-			AccountId:  entry.AccountId,
-			Expiration: &entry.Expiration,
+			AccountId:    entry.AccountId,
+			RoleName:     entry.RoleName,
+			Profile:      profileNames[idx],
+			Expiration:   &entry.Expiration,
+			RefreshError: entry.RefreshError,
 		}
 		summaries = append(summaries, summary)
 	}
-	c.JSON(200, gin.H{"credentials": summaries})
+	c.JSON(200, gin.H{"credentials": summaries, "refreshes": lastRefreshes.all()})
+}
+
+func routeCredentials(c *gin.Context) {
+	profile := c.Param("profile")
+
+	var wait time.Duration
+	if c.Query("wait") != "" {
+		var err error
+		wait, err = time.ParseDuration(c.Query("wait"))
+		if err != nil {
+			c.JSON(400, gin.H{"error": fmt.Sprintf("Invalid wait duration: %s. %s", c.Query("wait"), err.Error())})
+			return
+		}
+		if wait > MAX_CREDENTIALS_WAIT {
+			wait = MAX_CREDENTIALS_WAIT
+		}
+	}
+	deadline := time.NewTimer(wait)
+	defer deadline.Stop()
+
+	changes := credentials.CredentialStore.Subscribe()
+	defer credentials.CredentialStore.Unsubscribe(changes)
+
+	timedOut := false
+	refreshRequested := false
+	for {
+		entry, err := credentials.CredentialStore.EntryForProfile(profile)
+		if err != nil {
+			c.JSON(500, gin.H{"error": err.Error()})
+			return
+		}
+		if entry != nil && !entry.IsExpired() {
+			c.JSON(200, entry.CredentialProcessOutput())
+			return
+		}
+
+		// Waiting is pointless for a profile no refresh can produce.
+		if wait == 0 || timedOut || (entry == nil && !credentials.ProfileMayAppear(profile)) {
+			if entry == nil {
+				c.JSON(404, gin.H{"error": fmt.Sprintf("No credentials for profile: %s", profile)})
+			} else {
+				c.JSON(503, gin.H{"error": fmt.Sprintf("Credentials for profile %s expired at %s", profile, entry.Expiration)})
+			}
+			return
+		}
+
+		if !refreshRequested {
+			browser.RequestRefresh()
+			refreshRequested = true
+		}
+
+		select {
+		case <-c.Request.Context().Done():
+			return
+		case <-deadline.C:
+			timedOut = true
+		case <-changes:
+		}
+	}
 }
 
 func routeLogin(c *gin.Context) {
-	metadataURLRaw := c.Query("metadata_url")
-	if metadataURLRaw == "" {
-		metadataURLRaw = credentials.NextMetadataURLForRefresh()
+	accountKey := c.Query("account")
+	if accountKey == "" {
+		accountKey = credentials.NextAccountForRefresh()
 	}
 
 	// Nothing to do if nothing needs refreshing.
-	if metadataURLRaw == "" {
+	if accountKey == "" {
 		c.Redirect(http.StatusFound, "/")
 		return
 	}
 
-	middleware, err := saml.MiddlewareForURL(metadataURLRaw)
+	account := config.Current().AccountForKey(accountKey)
+	if account == nil {
+		c.JSON(404, gin.H{"error": fmt.Sprintf("Unknown account: %s", accountKey)})
+		return
+	}
+	middleware, err := saml.MiddlewareForAccount(account)
 	if err != nil {
-		c.JSON(400, gin.H{"error": fmt.Sprintf("Failed to retrieve middleware for url: %s. %s", metadataURLRaw, err.Error())})
+		c.JSON(400, gin.H{"error": fmt.Sprintf("Failed to retrieve middleware for %s. %s", account.Name(), err.Error())})
 		return
 	}
-	redirectURL, err := saml.MakeRedirectUrl(middleware, metadataURLRaw)
+	// The account comes back as the RelayState of the response.
+	authnRequest, err := saml.MakeAuthnRequest(middleware, account)
 	if err != nil {
 		c.JSON(400, gin.H{"error": "Failed to build a SAML instance. " + err.Error()})
 		return
 	}
 
-	c.Redirect(http.StatusFound, redirectURL.String())
+	if authnRequest.PostPage != nil {
+		// The page submits itself to the IdP.
+		c.Header("Cache-Control", "no-store")
+		c.Data(http.StatusOK, "text/html; charset=utf-8", authnRequest.PostPage)
+		return
+	}
+	c.Redirect(http.StatusFound, authnRequest.RedirectURL.String())
 }
 
 func routeSAML(c *gin.Context) {
@@ -78,15 +170,20 @@ func routeSAML(c *gin.Context) {
 		return
 	}
 
-	middleware, err := saml.MiddlewareForURL(samlResponse.RelayState)
+	account := config.Current().AccountForKey(samlResponse.RelayState)
+	if account == nil {
+		c.JSON(400, gin.H{"error": fmt.Sprintf("SAML Response for an unknown account: %s", samlResponse.RelayState)})
+		return
+	}
+	err = saml.CheckOrigin(account, c.GetHeader("Origin"))
 	if err != nil {
-		c.JSON(400, gin.H{"error": fmt.Sprintf("Failed to resolve middlware for origin url: %s. %s", samlResponse.RelayState, err.Error())})
+		c.JSON(403, gin.H{"error": "Rejected SAML Response. " + err.Error()})
 		return
 	}
 
-	assertion, err := middleware.ServiceProvider.ParseXMLResponse(rawResponseBuf, make([]string, 0))
+	assertion, err := saml.ParseResponse(account, rawResponseBuf)
 	if err != nil {
-		c.JSON(400, gin.H{"error": fmt.Sprintf("Failed to parse SAML Response for URL: %s. %s", samlResponse.RelayState, err.Error())})
+		c.JSON(400, gin.H{"error": fmt.Sprintf("Failed to parse SAML Response for %s. %s", account.Name(), err.Error())})
 		return
 	}
 
@@ -96,51 +193,142 @@ func routeSAML(c *gin.Context) {
 		return
 	}
 
-	for _, pair := range pairs {
-		fmt.Printf("Processing pair from response: %+v\n", pair)
-		credsResponse, err := saml.AssumeRoleWithSAML(pair.ProviderARN, pair.RoleARN, samlResponse.SAMLResponse)
-		if err != nil {
-			c.JSON(500, gin.H{"error": fmt.Sprintf("Failed to assume role: %s. %s", pair.RoleARN, err.Error())})
-			return
-		}
-		log.Logger.Debug("Got credentials after saml response", credsResponse)
+	accountKey := account.Key()
+	seenRoles.record(accountKey, pairs)
 
-		credentialEntry, err := credentials.AWSCredentialEntryFromOutput(credsResponse, samlResponse.RelayState)
-		if err != nil {
-			c.JSON(500, gin.H{"error": err.Error()})
-			return
+	decisions := saml.FilterRolePairs(pairs, account.Roles)
+	for _, decision := range decisions {
+		if !decision.Included {
+			log.Logger.Debugf("Skipping role %s: %s", decision.RoleARN, decision.Reason)
 		}
-		credentials.CredentialStore.UpsertEntry(*credentialEntry)
 	}
+	pairs = saml.IncludedPairs(decisions)
+	if len(pairs) == 0 {
+		// Logging in again can't change that, so the account counts as logged in
+		// until its filter changes.
+		message := fmt.Sprintf("The roles filter for %s excludes every granted role. See 'aws-llama roles'.", account.Name())
+		log.Logger.Warn(message)
+		lastRefreshes.record(RefreshSummary{Account: accountKey, Time: time.Now(), Error: message})
+		credentials.CredentialStore.RecordFilteredLogin(account)
+		finishLogin(c)
+		return
+	}
+	sessionDuration := saml.SessionDuration(account.SessionDuration, assertion)
+
+	entries, failures := assumeRoles(pairs, samlResponse.SAMLResponse, account, sessionDuration)
+	summary := RefreshSummary{
+		Account:   accountKey,
+		Time:      time.Now(),
+		Succeeded: make([]string, 0, len(entries)),
+		Failed:    failures,
+	}
+	for _, entry := range entries {
+		summary.Succeeded = append(summary.Succeeded, entry.RoleARN)
+	}
+	sort.Strings(summary.Succeeded)
+	lastRefreshes.record(summary)
 
-	credentials.StoreCredentials(credentials.CredentialStore.Entries)
+	// Roles the IdP no longer grants are dropped, and roles that failed are
+	// marked so that they don't trigger another login right away.
+	failedRoles := make(map[string]string, len(failures))
+	for _, failure := range failures {
+		failedRoles[failure.RoleARN] = failure.Error
+	}
+	credentials.CredentialStore.ReplaceAccountEntries(accountKey, entries, failedRoles)
+
+	if len(entries) == 0 {
+		c.JSON(502, gin.H{"error": fmt.Sprintf("Failed to assume any role for %s.", account.Name()), "failed": failures})
+		return
+	}
+
+	// Chained roles are assumed again with the fresh credentials. A broken chain
+	// shouldn't keep the SAML credentials from being written.
+	_, err = chain.Refresh(accountKey)
+	if err != nil {
+		log.Logger.Errorf("Error refreshing chained roles: %s", err.Error())
+	}
+
+	finishLogin(c)
+}
+
+// Writes the credentials after a login, and continues with the next account
+// that needs one, if any.
+func finishLogin(c *gin.Context) {
+	err := credentials.CredentialStore.WriteToDisk()
+	if err != nil {
+		c.JSON(500, gin.H{"error": fmt.Sprintf("Failed to store credentials: %s", err.Error())})
+		return
+	}
 
 	// Check to see if there's any other credentials that need to be fetched and do so.
-	metadataURL := credentials.NextMetadataURLForRefresh()
-	if metadataURL != "" {
-		c.Redirect(302, "/login?metadata_url="+url.QueryEscape(metadataURL))
+	nextAccount := credentials.NextAccountForRefresh()
+	if nextAccount != "" {
+		c.Redirect(302, "/login?account="+url.QueryEscape(nextAccount))
 		return
 	}
 	c.Redirect(302, "/")
 }
 
+// SP metadata for registering aws-llama in the IdP.
+func routeSPMetadata(c *gin.Context) {
+	metadata, err := saml.ServiceProviderMetadata()
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to build the SP metadata. " + err.Error()})
+		return
+	}
+	out, err := xml.MarshalIndent(metadata, "", "  ")
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to encode the SP metadata. " + err.Error()})
+		return
+	}
+	c.Data(200, "application/samlmetadata+xml", out)
+}
+
+type AccountRoles struct {
+	Account  string
+	Nickname string
+	Roles    []saml.RoleDecision
+}
+
+// Shows which of the roles granted in the latest assertion of every account are
+// assumed, according to the current role filters.
+func routeRoles(c *gin.Context) {
+	accounts := make([]AccountRoles, 0)
+	for _, account := range config.Current().Accounts {
+		pairs, ok := seenRoles.get(account.Key())
+		if !ok {
+			continue
+		}
+		accounts = append(accounts, AccountRoles{
+			Account:  account.Key(),
+			Nickname: account.Nickname,
+			Roles:    saml.FilterRolePairs(pairs, account.Roles),
+		})
+	}
+	c.JSON(200, gin.H{"accounts": accounts})
+}
+
 func CreateGinWebserver() *gin.Engine {
 	r := gin.Default()
 	r.SetTrustedProxies(nil)
+	r.Use(requireLocalHost)
 	r.GET("/", routeIndex)
 	r.GET("/login", routeLogin)
-	r.POST("/sso/saml", routeSAML)
+	r.GET("/credentials/:profile", requireToken, routeCredentials)
+	r.GET("/roles", routeRoles)
+	r.POST(saml.ACS_PATH, routeSAML)
+	r.GET(saml.SP_METADATA_PATH, routeSPMetadata)
 	return r
 }
 
 func RunWebserver(r *gin.Engine) {
-	bind := fmt.Sprintf("127.0.0.1:%d", config.CurrentConfig.ListenPort)
+	bind := fmt.Sprintf("127.0.0.1:%d", config.Current().ListenPort)
 	r.Run(bind)
 }
 
 func IsWebserverRunning() bool {
 	timeout := time.Second
-	address := fmt.Sprintf("127.0.0.1:%d", config.CurrentConfig.ListenPort)
+	address := fmt.Sprintf("127.0.0.1:%d", config.Current().ListenPort)
 	conn, err := net.DialTimeout("tcp", address, timeout)
 	if err != nil {
 		return false
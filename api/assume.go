@@ -0,0 +1,106 @@
+package api
+
+import (
+	"aws-llama/config"
+	"aws-llama/credentials"
+	"aws-llama/log"
+	"aws-llama/saml"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Number of AssumeRoleWithSAML calls made at the same time, to stay clear of
+// STS throttling for users with many roles.
+const ASSUME_ROLE_WORKERS = 4
+
+type RoleFailure struct {
+	RoleARN string
+	Error   string
+}
+
+// Outcome of the latest SAML login of an account.
+type RefreshSummary struct {
+	// Key of the account.
+	Account   string
+	Time      time.Time
+	Succeeded []string
+	Failed    []RoleFailure
+	// Why the login didn't assume any role, other than roles failing.
+	Error string `json:",omitempty"`
+}
+
+// Assumes every pair with a bounded number of workers. Failures don't stop the
+// other roles from being assumed; they're returned per role instead.
+func assumeRoles(pairs []*saml.RolePair, samlAssertion string, account *config.Account, sessionDuration int64) ([]credentials.AWSCredentialEntry, []RoleFailure) {
+	var lock sync.Mutex
+	entries := make([]credentials.AWSCredentialEntry, 0, len(pairs))
+	failures := make([]RoleFailure, 0)
+
+	work := make(chan *saml.RolePair)
+	var wg sync.WaitGroup
+	for worker := 0; worker < ASSUME_ROLE_WORKERS && worker < len(pairs); worker++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for pair := range work {
+				entry, err := assumeRole(pair, samlAssertion, account, sessionDuration)
+
+				lock.Lock()
+				if err != nil {
+					log.Logger.Errorf("Failed to assume role %s: %s", pair.RoleARN, err.Error())
+					failures = append(failures, RoleFailure{RoleARN: pair.RoleARN, Error: err.Error()})
+				} else {
+					entries = append(entries, *entry)
+				}
+				lock.Unlock()
+			}
+		}()
+	}
+
+	for _, pair := range pairs {
+		work <- pair
+	}
+	close(work)
+	wg.Wait()
+
+	sort.Slice(failures, func(i, j int) bool { return failures[i].RoleARN < failures[j].RoleARN })
+	return entries, failures
+}
+
+func assumeRole(pair *saml.RolePair, samlAssertion string, account *config.Account, sessionDuration int64) (*credentials.AWSCredentialEntry, error) {
+	log.Logger.Debugf("Processing pair from response: %+v", pair)
+	credsResponse, err := saml.AssumeRoleWithSAML(account, pair.ProviderARN, pair.RoleARN, samlAssertion, sessionDuration)
+	if err != nil {
+		return nil, err
+	}
+
+	return credentials.AWSCredentialEntryFromOutput(credsResponse, pair.RoleARN, account.Key())
+}
+
+// The latest RefreshSummary per account.
+type refreshHistory struct {
+	lock      sync.Mutex
+	summaries map[string]RefreshSummary
+}
+
+var lastRefreshes = refreshHistory{summaries: make(map[string]RefreshSummary)}
+
+func (r *refreshHistory) record(summary RefreshSummary) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.summaries[summary.Account] = summary
+}
+
+func (r *refreshHistory) all() []RefreshSummary {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	summaries := make([]RefreshSummary, 0, len(r.summaries))
+	for _, summary := range r.summaries {
+		summaries = append(summaries, summary)
+	}
+	sort.Slice(summaries, func(i, j int) bool { return summaries[i].Account < summaries[j].Account })
+	return summaries
+}
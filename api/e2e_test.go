@@ -0,0 +1,964 @@
+package api
+
+import (
+	"aws-llama/chain"
+	"aws-llama/config"
+	"aws-llama/credentials"
+	"aws-llama/devidp"
+	"aws-llama/devidp/devidptest"
+	"aws-llama/fakests"
+	"aws-llama/log"
+	"aws-llama/saml"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	crewjam "github.com/crewjam/saml"
+	"github.com/crewjam/saml/samlsp"
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+	"gopkg.in/ini.v1"
+)
+
+const (
+	testAccountId   = "123456789012"
+	testProviderARN = "arn:aws:iam::123456789012:saml-provider/TestIdP"
+)
+
+func testRoleARN(name string) string {
+	return fmt.Sprintf("arn:aws:iam::%s:role/%s", testAccountId, name)
+}
+
+// Starts a dev IdP with a "dev" user (password "dev") granted roleNames.
+func newTestIdP(t *testing.T, roleNames ...string) *devidptest.Server {
+	roles := make([]string, 0, len(roleNames))
+	for _, roleName := range roleNames {
+		roles = append(roles, testRoleARN(roleName))
+	}
+	return devidptest.NewServer(t, devidp.Settings{
+		Users:       []devidp.User{{Username: "dev", Password: "dev", Roles: roles}},
+		ProviderARN: testProviderARN,
+	})
+}
+
+// Points HOME, the config, the credential store and STS at test doubles.
+func setupE2E(t *testing.T, accounts ...config.Account) (*fakests.FakeSTS, string) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+
+	rootUrl, _ := url.Parse("http://localhost:2600")
+	previousConfig := config.Current()
+	config.SetCurrent(&config.Config{
+		Accounts:           accounts,
+		RenewWithinSeconds: 15 * 60,
+		RootUrl:            rootUrl,
+		ListenPort:         2600,
+		StorageStatePath:   filepath.Join(home, ".aws-llama-storage"),
+		StatePath:          filepath.Join(home, ".aws-llama-state.json"),
+		TokenPath:          filepath.Join(home, ".aws-llama-token"),
+		MetadataCacheDir:   filepath.Join(home, ".aws-llama-metadata"),
+		CredentialsMode:    config.CredentialsModeReplace,
+	})
+
+	previousLogger := log.Logger
+	log.Logger = zap.NewNop().Sugar()
+
+	previousStore := credentials.CredentialStore
+	credentials.CredentialStore = credentials.NewAWSCredentialStore()
+
+	fake := fakests.New()
+	previousSTS := saml.STS
+	saml.STS = fake
+
+	gin.SetMode(gin.TestMode)
+
+	t.Cleanup(func() {
+		config.SetCurrent(previousConfig)
+		log.Logger = previousLogger
+		credentials.CredentialStore = previousStore
+		saml.STS = previousSTS
+	})
+	return fake, home
+}
+
+// Builds a request to the daemon the way local clients send it.
+func newLocalRequest(method string, target string, body io.Reader) *http.Request {
+	return httptest.NewRequest(method, "http://localhost:2600"+target, body)
+}
+
+// Builds a request for credentials, authorized like the credential-process command.
+func newCredentialsRequest(t *testing.T, target string) *http.Request {
+	token, err := LoadOrCreateToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	request := newLocalRequest("GET", target, nil)
+	request.Header.Set("Authorization", "Bearer "+token)
+	return request
+}
+
+// Runs a login the way the browser would: GET /login, sign in at the IdP it
+// redirects or posts to, and POST the IdP's form back to the ACS.
+func login(t *testing.T, engine *gin.Engine, client *http.Client) *httptest.ResponseRecorder {
+	return postResponse(engine, signIn(t, engine, client).Values, "")
+}
+
+// Starts a login at /login and returns the response form of the IdP.
+func signIn(t *testing.T, engine *gin.Engine, client *http.Client) *devidptest.Form {
+	recorder := httptest.NewRecorder()
+	engine.ServeHTTP(recorder, newLocalRequest("GET", "/login", nil))
+
+	var form *devidptest.Form
+	var err error
+	switch recorder.Code {
+	case http.StatusFound:
+		form, err = devidptest.SignIn(client, recorder.Header().Get("Location"), "dev", "dev")
+	case http.StatusOK:
+		// HTTP-POST binding: the page posts the AuthnRequest to the IdP.
+		var request *devidptest.Form
+		request, err = devidptest.ParseForm(recorder.Body.String())
+		if err == nil {
+			form, err = devidptest.SignInWithForm(client, request, "dev", "dev")
+		}
+	default:
+		t.Fatalf("GET /login: unexpected status %d: %s", recorder.Code, recorder.Body.String())
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if form.Action != "http://localhost:2600/sso/saml" {
+		t.Fatalf("IdP posts to %s instead of the ACS", form.Action)
+	}
+	return form
+}
+
+// Posts a response form to the ACS, with an Origin header unless origin is empty.
+func postResponse(engine *gin.Engine, values url.Values, origin string) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	request := newLocalRequest("POST", saml.ACS_PATH, strings.NewReader(values.Encode()))
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if origin != "" {
+		request.Header.Set("Origin", origin)
+	}
+	engine.ServeHTTP(recorder, request)
+	return recorder
+}
+
+func loadCredentialsFile(t *testing.T, home string) *ini.File {
+	iniFile, err := ini.Load(filepath.Join(home, ".aws", "credentials"))
+	if err != nil {
+		t.Fatalf("failed to load the credentials file: %s", err)
+	}
+	return iniFile
+}
+
+func TestE2ELoginWritesCredentials(t *testing.T) {
+	idp := newTestIdP(t, "developer", "read-only")
+	fake, home := setupE2E(t, config.Account{MetadataURL: idp.MetadataURLString()})
+	engine := CreateGinWebserver()
+
+	recorder := login(t, engine, devidptest.NewClient())
+	if recorder.Code != http.StatusFound || recorder.Header().Get("Location") != "/" {
+		t.Fatalf("expected a redirect to /, got %d %q: %s", recorder.Code, recorder.Header().Get("Location"), recorder.Body.String())
+	}
+
+	entries := credentials.CredentialStore.Entries()
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 entries in the store, got %d: %+v", len(entries), entries)
+	}
+	if len(fake.Calls()) != 2 {
+		t.Errorf("expected 2 STS calls, got %+v", fake.Calls())
+	}
+
+	iniFile := loadCredentialsFile(t, home)
+	for _, entry := range entries {
+		section, err := iniFile.GetSection("llama-" + testAccountId + "-" + entry.RoleName)
+		if err != nil {
+			t.Errorf("missing profile for %s: %s", entry.RoleARN, err)
+			continue
+		}
+		if section.Key("aws_access_key_id").String() != entry.Credential.AccessKeyId {
+			t.Errorf("profile for %s has access key %q, expected %q", entry.RoleARN, section.Key("aws_access_key_id").String(), entry.Credential.AccessKeyId)
+		}
+		if !strings.HasPrefix(entry.Credential.AccessKeyId, "ASIA") {
+			t.Errorf("unexpected access key %q", entry.Credential.AccessKeyId)
+		}
+	}
+
+	// The index reflects the store.
+	recorder = httptest.NewRecorder()
+	engine.ServeHTTP(recorder, newLocalRequest("GET", "/", nil))
+	var index struct {
+		Credentials []CredentialSummary
+	}
+	err := json.Unmarshal(recorder.Body.Bytes(), &index)
+	if err != nil || len(index.Credentials) != 2 {
+		t.Errorf("unexpected index (%v): %s", err, recorder.Body.String())
+	}
+
+	// Once logged in, nothing is left to refresh.
+	recorder = httptest.NewRecorder()
+	engine.ServeHTTP(recorder, newLocalRequest("GET", "/login", nil))
+	if recorder.Code != http.StatusFound || recorder.Header().Get("Location") != "/" {
+		t.Errorf("expected /login to redirect to /, got %d %q", recorder.Code, recorder.Header().Get("Location"))
+	}
+}
+
+func TestE2ELoginWithPostBinding(t *testing.T) {
+	idp := newTestIdP(t, "developer")
+	fake, home := setupE2E(t, config.Account{MetadataURL: idp.MetadataURLString(), Binding: config.BindingPost})
+	engine := CreateGinWebserver()
+
+	recorder := httptest.NewRecorder()
+	engine.ServeHTTP(recorder, newLocalRequest("GET", "/login", nil))
+	if recorder.Code != http.StatusOK || !strings.Contains(recorder.Body.String(), `name="SAMLRequest"`) {
+		t.Fatalf("expected an AuthnRequest form, got %d: %s", recorder.Code, recorder.Body.String())
+	}
+
+	recorder = login(t, engine, devidptest.NewClient())
+	if recorder.Code != http.StatusFound || recorder.Header().Get("Location") != "/" {
+		t.Fatalf("expected a redirect to /, got %d %q: %s", recorder.Code, recorder.Header().Get("Location"), recorder.Body.String())
+	}
+	if len(fake.Calls()) != 1 {
+		t.Errorf("expected 1 STS call, got %+v", fake.Calls())
+	}
+	if !loadCredentialsFile(t, home).HasSection("llama-" + testAccountId + "-developer") {
+		t.Errorf("missing profile after a POST binding login")
+	}
+}
+
+func TestE2ESignedRequestsAndEncryptedAssertions(t *testing.T) {
+	fake, home := setupE2E(t)
+	spMetadata, err := saml.ServiceProviderMetadata()
+	if err != nil {
+		t.Fatal(err)
+	}
+	spKey, _, err := saml.ServiceProviderKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake.DecryptionKey = spKey
+
+	// With the SP metadata, the IdP encrypts assertions for the SP certificate.
+	idp := devidptest.NewServer(t, devidp.Settings{
+		Users:       []devidp.User{{Username: "dev", Password: "dev", Roles: []string{testRoleARN("developer")}}},
+		ProviderARN: testProviderARN,
+		SPMetadata:  spMetadata,
+	})
+	signRequests := true
+	config.Current().Accounts = []config.Account{{MetadataURL: idp.MetadataURLString(), SignRequests: &signRequests}}
+	engine := CreateGinWebserver()
+
+	recorder := httptest.NewRecorder()
+	engine.ServeHTTP(recorder, newLocalRequest("GET", "/login", nil))
+	location, err := url.Parse(recorder.Header().Get("Location"))
+	if err != nil || location.Query().Get("Signature") == "" || location.Query().Get("SigAlg") == "" {
+		t.Fatalf("expected a signed AuthnRequest, got %d %q", recorder.Code, recorder.Header().Get("Location"))
+	}
+
+	client := devidptest.NewClient()
+	form, err := devidptest.SignIn(client, location.String(), "dev", "dev")
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, err := base64.StdEncoding.DecodeString(form.Values.Get("SAMLResponse"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(response), "EncryptedAssertion") {
+		t.Fatalf("expected an encrypted assertion: %s", response)
+	}
+
+	recorder = httptest.NewRecorder()
+	request := newLocalRequest("POST", saml.ACS_PATH, strings.NewReader(form.Values.Encode()))
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	engine.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusFound {
+		t.Fatalf("expected the encrypted assertion to be accepted, got %d: %s", recorder.Code, recorder.Body.String())
+	}
+	if !loadCredentialsFile(t, home).HasSection("llama-" + testAccountId + "-developer") {
+		t.Errorf("missing profile after an encrypted login")
+	}
+}
+
+func TestE2ERequestsAreUnsignedByDefault(t *testing.T) {
+	idp := newTestIdP(t, "developer")
+	setupE2E(t, config.Account{MetadataURL: idp.MetadataURLString()})
+	engine := CreateGinWebserver()
+
+	recorder := httptest.NewRecorder()
+	engine.ServeHTTP(recorder, newLocalRequest("GET", "/login", nil))
+	location, err := url.Parse(recorder.Header().Get("Location"))
+	if err != nil || location.Query().Get("SAMLRequest") == "" || location.Query().Get("Signature") != "" {
+		t.Fatalf("expected an unsigned AuthnRequest, got %d %q", recorder.Code, recorder.Header().Get("Location"))
+	}
+
+	// The SP metadata only promises signed requests once an account opts in.
+	for _, signRequests := range []bool{false, true} {
+		config.Current().Accounts[0].SignRequests = &signRequests
+		metadata, err := saml.ServiceProviderMetadata()
+		if err != nil {
+			t.Fatal(err)
+		}
+		signed := metadata.SPSSODescriptors[0].AuthnRequestsSigned
+		if signed == nil || *signed != signRequests {
+			t.Errorf("expected AuthnRequestsSigned=%v in the SP metadata, got %v", signRequests, signed)
+		}
+	}
+}
+
+func TestE2ELoginToleratesPartialFailure(t *testing.T) {
+	idp := newTestIdP(t, "developer", "broken")
+	fake, home := setupE2E(t, config.Account{MetadataURL: idp.MetadataURLString()})
+	fake.Failures[testRoleARN("broken")] = awserr.New("AccessDenied", "not allowed", nil)
+	engine := CreateGinWebserver()
+
+	recorder := login(t, engine, devidptest.NewClient())
+	if recorder.Code != http.StatusFound {
+		t.Fatalf("expected a redirect, got %d: %s", recorder.Code, recorder.Body.String())
+	}
+
+	iniFile := loadCredentialsFile(t, home)
+	if !iniFile.HasSection("llama-" + testAccountId + "-developer") {
+		t.Errorf("missing profile for the role that succeeded: %v", iniFile.SectionStrings())
+	}
+	if iniFile.HasSection("llama-" + testAccountId + "-broken") {
+		t.Errorf("unexpected profile for the role that failed")
+	}
+
+	var summary *RefreshSummary
+	for _, candidate := range lastRefreshes.all() {
+		if candidate.Account == config.Current().Accounts[0].Key() {
+			candidate := candidate
+			summary = &candidate
+		}
+	}
+	if summary == nil || len(summary.Failed) != 1 || summary.Failed[0].RoleARN != testRoleARN("broken") {
+		t.Errorf("unexpected refresh summary: %+v", summary)
+	}
+
+	// Once the role works, a login due to another role picks it up.
+	delete(fake.Failures, testRoleARN("broken"))
+	expireEntry("developer")
+	recorder = login(t, engine, devidptest.NewClient())
+	if recorder.Code != http.StatusFound || len(credentials.CredentialStore.Entries()) != 2 {
+		t.Fatalf("expected both roles after the second login, got %d: %+v", recorder.Code, credentials.CredentialStore.Entries())
+	}
+
+	// When it breaks again, its expired entry mustn't make every login start
+	// another one.
+	fake.Failures[testRoleARN("broken")] = awserr.New("AccessDenied", "not allowed", nil)
+	expireEntry("broken")
+	recorder = login(t, engine, devidptest.NewClient())
+	if recorder.Code != http.StatusFound || recorder.Header().Get("Location") != "/" {
+		t.Fatalf("expected a redirect to /, got %d %q: %s", recorder.Code, recorder.Header().Get("Location"), recorder.Body.String())
+	}
+	if next := credentials.NextAccountForRefresh(); next != "" {
+		t.Errorf("expected nothing left to refresh, got %s", next)
+	}
+
+	recorder = httptest.NewRecorder()
+	engine.ServeHTTP(recorder, newLocalRequest("GET", "/", nil))
+	var index struct {
+		Credentials []CredentialSummary
+	}
+	err := json.Unmarshal(recorder.Body.Bytes(), &index)
+	if recorder.Code != http.StatusOK || err != nil {
+		t.Fatalf("unexpected index %d (%v): %s", recorder.Code, err, recorder.Body.String())
+	}
+	for _, credential := range index.Credentials {
+		failed := credential.RefreshError != ""
+		if failed != (credential.RoleName == "broken") {
+			t.Errorf("expected only the broken role to be marked as failed: %+v", credential)
+		}
+	}
+}
+
+// Makes the stored credentials of roleName expire, so that their account is due
+// for a login.
+func expireEntry(roleName string) {
+	entries := credentials.CredentialStore.Entries()
+	for idx := range entries {
+		if entries[idx].RoleName == roleName {
+			entries[idx].Expiration = time.Now().Add(-time.Minute)
+		}
+	}
+	credentials.CredentialStore.ReplaceEntries(entries)
+}
+
+func TestE2ECredentialsForUnknownProfileDontWait(t *testing.T) {
+	idp := newTestIdP(t, "developer")
+	setupE2E(t, config.Account{MetadataURL: idp.MetadataURLString()})
+	engine := CreateGinWebserver()
+
+	recorder := login(t, engine, devidptest.NewClient())
+	if recorder.Code != http.StatusFound {
+		t.Fatalf("expected a redirect, got %d: %s", recorder.Code, recorder.Body.String())
+	}
+
+	recorder = httptest.NewRecorder()
+	engine.ServeHTTP(recorder, newCredentialsRequest(t, "/credentials/llama-"+testAccountId+"-developer?wait=1m"))
+	if recorder.Code != http.StatusOK {
+		t.Errorf("expected the credentials of a known profile, got %d: %s", recorder.Code, recorder.Body.String())
+	}
+
+	started := time.Now()
+	recorder = httptest.NewRecorder()
+	engine.ServeHTTP(recorder, newCredentialsRequest(t, "/credentials/unknown?wait=1m"))
+	if recorder.Code != http.StatusNotFound || time.Since(started) > 10*time.Second {
+		t.Errorf("expected an immediate 404, got %d after %s: %s", recorder.Code, time.Since(started), recorder.Body.String())
+	}
+}
+
+func TestE2ERoleFilterExcludesRoles(t *testing.T) {
+	idp := newTestIdP(t, "developer", "admin")
+	fake, home := setupE2E(t, config.Account{
+		MetadataURL: idp.MetadataURLString(),
+		Roles:       config.RoleFilter{Exclude: config.RoleMatcher{Names: []string{"admin"}}},
+	})
+	engine := CreateGinWebserver()
+
+	recorder := login(t, engine, devidptest.NewClient())
+	if recorder.Code != http.StatusFound {
+		t.Fatalf("expected a redirect, got %d: %s", recorder.Code, recorder.Body.String())
+	}
+
+	for _, call := range fake.Calls() {
+		if call.RoleARN == testRoleARN("admin") {
+			t.Errorf("excluded role was assumed: %+v", call)
+		}
+	}
+	iniFile := loadCredentialsFile(t, home)
+	if iniFile.HasSection("llama-" + testAccountId + "-admin") {
+		t.Errorf("unexpected profile for the excluded role")
+	}
+}
+
+func TestE2ERoleFilterExcludingEverythingStopsLogins(t *testing.T) {
+	idp := newTestIdP(t, "developer", "admin")
+	fake, _ := setupE2E(t, config.Account{
+		MetadataURL: idp.MetadataURLString(),
+		Roles:       config.RoleFilter{Include: config.RoleMatcher{Names: []string{"auditor"}}},
+	})
+	engine := CreateGinWebserver()
+
+	recorder := login(t, engine, devidptest.NewClient())
+	if recorder.Code != http.StatusFound || recorder.Header().Get("Location") != "/" {
+		t.Fatalf("expected a redirect to /, got %d %q: %s", recorder.Code, recorder.Header().Get("Location"), recorder.Body.String())
+	}
+	if len(fake.Calls()) != 0 {
+		t.Errorf("expected no role to be assumed, got %+v", fake.Calls())
+	}
+	if next := credentials.NextAccountForRefresh(); next != "" {
+		t.Errorf("expected no further logins, got %s", next)
+	}
+	if _, ok := credentials.NextRefreshDeadline(time.Now()); ok {
+		t.Errorf("expected nothing to refresh")
+	}
+	explained := false
+	for _, summary := range lastRefreshes.all() {
+		if summary.Account == config.Current().Accounts[0].Key() {
+			explained = strings.Contains(summary.Error, "excludes every granted role")
+		}
+	}
+	if !explained {
+		t.Errorf("expected the refresh summary to explain the filter")
+	}
+
+	// Editing the filter makes the account due for a login again.
+	reloaded := *config.Current()
+	reloaded.Accounts = []config.Account{{
+		MetadataURL: idp.MetadataURLString(),
+		Roles:       config.RoleFilter{Include: config.RoleMatcher{Names: []string{"developer"}}},
+	}}
+	config.SetCurrent(&reloaded)
+	if next := credentials.NextAccountForRefresh(); next != reloaded.Accounts[0].Key() {
+		t.Fatalf("expected a login after the filter changed, got %q", next)
+	}
+	recorder = login(t, engine, devidptest.NewClient())
+	if recorder.Code != http.StatusFound || len(credentials.CredentialStore.Entries()) != 1 {
+		t.Errorf("expected the included role after the filter changed, got %d: %+v", recorder.Code, credentials.CredentialStore.Entries())
+	}
+}
+
+func TestE2EChainedRoles(t *testing.T) {
+	idp := newTestIdP(t, "developer")
+	fake, home := setupE2E(t, config.Account{MetadataURL: idp.MetadataURLString()})
+	config.Current().ChainedRoles = []config.ChainedRole{{
+		SourceRoleARN: testRoleARN("developer"),
+		RoleARN:       "arn:aws:iam::210987654321:role/deploy",
+		Profile:       "deploy",
+	}}
+	engine := CreateGinWebserver()
+
+	recorder := login(t, engine, devidptest.NewClient())
+	if recorder.Code != http.StatusFound {
+		t.Fatalf("expected a redirect, got %d: %s", recorder.Code, recorder.Body.String())
+	}
+
+	calls := fake.Calls()
+	if len(calls) != 2 || calls[1].Action != "AssumeRole" {
+		t.Fatalf("expected the chained role to be assumed after the SAML login, got %+v", calls)
+	}
+	source, _ := credentials.CredentialStore.EntryForProfile("llama-" + testAccountId + "-developer")
+	if source == nil || calls[1].AccessKeyId != source.Credential.AccessKeyId {
+		t.Errorf("chained role wasn't assumed with the SAML credentials: %+v", calls[1])
+	}
+
+	iniFile := loadCredentialsFile(t, home)
+	if !iniFile.HasSection("deploy") {
+		t.Errorf("missing profile for the chained role: %v", iniFile.SectionStrings())
+	}
+}
+
+func TestE2EFailingChainedRoleDoesntTriggerLogins(t *testing.T) {
+	idp := newTestIdP(t, "developer")
+	fake, _ := setupE2E(t, config.Account{MetadataURL: idp.MetadataURLString()})
+	chainedARN := "arn:aws:iam::210987654321:role/deploy"
+	config.Current().ChainedRoles = []config.ChainedRole{{
+		SourceRoleARN: testRoleARN("developer"),
+		RoleARN:       chainedARN,
+		Profile:       "deploy",
+	}}
+	engine := CreateGinWebserver()
+
+	recorder := login(t, engine, devidptest.NewClient())
+	if recorder.Code != http.StatusFound {
+		t.Fatalf("expected a redirect, got %d: %s", recorder.Code, recorder.Body.String())
+	}
+
+	fake.Failures[chainedARN] = awserr.New("AccessDenied", "not allowed", nil)
+	expireEntry("deploy")
+	changed, err := chain.Refresh("")
+	if err == nil || !changed {
+		t.Fatalf("expected the chained role to fail and be marked, got changed=%v err=%v", changed, err)
+	}
+	entry, _ := credentials.CredentialStore.EntryForProfile("deploy")
+	if entry == nil || entry.RefreshError == "" {
+		t.Fatalf("expected the chained entry to be marked as failed: %+v", entry)
+	}
+	if next := credentials.NextAccountForRefresh(); next != "" {
+		t.Errorf("expected the failed chained role not to trigger a login, got %s", next)
+	}
+	if deadline, ok := credentials.NextRefreshDeadline(time.Now()); ok && !deadline.After(time.Now()) {
+		t.Errorf("expected no refresh to be due, got %s", deadline)
+	}
+
+	// It's still retried when chained roles are refreshed, and recovers.
+	delete(fake.Failures, chainedARN)
+	_, err = chain.Refresh("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry, _ = credentials.CredentialStore.EntryForProfile("deploy")
+	if entry == nil || entry.RefreshError != "" || entry.IsExpired() {
+		t.Errorf("expected fresh credentials for the chained role: %+v", entry)
+	}
+}
+
+func TestE2ERejectsTamperedResponse(t *testing.T) {
+	idp := newTestIdP(t, "developer")
+	_, home := setupE2E(t, config.Account{MetadataURL: idp.MetadataURLString()})
+	engine := CreateGinWebserver()
+
+	form := url.Values{}
+	form.Set("SAMLResponse", "PHNhbWxwOlJlc3BvbnNlLz4=") // <samlp:Response/>
+	form.Set("RelayState", config.Current().Accounts[0].Key())
+	recorder := httptest.NewRecorder()
+	request := newLocalRequest("POST", saml.ACS_PATH, strings.NewReader(form.Encode()))
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	engine.ServeHTTP(recorder, request)
+
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("expected 400, got %d: %s", recorder.Code, recorder.Body.String())
+	}
+	if len(credentials.CredentialStore.Entries()) != 0 {
+		t.Errorf("store changed after a rejected response")
+	}
+	if _, err := os.Stat(filepath.Join(home, ".aws", "credentials")); !os.IsNotExist(err) {
+		t.Errorf("credentials file was written after a rejected response: %v", err)
+	}
+}
+
+func TestE2EServesSPMetadata(t *testing.T) {
+	setupE2E(t)
+	engine := CreateGinWebserver()
+
+	recorder := httptest.NewRecorder()
+	engine.ServeHTTP(recorder, newLocalRequest("GET", "/saml/metadata", nil))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", recorder.Code, recorder.Body.String())
+	}
+
+	var metadata crewjam.EntityDescriptor
+	if err := xml.Unmarshal(recorder.Body.Bytes(), &metadata); err != nil {
+		t.Fatalf("failed to parse the SP metadata: %s", err)
+	}
+	if metadata.EntityID != "http://localhost:2600/sso/saml" {
+		t.Errorf("unexpected entity ID %s", metadata.EntityID)
+	}
+	if len(metadata.SPSSODescriptors) != 1 {
+		t.Fatalf("expected one SPSSODescriptor, got %d", len(metadata.SPSSODescriptors))
+	}
+	descriptor := metadata.SPSSODescriptors[0]
+	if len(descriptor.AssertionConsumerServices) != 1 || descriptor.AssertionConsumerServices[0].Location != "http://localhost:2600/sso/saml" {
+		t.Errorf("unexpected ACS entries %+v", descriptor.AssertionConsumerServices)
+	}
+	if len(descriptor.KeyDescriptors) == 0 {
+		t.Errorf("expected the SP certificate in the metadata")
+	}
+}
+
+func TestE2ERefetchesMetadataAfterCertificateRotation(t *testing.T) {
+	idp := newTestIdP(t, "developer")
+	setupE2E(t, config.Account{MetadataURL: idp.MetadataURLString()})
+	engine := CreateGinWebserver()
+
+	// Caches the metadata with the current certificate.
+	recorder := login(t, engine, devidptest.NewClient())
+	if recorder.Code != http.StatusFound {
+		t.Fatalf("expected the first login to succeed, got %d: %s", recorder.Code, recorder.Body.String())
+	}
+
+	key, cert, err := saml.GenerateKeyPair(devidp.CERTIFICATE_NAME)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idp.RotateKey(key, cert)
+	credentials.CredentialStore = credentials.NewAWSCredentialStore()
+
+	recorder = login(t, engine, devidptest.NewClient())
+	if recorder.Code != http.StatusFound {
+		t.Fatalf("expected the response signed with the new certificate to be accepted, got %d: %s", recorder.Code, recorder.Body.String())
+	}
+	if len(credentials.CredentialStore.Entries()) != 1 {
+		t.Errorf("expected credentials after the rotation, got %d entries", len(credentials.CredentialStore.Entries()))
+	}
+}
+
+// Returns the metadata of the IdP and the SHA-256 fingerprint of its certificate.
+func fetchIdPMetadata(t *testing.T, idp *devidptest.Server) (string, string) {
+	response, err := idp.Server.Client().Get(idp.MetadataURLString())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	raw, err := io.ReadAll(response.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var metadata crewjam.EntityDescriptor
+	if err := xml.Unmarshal(raw, &metadata); err != nil {
+		t.Fatal(err)
+	}
+	der, err := base64.StdEncoding.DecodeString(metadata.IDPSSODescriptors[0].KeyDescriptors[0].KeyInfo.X509Data.X509Certificates[0].Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(der)
+	return string(raw), hex.EncodeToString(sum[:])
+}
+
+func TestE2ELoginWithLocalMetadata(t *testing.T) {
+	idp := newTestIdP(t, "developer")
+	metadata, fingerprint := fetchIdPMetadata(t, idp)
+	metadataFile := filepath.Join(t.TempDir(), "idp.xml")
+	if err := os.WriteFile(metadataFile, []byte(metadata), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, account := range []config.Account{
+		{ID: "inline", MetadataXML: metadata, IdPCertificateFingerprints: []string{strings.ToUpper(fingerprint)}},
+		{ID: "file", MetadataFile: metadataFile, IdPSSOURL: idp.Server.URL + "/sso"},
+	} {
+		setupE2E(t, account)
+		engine := CreateGinWebserver()
+
+		recorder := login(t, engine, devidptest.NewClient())
+		if recorder.Code != http.StatusFound {
+			t.Fatalf("%s: expected a redirect, got %d: %s", account.ID, recorder.Code, recorder.Body.String())
+		}
+		entries := credentials.CredentialStore.Entries()
+		if len(entries) != 1 || entries[0].AccountKey != account.ID {
+			t.Errorf("%s: expected credentials stored under the account id, got %+v", account.ID, entries)
+		}
+	}
+}
+
+func TestE2ERejectsUnpinnedIdPCertificate(t *testing.T) {
+	idp := newTestIdP(t, "developer")
+	setupE2E(t, config.Account{
+		MetadataURL:                idp.MetadataURLString(),
+		IdPCertificateFingerprints: []string{strings.Repeat("ab", 32)},
+	})
+	engine := CreateGinWebserver()
+
+	recorder := httptest.NewRecorder()
+	engine.ServeHTTP(recorder, newLocalRequest("GET", "/login", nil))
+	if recorder.Code != http.StatusBadRequest || !strings.Contains(recorder.Body.String(), "idp_certificate_fingerprints") {
+		t.Errorf("expected the IdP certificate to be rejected, got %d: %s", recorder.Code, recorder.Body.String())
+	}
+}
+
+func TestE2ERejectsUnknownRelayState(t *testing.T) {
+	idp := newTestIdP(t, "developer")
+	setupE2E(t, config.Account{MetadataURL: idp.MetadataURLString()})
+	engine := CreateGinWebserver()
+
+	form := url.Values{}
+	form.Set("SAMLResponse", "PHNhbWxwOlJlc3BvbnNlLz4=") // <samlp:Response/>
+	form.Set("RelayState", "http://evil.example.com/metadata")
+	recorder := httptest.NewRecorder()
+	request := newLocalRequest("POST", saml.ACS_PATH, strings.NewReader(form.Encode()))
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	engine.ServeHTTP(recorder, request)
+
+	if recorder.Code != http.StatusBadRequest || !strings.Contains(recorder.Body.String(), "unknown account") {
+		t.Errorf("expected the unknown account to be rejected, got %d: %s", recorder.Code, recorder.Body.String())
+	}
+}
+
+func TestE2ERejectsReplayedResponse(t *testing.T) {
+	idp := newTestIdP(t, "developer")
+	setupE2E(t, config.Account{MetadataURL: idp.MetadataURLString()})
+	engine := CreateGinWebserver()
+
+	form := signIn(t, engine, devidptest.NewClient())
+	recorder := postResponse(engine, form.Values, "")
+	if recorder.Code != http.StatusFound {
+		t.Fatalf("expected the first response to be accepted, got %d: %s", recorder.Code, recorder.Body.String())
+	}
+
+	// Even with another login in progress, the response can't be used twice.
+	credentials.CredentialStore = credentials.NewAWSCredentialStore()
+	recorder = httptest.NewRecorder()
+	engine.ServeHTTP(recorder, newLocalRequest("GET", "/login", nil))
+	recorder = postResponse(engine, form.Values, "")
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("expected the replayed response to be rejected, got %d: %s", recorder.Code, recorder.Body.String())
+	}
+	if len(credentials.CredentialStore.Entries()) != 0 {
+		t.Errorf("store changed after a replayed response")
+	}
+}
+
+func TestE2ERejectsUnsolicitedResponse(t *testing.T) {
+	idp := newTestIdP(t, "developer")
+	setupE2E(t, config.Account{MetadataURL: idp.MetadataURLString()})
+	engine := CreateGinWebserver()
+	accountKey := config.Current().Accounts[0].Key()
+
+	// No login was started: an IdP-initiated or injected response is refused.
+	client := devidptest.NewClient()
+	metadata, err := samlsp.FetchMetadata(context.Background(), idp.Server.Client(), idp.MetadataURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	acs, _ := url.Parse("http://localhost:2600/sso/saml")
+	foreign := &crewjam.ServiceProvider{EntityID: acs.String(), AcsURL: *acs, IDPMetadata: metadata}
+	authnRequest, err := foreign.MakeAuthenticationRequest(foreign.GetSSOBindingLocation(crewjam.HTTPRedirectBinding), crewjam.HTTPRedirectBinding, crewjam.HTTPPostBinding)
+	if err != nil {
+		t.Fatal(err)
+	}
+	redirectURL, err := authnRequest.Redirect(accountKey, foreign)
+	if err != nil {
+		t.Fatal(err)
+	}
+	form, err := devidptest.SignIn(client, redirectURL.String(), "dev", "dev")
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder := postResponse(engine, form.Values, "")
+	if recorder.Code != http.StatusBadRequest || !strings.Contains(recorder.Body.String(), "/login") {
+		t.Errorf("expected the unsolicited response to be rejected, got %d: %s", recorder.Code, recorder.Body.String())
+	}
+
+	// Nor is it accepted as the answer to a login that is in progress.
+	recorder = httptest.NewRecorder()
+	engine.ServeHTTP(recorder, newLocalRequest("GET", "/login", nil))
+	recorder = postResponse(engine, form.Values, "")
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("expected the response to a foreign AuthnRequest to be rejected, got %d: %s", recorder.Code, recorder.Body.String())
+	}
+	if len(credentials.CredentialStore.Entries()) != 0 {
+		t.Errorf("store changed after an unsolicited response")
+	}
+}
+
+func TestE2EChecksResponseOrigin(t *testing.T) {
+	idp := newTestIdP(t, "developer")
+	setupE2E(t, config.Account{MetadataURL: idp.MetadataURLString()})
+	engine := CreateGinWebserver()
+
+	form := signIn(t, engine, devidptest.NewClient())
+	recorder := postResponse(engine, form.Values, "https://evil.example.com")
+	if recorder.Code != http.StatusForbidden {
+		t.Fatalf("expected a foreign origin to be rejected, got %d: %s", recorder.Code, recorder.Body.String())
+	}
+
+	// The login is still in progress, and the IdP may post its response.
+	recorder = postResponse(engine, form.Values, idp.Server.URL)
+	if recorder.Code != http.StatusFound {
+		t.Errorf("expected the IdP origin to be accepted, got %d: %s", recorder.Code, recorder.Body.String())
+	}
+}
+
+func TestE2EAllowedOrigins(t *testing.T) {
+	idp := newTestIdP(t, "developer")
+	setupE2E(t, config.Account{MetadataURL: idp.MetadataURLString(), AllowedOrigins: []string{"https://login.example.com"}})
+	engine := CreateGinWebserver()
+
+	form := signIn(t, engine, devidptest.NewClient())
+	recorder := postResponse(engine, form.Values, "https://LOGIN.example.com")
+	if recorder.Code != http.StatusFound {
+		t.Errorf("expected an allowed origin to be accepted, got %d: %s", recorder.Code, recorder.Body.String())
+	}
+}
+
+func TestE2ERejectsForeignHosts(t *testing.T) {
+	setupE2E(t)
+	engine := CreateGinWebserver()
+
+	cases := []struct {
+		host    string
+		allowed bool
+	}{
+		{"localhost:2600", true},
+		{"127.0.0.1:2600", true},
+		{"LOCALHOST:2600", true},
+		{"localhost:2601", false},
+		{"attacker.example.com:2600", false},
+		{"", false},
+	}
+	for _, c := range cases {
+		request := newLocalRequest("GET", "/", nil)
+		request.Host = c.host
+		recorder := httptest.NewRecorder()
+		engine.ServeHTTP(recorder, request)
+		if c.allowed && recorder.Code != http.StatusOK {
+			t.Errorf("%s: expected the request to be served, got %d: %s", c.host, recorder.Code, recorder.Body.String())
+		}
+		if !c.allowed && recorder.Code != http.StatusForbidden {
+			t.Errorf("%s: expected the request to be rejected, got %d", c.host, recorder.Code)
+		}
+	}
+}
+
+func TestE2ECredentialsRequireToken(t *testing.T) {
+	idp := newTestIdP(t, "developer")
+	_, home := setupE2E(t, config.Account{MetadataURL: idp.MetadataURLString()})
+	engine := CreateGinWebserver()
+	recorder := login(t, engine, devidptest.NewClient())
+	if recorder.Code != http.StatusFound {
+		t.Fatalf("expected a redirect, got %d: %s", recorder.Code, recorder.Body.String())
+	}
+
+	path := "/credentials/llama-" + testAccountId + "-developer"
+	for _, authorization := range []string{"", "Bearer wrong"} {
+		request := newLocalRequest("GET", path, nil)
+		if authorization != "" {
+			request.Header.Set("Authorization", authorization)
+		}
+		recorder = httptest.NewRecorder()
+		engine.ServeHTTP(recorder, request)
+		if recorder.Code != http.StatusUnauthorized {
+			t.Errorf("%q: expected the request to be rejected, got %d", authorization, recorder.Code)
+		}
+	}
+
+	recorder = httptest.NewRecorder()
+	engine.ServeHTTP(recorder, newCredentialsRequest(t, path))
+	if recorder.Code != http.StatusOK {
+		t.Errorf("expected the token to be accepted, got %d: %s", recorder.Code, recorder.Body.String())
+	}
+
+	info, err := os.Stat(filepath.Join(home, ".aws-llama-token"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("token written with mode %v", info.Mode().Perm())
+	}
+	token, err := LoadOrCreateToken()
+	if err != nil || len(token) != 64 {
+		t.Errorf("expected the token to be kept, got %q (%v)", token, err)
+	}
+}
+
+// Run with -race: the config file is reloaded while logins and other requests
+// read the config.
+func TestE2EReloadsConfigUnderLoad(t *testing.T) {
+	idp := newTestIdP(t, "developer")
+	_, home := setupE2E(t)
+	contents := fmt.Sprintf(`{"accounts": [{"id": "test", "metadata_url": %q}]}`, idp.MetadataURLString())
+	if err := os.WriteFile(filepath.Join(home, ".aws-llama.json"), []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := config.ReloadConfig(); err != nil {
+		t.Fatal(err)
+	}
+	engine := CreateGinWebserver()
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if err := config.ReloadConfig(); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	authorization := newCredentialsRequest(t, "/").Header.Get("Authorization")
+	for _, path := range []string{"/", "/roles", "/credentials/llama-" + testAccountId + "-developer"} {
+		wg.Add(1)
+		go func(path string) {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				request := newLocalRequest("GET", path, nil)
+				request.Header.Set("Authorization", authorization)
+				engine.ServeHTTP(httptest.NewRecorder(), request)
+				credentials.NextRefreshDeadline(time.Now())
+			}
+		}(path)
+	}
+
+	recorder := login(t, engine, devidptest.NewClient())
+	close(done)
+	wg.Wait()
+	if recorder.Code != http.StatusFound {
+		t.Fatalf("expected the login to succeed during reloads, got %d: %s", recorder.Code, recorder.Body.String())
+	}
+	entries := credentials.CredentialStore.Entries()
+	if len(entries) != 1 || entries[0].AccountKey != "test" {
+		t.Errorf("unexpected entries after the login: %+v", entries)
+	}
+}
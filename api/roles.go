@@ -0,0 +1,30 @@
+package api
+
+import (
+	"aws-llama/saml"
+	"sync"
+)
+
+// The role pairs from the latest assertion of every account, kept so the
+// role filters can be previewed without logging in again.
+type roleHistory struct {
+	lock  sync.Mutex
+	pairs map[string][]*saml.RolePair
+}
+
+var seenRoles = roleHistory{pairs: make(map[string][]*saml.RolePair)}
+
+func (r *roleHistory) record(accountKey string, pairs []*saml.RolePair) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.pairs[accountKey] = pairs
+}
+
+func (r *roleHistory) get(accountKey string) ([]*saml.RolePair, bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	pairs, ok := r.pairs[accountKey]
+	return pairs, ok
+}
@@ -0,0 +1,44 @@
+// Package atomicfile replaces files without readers ever seeing partial contents.
+package atomicfile
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Writes to a 0600 temp file next to path and renames it into place, so readers
+// only ever see the old or the new contents.
+func Write(path string, write func(w io.Writer) error) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	// Cleanup for the failure paths; after the rename this is a no-op.
+	defer os.Remove(tmp.Name())
+
+	err = tmp.Chmod(0600)
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+
+	err = write(tmp)
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+
+	err = tmp.Sync()
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+
+	err = tmp.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
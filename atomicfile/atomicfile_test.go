@@ -0,0 +1,94 @@
+package atomicfile
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Fails if anything but path is left in its directory.
+func assertOnlyFile(t *testing.T, path string) {
+	entries, err := os.ReadDir(filepath.Dir(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		if entry.Name() != filepath.Base(path) {
+			t.Errorf("unexpected file left behind: %s", entry.Name())
+		}
+	}
+}
+
+func TestWriteReplacesFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "credentials")
+	err := os.WriteFile(path, []byte("old"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = Write(path, func(w io.Writer) error {
+		_, err := io.WriteString(w, "new")
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	contents, err := os.ReadFile(path)
+	if err != nil || string(contents) != "new" {
+		t.Errorf("expected the new contents, got %q (%v)", contents, err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("expected mode 0600, got %s", info.Mode().Perm())
+	}
+	assertOnlyFile(t, path)
+}
+
+func TestWriteCreatesPrivateFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "credentials")
+
+	err := Write(path, func(w io.Writer) error {
+		_, err := io.WriteString(w, "new")
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("expected mode 0600, got %s", info.Mode().Perm())
+	}
+}
+
+func TestFailedWriteKeepsOldFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "credentials")
+	err := os.WriteFile(path, []byte("old"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	failure := errors.New("disk full")
+	err = Write(path, func(w io.Writer) error {
+		io.WriteString(w, "partial")
+		return failure
+	})
+	if !errors.Is(err, failure) {
+		t.Fatalf("expected the write error, got %v", err)
+	}
+
+	contents, err := os.ReadFile(path)
+	if err != nil || string(contents) != "old" {
+		t.Errorf("expected the old contents to be intact, got %q (%v)", contents, err)
+	}
+	assertOnlyFile(t, path)
+}
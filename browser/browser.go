@@ -1,9 +1,13 @@
 package browser
 
 import (
+	"aws-llama/chain"
 	"aws-llama/config"
 	"aws-llama/credentials"
 	"aws-llama/log"
+	"aws-llama/scheduler"
+	"aws-llama/secrets"
+	"context"
 	"fmt"
 	"net/url"
 	"time"
@@ -25,7 +29,7 @@ func NewBrowser() (*Browser, error) {
 		return nil, err
 	}
 
-	loginPath, err := url.JoinPath(config.CurrentConfig.RootUrl.String(), "/login")
+	loginPath, err := url.JoinPath(config.Current().RootUrl.String(), "/login")
 	if err != nil {
 		return nil, err
 	}
@@ -44,7 +48,7 @@ func (b *Browser) Authenticate() error {
 	}
 
 	if authenticated {
-		b.browserContext.StorageState(config.CurrentConfig.StorageStatePath)
+		b.persistStorageState()
 		log.Logger.Debug("Authentication via headless mode successful.")
 		return nil
 	}
@@ -56,7 +60,7 @@ func (b *Browser) Authenticate() error {
 	}
 
 	if authenticated {
-		b.browserContext.StorageState(config.CurrentConfig.StorageStatePath)
+		b.persistStorageState()
 		log.Logger.Debug("Authentication mode via browser successful.")
 		return nil
 	}
@@ -64,6 +68,13 @@ func (b *Browser) Authenticate() error {
 	return fmt.Errorf("failed to authenticate via both headed and headless browsers")
 }
 
+func (b *Browser) persistStorageState() {
+	err := b.saveStorageState()
+	if err != nil {
+		log.Logger.Errorf("Failed to save browser storage state: %s", err.Error())
+	}
+}
+
 func (b *Browser) Close() error {
 	err := b.browserContext.Close()
 	if err != nil {
@@ -133,7 +144,7 @@ func (b *Browser) authenticate(headless bool) (bool, error) {
 }
 
 func attemptAuth(page playwright.Page) error {
-	if !config.CurrentConfig.HasLogin() {
+	if !config.Current().HasLogin() {
 		log.Logger.Info("Skipping auth attempt. Credentials not configured.")
 		return nil
 	}
@@ -151,12 +162,16 @@ func attemptAuth(page playwright.Page) error {
 
 	// Fill in Username and Password
 	usernameField := page.Locator("input[name=\"identifier\"]")
-	err = usernameField.Fill(config.CurrentConfig.Username)
+	err = usernameField.Fill(config.Current().Username)
 	if err != nil {
 		return fmt.Errorf("failed to fill in username field: %w", err)
 	}
+	password, err := secrets.LoginPassword()
+	if err != nil {
+		return fmt.Errorf("failed to retrieve the password: %w", err)
+	}
 	passwordField := page.Locator("input[name=\"credentials.passcode\"]")
-	err = passwordField.Fill(config.CurrentConfig.Password)
+	err = passwordField.Fill(password)
 	if err != nil {
 		return fmt.Errorf("failed to fill in password field: %w", err)
 	}
@@ -239,8 +254,14 @@ func (b *Browser) ensureBrowserContext(headless bool) error {
 	}
 	b.browser = browser
 
+	storageState, err := loadStorageState()
+	if err != nil {
+		// Not fatal: the user just has to log in again.
+		log.Logger.Errorf("Failed to load browser storage state, starting without it: %s", err.Error())
+		storageState = &playwright.OptionalStorageState{}
+	}
 	contextOpts := playwright.BrowserNewContextOptions{
-		StorageStatePath: playwright.String(config.CurrentConfig.StorageStatePath),
+		StorageState: storageState,
 	}
 	browserCtx, err := browser.NewContext(contextOpts)
 	if err != nil {
@@ -276,38 +297,74 @@ func (b *Browser) ensurePage() (playwright.Page, error) {
 	return page, err
 }
 
-func AuthenticationLoop() {
-	log.Logger.Debug("Starting browser auth loop.")
-	ticker := time.NewTicker(5 * time.Minute)
+var authScheduler = newAuthScheduler()
 
-	// Perform the initial tick.
-	AttemptAuthentication()
-	for {
-		<-ticker.C
-		AttemptAuthentication()
+func newAuthScheduler() *scheduler.Scheduler {
+	s := scheduler.New(AttemptAuthentication, credentials.NextRefreshDeadline, scheduler.RealClock)
+	s.OnRetry = func(err error, delay time.Duration) {
+		log.Logger.Infof("Refresh failed (%s), retrying in %s.", err.Error(), delay.Round(time.Second))
 	}
+	return s
 }
 
-func AttemptAuthentication() {
-	metadataURL := credentials.NextMetadataURLForRefresh()
-	if metadataURL != "" {
-		log.Logger.Info("Eligible to authenticate a metadata url. Opening browser")
-		b, err := NewBrowser()
-		if err != nil {
-			log.Logger.Errorf("Error in new browser creation:", err.Error())
-		}
+// Asks the AuthenticationLoop to check for credentials to refresh right away,
+// unless it's backing off after failed refreshes.
+func RequestRefresh() {
+	authScheduler.Wake()
+}
 
-		err = b.Authenticate()
-		if err != nil {
-			log.Logger.Errorf("Error during authentication:", err.Error())
-		}
+// Asks the AuthenticationLoop to check for credentials to refresh right away,
+// even if it's backing off, e.g. because the config changed.
+func ForceRefresh() {
+	authScheduler.WakeSkippingBackoff()
+}
+
+// Refreshes credentials whenever the next one is due to expire (or is missing),
+// retrying failed attempts with backoff. Never returns.
+func AuthenticationLoop() {
+	log.Logger.Debug("Starting browser auth loop.")
+	authScheduler.Run(context.Background())
+}
 
-		// log.Logger.Info("Skipping browser closure!")
-		err = b.Close()
+func AttemptAuthentication() error {
+	// Chained roles whose source credentials are still valid don't need a login.
+	changed, chainErr := chain.Refresh("")
+	if chainErr != nil {
+		log.Logger.Errorf("Error refreshing chained roles: %s", chainErr.Error())
+	}
+	if changed {
+		err := credentials.CredentialStore.WriteToDisk()
 		if err != nil {
-			log.Logger.Errorf("Error during browser closure", err.Error())
+			log.Logger.Errorf("Error storing chained role credentials: %s", err.Error())
 		}
-	} else {
+	}
+
+	account := config.Current().AccountForKey(credentials.NextAccountForRefresh())
+	if account == nil {
 		log.Logger.Debug("No credentials need refreshing at this time.")
+		return chainErr
+	}
+
+	err := checkNetwork(account)
+	if err != nil {
+		return err
+	}
+
+	log.Logger.Infof("Eligible to authenticate %s. Opening browser", account.Name())
+	b, err := NewBrowser()
+	if err != nil {
+		log.Logger.Errorf("Error in new browser creation: %s", err.Error())
+		return err
+	}
+
+	authErr := b.Authenticate()
+	if authErr != nil {
+		log.Logger.Errorf("Error during authentication: %s", authErr.Error())
+	}
+
+	err = b.Close()
+	if err != nil {
+		log.Logger.Errorf("Error during browser closure: %s", err.Error())
 	}
+	return authErr
 }
@@ -0,0 +1,74 @@
+package browser
+
+import (
+	"aws-llama/config"
+	"aws-llama/log"
+	"aws-llama/saml"
+	"aws-llama/scheduler"
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"time"
+)
+
+const NETWORK_CHECK_TIMEOUT = 5 * time.Second
+
+// How often to compare the wall and monotonic clocks, and how far they may drift
+// apart before we assume the machine was asleep.
+const CLOCK_CHECK_INTERVAL = 30 * time.Second
+const CLOCK_JUMP_THRESHOLD = 60 * time.Second
+
+// Makes sure the IdP is reachable before a browser is launched, so that a login
+// attempt isn't wasted while e.g. Wi-Fi is still reconnecting after a resume.
+func checkNetwork(account *config.Account) error {
+	// Local metadata names the IdP only through its SSO endpoint.
+	idpURL := account.MetadataURL
+	if idpURL == "" {
+		var err error
+		idpURL, err = saml.SSOURL(account)
+		if err != nil {
+			return err
+		}
+	}
+
+	parsed, err := url.Parse(idpURL)
+	if err != nil {
+		return err
+	}
+
+	port := parsed.Port()
+	if port == "" {
+		port = "443"
+		if parsed.Scheme == "http" {
+			port = "80"
+		}
+	}
+	address := net.JoinHostPort(parsed.Hostname(), port)
+
+	conn, err := net.DialTimeout("tcp", address, NETWORK_CHECK_TIMEOUT)
+	if err != nil {
+		return fmt.Errorf("%w: IdP %s is unreachable: %s", scheduler.ErrNotReady, address, err.Error())
+	}
+	conn.Close()
+	return nil
+}
+
+// Triggers a refresh as soon as the machine wakes up from sleep, detected through
+// systemd-logind where available and through wall clock jumps everywhere.
+func WatchForResume(ctx context.Context) {
+	go scheduler.WatchClockJumps(ctx, scheduler.RealClock, CLOCK_CHECK_INTERVAL, CLOCK_JUMP_THRESHOLD, func(jump time.Duration) {
+		log.Logger.Infof("Wall clock jumped by %s (resumed from sleep?), re-checking credentials.", jump.Round(time.Second))
+		ForceRefresh()
+	})
+
+	go func() {
+		err := scheduler.WatchSleep(ctx, func() {
+			log.Logger.Info("System resumed from sleep, re-checking credentials.")
+			ForceRefresh()
+		})
+		if err != nil {
+			log.Logger.Debugf("Not watching for sleep notifications: %s", err.Error())
+		}
+	}()
+}
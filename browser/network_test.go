@@ -0,0 +1,35 @@
+package browser
+
+import (
+	"aws-llama/config"
+	"aws-llama/scheduler"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCheckNetwork(t *testing.T) {
+	idp := httptest.NewServer(http.NotFoundHandler())
+	defer idp.Close()
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+
+	cases := []struct {
+		name        string
+		metadataURL string
+		reachable   bool
+	}{
+		{"reachable IdP", idp.URL + "/metadata", true},
+		{"unreachable IdP", down.URL + "/metadata", false},
+	}
+	for _, c := range cases {
+		err := checkNetwork(&config.Account{MetadataURL: c.metadataURL})
+		if c.reachable && err != nil {
+			t.Errorf("%s: unexpected error %s", c.name, err)
+		}
+		if !c.reachable && !errors.Is(err, scheduler.ErrNotReady) {
+			t.Errorf("%s: expected ErrNotReady, got %v", c.name, err)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package browser
+
+import (
+	"aws-llama/config"
+	"aws-llama/encryption"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/playwright-community/playwright-go"
+)
+
+// Reads the saved browser storage state (IdP session cookies), decrypting it if needed.
+func loadStorageState() (*playwright.OptionalStorageState, error) {
+	storageStatePath := config.Current().StorageStatePath
+	contents, err := os.ReadFile(storageStatePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &playwright.OptionalStorageState{}, nil
+		}
+		return nil, err
+	}
+
+	contents, err = encryption.Open(contents)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt storage state %s: %w", storageStatePath, err)
+	}
+
+	var state playwright.OptionalStorageState
+	err = json.Unmarshal(contents, &state)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse storage state %s: %w", storageStatePath, err)
+	}
+	return &state, nil
+}
+
+// Saves the storage state of the current browser context, encrypting it if configured.
+func (b *Browser) saveStorageState() error {
+	state, err := b.browserContext.StorageState()
+	if err != nil {
+		return err
+	}
+
+	contents, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	contents, err = encryption.Seal(contents)
+	if err != nil {
+		return fmt.Errorf("failed to encrypt storage state: %w", err)
+	}
+
+	return os.WriteFile(config.Current().StorageStatePath, contents, 0600)
+}
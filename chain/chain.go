@@ -0,0 +1,98 @@
+package chain
+
+import (
+	"aws-llama/config"
+	"aws-llama/credentials"
+	"aws-llama/log"
+	"aws-llama/saml"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/sts"
+)
+
+const DEFAULT_SESSION_NAME = "aws-llama"
+
+// Assumes the chained role with the credentials of source.
+func assume(chained *config.ChainedRole, source *credentials.AWSCredentialEntry) (*credentials.AWSCredentialEntry, error) {
+	sessionName := chained.SessionName
+	if sessionName == "" {
+		sessionName = DEFAULT_SESSION_NAME
+	}
+	input := sts.AssumeRoleInput{
+		RoleArn:         &chained.RoleARN,
+		RoleSessionName: &sessionName,
+	}
+	if chained.ExternalID != "" {
+		input.ExternalId = &chained.ExternalID
+	}
+	if chained.DurationSeconds != 0 {
+		input.DurationSeconds = &chained.DurationSeconds
+	}
+
+	account := config.Current().AccountForKey(source.AccountKey)
+	output, err := saml.STS.AssumeRole(account, source.Credential.AccessKeyId, source.Credential.SecretAccessKey, source.Credential.SessionToken, &input)
+	if err != nil {
+		return nil, err
+	}
+	return credentials.AWSCredentialEntryFromAssumeRoleOutput(output, chained.RoleARN, source)
+}
+
+// Assumes the configured chained roles whose source credentials are valid and
+// that are missing or expire within RenewWithinSeconds. Roles whose source was
+// just refreshed by a login to the account refreshedAccountKey (if not empty)
+// are always assumed again. Roles that fail keep their previous credentials,
+// marked with the error. Returns whether the store changed, and the errors of
+// the roles that failed.
+func Refresh(refreshedAccountKey string) (bool, error) {
+	entries := credentials.CredentialStore.Entries()
+	samlEntries := make([]credentials.AWSCredentialEntry, 0, len(entries))
+	for _, entry := range entries {
+		if !entry.IsChained() {
+			samlEntries = append(samlEntries, entry)
+		}
+	}
+	current := config.Current()
+	renewWithin := time.Duration(current.RenewWithinSeconds * float64(time.Second))
+
+	changed := false
+	var errs []error
+	for idx := range current.ChainedRoles {
+		chained := &current.ChainedRoles[idx]
+		source, err := credentials.ChainSource(chained, samlEntries)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if source == nil || source.IsExpired() {
+			// Will be retried after the next SAML refresh of the source.
+			continue
+		}
+
+		existing := credentials.ChainedEntry(chained, source, entries)
+		force := refreshedAccountKey != "" && source.AccountKey == refreshedAccountKey
+		if !force && existing != nil && time.Until(existing.Expiration) > renewWithin {
+			continue
+		}
+
+		log.Logger.Debugf("Assuming chained role %s from %s", chained.RoleARN, source.RoleARN)
+		entry, err := assume(chained, source)
+		if err != nil {
+			err = fmt.Errorf("failed to assume chained role %s from %s: %w", chained.RoleARN, source.RoleARN, err)
+			errs = append(errs, err)
+			// Like a failed SAML role, the entry keeps its credentials but no longer
+			// triggers logins to the source account, whose credentials are fine.
+			if existing != nil && existing.RefreshError != err.Error() {
+				failed := *existing
+				failed.RefreshError = err.Error()
+				credentials.CredentialStore.UpsertEntry(failed)
+				changed = true
+			}
+			continue
+		}
+		credentials.CredentialStore.UpsertEntry(*entry)
+		changed = true
+	}
+	return changed, errors.Join(errs...)
+}
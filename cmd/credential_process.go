@@ -0,0 +1,107 @@
+package cmd
+
+import (
+	"aws-llama/api"
+	"aws-llama/config"
+	"aws-llama/credentials"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+var credentialProcessProfile string
+var credentialProcessWait bool
+var credentialProcessTimeout time.Duration
+
+// credentialProcessCmd represents the credential-process command
+var credentialProcessCmd = &cobra.Command{
+	Use:   "credential-process",
+	Short: "Print credentials for a profile in the AWS credential_process format.",
+	Long: `Prints credentials for a profile as the JSON document expected by the
+credential_process setting of the AWS CLIs and SDKs.
+
+Credentials are requested from the running 'serve' instance. With --wait, missing
+or expired credentials trigger a refresh and the command blocks until it finishes.
+If the daemon isn't running, unexpired credentials are read from its state file.
+
+Set "credential_process": true in ~/.aws-llama.json to have the daemon write
+matching profiles to ~/.aws/config instead of writing secrets to ~/.aws/credentials.
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		output, err := fetchCredentialProcessOutput()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "aws-llama: %s\n", err)
+			os.Exit(1)
+		}
+
+		err = json.NewEncoder(os.Stdout).Encode(output)
+		if err != nil {
+			panic(err)
+		}
+	},
+}
+
+func fetchCredentialProcessOutput() (*credentials.CredentialProcessOutput, error) {
+	if !api.IsWebserverRunning() {
+		return credentials.CredentialProcessOutputFromState(credentialProcessProfile)
+	}
+
+	query := url.Values{}
+	if credentialProcessWait {
+		query.Set("wait", credentialProcessTimeout.String())
+	}
+	requestURL := config.Current().RootUrl.ResolveReference(&url.URL{
+		Path:     "/credentials/" + url.PathEscape(credentialProcessProfile),
+		RawQuery: query.Encode(),
+	})
+
+	token, err := api.LoadOrCreateToken()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load the token: %w", err)
+	}
+	request, err := http.NewRequest("GET", requestURL.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Authorization", "Bearer "+token)
+
+	client := http.Client{Timeout: credentialProcessTimeout + 10*time.Second}
+	response, err := client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		var body struct {
+			Error string `json:"error"`
+		}
+		json.NewDecoder(response.Body).Decode(&body)
+		if body.Error == "" {
+			body.Error = response.Status
+		}
+		return nil, errors.New(body.Error)
+	}
+
+	var output credentials.CredentialProcessOutput
+	err = json.NewDecoder(response.Body).Decode(&output)
+	if err != nil {
+		return nil, err
+	}
+	return &output, nil
+}
+
+func init() {
+	rootCmd.AddCommand(credentialProcessCmd)
+
+	credentialProcessCmd.Flags().StringVar(&credentialProcessProfile, "profile", "", "Name of the profile to print credentials for.")
+	credentialProcessCmd.MarkFlagRequired("profile")
+	credentialProcessCmd.Flags().BoolVar(&credentialProcessWait, "wait", false, "Trigger a refresh and wait for it if the credentials are missing or expired.")
+	credentialProcessCmd.Flags().DurationVar(&credentialProcessTimeout, "timeout", 5*time.Minute, "How long to wait for a refresh with --wait.")
+}
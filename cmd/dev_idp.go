@@ -0,0 +1,98 @@
+package cmd
+
+import (
+	"aws-llama/devidp"
+	"aws-llama/log"
+	"aws-llama/saml"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+
+	"github.com/spf13/cobra"
+)
+
+var devIdPListen string
+var devIdPUsers string
+var devIdPKeyDir string
+var devIdPSPMetadata string
+
+// devIdPCmd represents the dev-idp command
+var devIdPCmd = &cobra.Command{
+	Use:   "dev-idp",
+	Short: "Run a local SAML IdP for developing and testing the login flow.",
+	Long: `Runs a local SAML IdP that signs in test users and grants them AWS roles, so the
+login flow can be developed and tested without a real IdP tenant.
+
+Users are read from the JSON file given with --users:
+
+  {
+    "users": [{"username": "dev", "password": "dev", "roles": ["arn:aws:iam::123456789012:role/developer"]}],
+    "provider_arn": "arn:aws:iam::123456789012:saml-provider/aws-llama-dev-idp"
+  }
+
+Without --users, a "dev" user with password "dev" is granted two roles. Add the
+printed metadata URL as an account in ~/.aws-llama.json and run 'aws-llama serve
+--fake-sts', since AWS doesn't trust the dev IdP.
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		settings := devidp.DefaultSettings()
+		if devIdPUsers != "" {
+			var err error
+			settings, err = devidp.LoadSettings(devIdPUsers)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "aws-llama: %s\n", err)
+				os.Exit(1)
+			}
+		}
+		if devIdPSPMetadata != "" {
+			var err error
+			settings.SPMetadata, err = devidp.LoadSPMetadata(devIdPSPMetadata)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "aws-llama: %s\n", err)
+				os.Exit(1)
+			}
+		}
+		if len(settings.ACSURLs) == 0 && settings.SPMetadata == nil {
+			settings.ACSURLs = []string{saml.ACSURL()}
+		}
+
+		keyDir := devIdPKeyDir
+		if keyDir == "" {
+			homeDir, err := os.UserHomeDir()
+			if err != nil {
+				panic(err)
+			}
+			keyDir = filepath.Join(homeDir, ".aws-llama-dev-idp")
+		}
+		key, cert, err := saml.LoadOrCreateKeyPair(filepath.Join(keyDir, "key.pem"), filepath.Join(keyDir, "cert.pem"), devidp.CERTIFICATE_NAME)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "aws-llama: failed to load the dev IdP key pair: %s\n", err)
+			os.Exit(1)
+		}
+
+		baseURL := url.URL{Scheme: "http", Host: devIdPListen}
+		idp, err := devidp.New(baseURL, key, cert, settings)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "aws-llama: %s\n", err)
+			os.Exit(1)
+		}
+
+		metadataURL := idp.MetadataURL()
+		fmt.Printf("Dev IdP metadata URL: %s\n", metadataURL.String())
+		for _, user := range settings.Users {
+			fmt.Printf("  user %s: %d role(s)\n", user.Username, len(user.Roles))
+		}
+		log.Logger.Fatal(http.ListenAndServe(devIdPListen, idp.Handler()))
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(devIdPCmd)
+
+	devIdPCmd.Flags().StringVar(&devIdPListen, "listen", "127.0.0.1:2700", "Address to serve the IdP on.")
+	devIdPCmd.Flags().StringVar(&devIdPUsers, "users", "", "JSON file with the test users and their roles.")
+	devIdPCmd.Flags().StringVar(&devIdPSPMetadata, "sp-metadata", "", "SP metadata file (see 'aws-llama sp-metadata'), to encrypt assertions for its certificate.")
+	devIdPCmd.Flags().StringVar(&devIdPKeyDir, "key-dir", "", "Directory for the signing key pair (defaults to ~/.aws-llama-dev-idp).")
+}
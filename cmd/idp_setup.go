@@ -0,0 +1,176 @@
+package cmd
+
+import (
+	"aws-llama/saml"
+	"crypto/sha1"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/template"
+
+	"github.com/spf13/cobra"
+)
+
+var idpSetupProvider string
+
+type idpSetupValues struct {
+	ACSURL                   string
+	EntityID                 string
+	SPMetadataURL            string
+	RoleAttribute            string
+	RoleSessionNameAttribute string
+	SessionDurationAttribute string
+	CertificateSHA1          string
+	CertificateSHA256        string
+}
+
+const idpSetupAttributes = `Attributes
+  {{.RoleAttribute}}
+      One value per role: arn:aws:iam::<account>:role/<role>,arn:aws:iam::<account>:saml-provider/<provider>
+  {{.RoleSessionNameAttribute}}
+      The user's email address or username
+  {{.SessionDurationAttribute}}
+      Optional: session length in seconds (900-43200)
+`
+
+const idpSetupCertificate = `Certificate (for signed AuthnRequests and encrypted assertions)
+  Print it with 'aws-llama sp-metadata --certificate'.
+  AuthnRequests are only signed for accounts with "sign_requests": true.
+  SHA-1 fingerprint:   {{.CertificateSHA1}}
+  SHA-256 fingerprint: {{.CertificateSHA256}}
+`
+
+var idpSetupTemplates = map[string]string{
+	"okta": `== Okta ==
+Applications > Create App Integration > SAML 2.0
+  Single sign-on URL:            {{.ACSURL}}
+  Use this for Recipient URL and Destination URL: checked
+  Audience URI (SP Entity ID):   {{.EntityID}}
+  Name ID format:                EmailAddress
+  Application username:          Email
+Attribute Statements (Name format: URI Reference)
+  {{.RoleAttribute}}   the role pairs, e.g. from a group attribute
+  {{.RoleSessionNameAttribute}}   user.email
+  {{.SessionDurationAttribute}}   e.g. "43200"
+Advanced Settings
+  Signature Certificate:         upload the SP certificate to require signed requests
+  Assertion Encryption:          Encrypted, with the SP certificate as Encryption Certificate
+`,
+	"azure": `== Azure AD (Entra ID) ==
+Enterprise applications > New application > Create your own application > Single sign-on > SAML
+Basic SAML Configuration
+  Identifier (Entity ID):        {{.EntityID}}
+  Reply URL (ACS URL):           {{.ACSURL}}
+Attributes & Claims (Namespace: https://aws.amazon.com/SAML/Attributes)
+  Role              user.assignedroles (app roles named "<role ARN>,<provider ARN>")
+  RoleSessionName   user.userprincipalname
+  SessionDuration   e.g. "43200"
+SAML Certificates
+  Verification certificates:     upload the SP certificate and require verification
+Token encryption:                import the SP certificate and activate it
+`,
+	"google": `== Google Workspace ==
+Apps > Web and mobile apps > Add app > Add custom SAML app
+Service provider details
+  ACS URL:                       {{.ACSURL}}
+  Entity ID:                     {{.EntityID}}
+  Name ID format:                EMAIL
+  Name ID:                       Basic Information > Primary email
+Attribute mapping (custom user schema attributes)
+  {{.RoleAttribute}}   a multi-value custom attribute with the role pairs
+  {{.RoleSessionNameAttribute}}   Primary email
+  {{.SessionDurationAttribute}}   e.g. a custom SessionDuration attribute
+Google Workspace neither verifies signed requests nor encrypts assertions.
+`,
+	"keycloak": `== Keycloak ==
+Clients > Create client > Client type: SAML
+  Client ID:                     {{.EntityID}}
+  Assertion Consumer Service POST Binding URL: {{.ACSURL}}
+  Name ID format:                email
+Keys
+  Client signature required:     On, importing the SP certificate
+  Encrypt assertions:            On, importing the SP certificate
+Client scopes > dedicated scope > Add mapper
+  Role list (Role attribute name: {{.RoleAttribute}}, Single Role Attribute: On)
+  User Property "email" (SAML Attribute Name: {{.RoleSessionNameAttribute}})
+  Hardcoded attribute (SAML Attribute Name: {{.SessionDurationAttribute}})
+Or import the SP metadata from {{.SPMetadataURL}} when creating the client.
+`,
+}
+
+func idpSetupProviderNames() []string {
+	names := make([]string, 0, len(idpSetupTemplates))
+	for name := range idpSetupTemplates {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func fingerprint(sum []byte) string {
+	parts := make([]string, len(sum))
+	for idx, b := range sum {
+		parts[idx] = fmt.Sprintf("%02X", b)
+	}
+	return strings.Join(parts, ":")
+}
+
+// idpSetupCmd represents the idp-setup command
+var idpSetupCmd = &cobra.Command{
+	Use:   "idp-setup",
+	Short: "Print the values to enter when creating the aws-llama app in an IdP.",
+	Long: `Prints the ACS URL, audience (SP entity ID), attribute mappings and certificate
+fingerprints to enter in Okta, Azure AD, Google Workspace or Keycloak when
+creating the SAML app for aws-llama.
+
+Once the app exists, add its IdP metadata URL as an account's metadata_url in
+~/.aws-llama.json.
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		providers := idpSetupProviderNames()
+		if idpSetupProvider != "" {
+			if _, ok := idpSetupTemplates[idpSetupProvider]; !ok {
+				fmt.Fprintf(os.Stderr, "aws-llama: unknown provider %q, expected one of: %s\n", idpSetupProvider, strings.Join(providers, ", "))
+				os.Exit(1)
+			}
+			providers = []string{idpSetupProvider}
+		}
+
+		_, cert, err := saml.ServiceProviderKeyPair()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "aws-llama: %s\n", err)
+			os.Exit(1)
+		}
+		sha1Sum := sha1.Sum(cert.Raw)
+		sha256Sum := sha256.Sum256(cert.Raw)
+		values := idpSetupValues{
+			ACSURL:                   saml.ACSURL(),
+			EntityID:                 saml.EntityID(),
+			SPMetadataURL:            saml.SPMetadataURL(),
+			RoleAttribute:            saml.ROLE_ATTRIBUTE,
+			RoleSessionNameAttribute: saml.ROLE_SESSION_NAME_ATTRIBUTE,
+			SessionDurationAttribute: saml.SESSION_DURATION_ATTRIBUTE,
+			CertificateSHA1:          fingerprint(sha1Sum[:]),
+			CertificateSHA256:        fingerprint(sha256Sum[:]),
+		}
+
+		text := idpSetupAttributes + "\n" + idpSetupCertificate
+		for _, provider := range providers {
+			text += "\n" + idpSetupTemplates[provider]
+		}
+		tmpl := template.Must(template.New("idp-setup").Parse(text))
+		fmt.Printf("ACS URL:            %s\nAudience/Entity ID: %s\nSP metadata:        %s\n\n", values.ACSURL, values.EntityID, values.SPMetadataURL)
+		err = tmpl.Execute(os.Stdout, values)
+		if err != nil {
+			panic(err)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(idpSetupCmd)
+
+	idpSetupCmd.Flags().StringVar(&idpSetupProvider, "provider", "", "Only print the steps for one IdP: okta, azure, google or keycloak.")
+}
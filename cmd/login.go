@@ -0,0 +1,102 @@
+package cmd
+
+import (
+	"aws-llama/config"
+	"aws-llama/secrets"
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"golang.org/x/term"
+)
+
+var setPasswordUsername string
+var setPasswordFromStdin bool
+
+// loginCmd represents the login command
+var loginCmd = &cobra.Command{
+	Use:   "login",
+	Short: "Manage the IdP login used for automated authentication.",
+	Long:  `Manage the IdP login used for automated authentication.`,
+}
+
+// setPasswordCmd represents the login set-password command
+var setPasswordCmd = &cobra.Command{
+	Use:   "set-password",
+	Short: "Store the IdP password in the configured password backend.",
+	Long: `Stores the IdP password in the backend configured by "password_backend" in
+~/.aws-llama.json (secret-service, pass or file), so that it doesn't have to be
+kept in plaintext in the config file.
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		username := setPasswordUsername
+		if username == "" {
+			username = config.Current().Username
+		}
+		if username == "" {
+			fmt.Fprintln(os.Stderr, "No username configured: set \"username\" in ~/.aws-llama.json or pass --username.")
+			os.Exit(1)
+		}
+
+		backend, err := secrets.NewBackend(config.Current().PasswordBackend)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s. Set \"password_backend\" in ~/.aws-llama.json first.\n", err)
+			os.Exit(1)
+		}
+
+		password, err := readPassword(username)
+		if err != nil {
+			panic(err)
+		}
+
+		err = backend.Set(username, password)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		fmt.Printf("Stored the password for %s in the %s backend.\n", username, config.Current().PasswordBackend.Type)
+		if config.Current().Password != "" {
+			fmt.Println("Remove \"password\" from ~/.aws-llama.json, it takes precedence over the backend.")
+		}
+	},
+}
+
+func readPassword(username string) (string, error) {
+	if setPasswordFromStdin {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && line == "" {
+			return "", err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			return "", errors.New("empty password")
+		}
+		return line, nil
+	}
+
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return "", errors.New("stdin is not a terminal, use --stdin to pipe the password")
+	}
+	fmt.Fprintf(os.Stderr, "Password for %s: ", username)
+	password, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", err
+	}
+	if len(password) == 0 {
+		return "", errors.New("empty password")
+	}
+	return string(password), nil
+}
+
+func init() {
+	rootCmd.AddCommand(loginCmd)
+	loginCmd.AddCommand(setPasswordCmd)
+
+	setPasswordCmd.Flags().StringVar(&setPasswordUsername, "username", "", "Username to store the password for (defaults to the configured username).")
+	setPasswordCmd.Flags().BoolVar(&setPasswordFromStdin, "stdin", false, "Read the password from the first line of stdin instead of prompting.")
+}
@@ -6,7 +6,9 @@ package cmd
 import (
 	"aws-llama/api"
 	"aws-llama/browser"
+	"aws-llama/credentials"
 	"aws-llama/log"
+	"os"
 
 	"github.com/gin-gonic/gin"
 	"github.com/spf13/cobra"
@@ -18,6 +20,11 @@ var refreshCmd = &cobra.Command{
 	Short: "Make a one-time refresh of all credentials",
 	Long:  `This makes a one-time refresh of all credentials`,
 	Run: func(cmd *cobra.Command, args []string) {
+		err := credentials.CredentialStore.Load()
+		if err != nil {
+			log.Logger.Errorf("Failed to load persisted credentials, starting empty: %s", err.Error())
+		}
+
 		var r *gin.Engine
 		if !api.IsWebserverRunning() {
 			log.Logger.Info("Webserver is not running, starting one.")
@@ -25,7 +32,11 @@ var refreshCmd = &cobra.Command{
 			go api.RunWebserver(r)
 		}
 
-		browser.AttemptAuthentication()
+		err = browser.AttemptAuthentication()
+		if err != nil {
+			log.Logger.Errorf("One-shot credential refresh failed: %s", err.Error())
+			os.Exit(1)
+		}
 		log.Logger.Info("Finished one-shot credential refresh. Exiting.")
 	},
 }
@@ -0,0 +1,71 @@
+package cmd
+
+import (
+	"aws-llama/api"
+	"aws-llama/config"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// rolesCmd represents the roles command
+var rolesCmd = &cobra.Command{
+	Use:   "roles",
+	Short: "Show which granted roles are assumed or filtered out.",
+	Long: `Shows every role granted by the IdP in the latest login of each account, and
+whether the account's "roles" filter includes or excludes it.
+
+Requires a running 'serve' instance that has logged in at least once. Filters are
+evaluated against the config 'serve' has in effect, which picks up edits to
+~/.aws-llama.json within about 10 seconds.
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if !api.IsWebserverRunning() {
+			fmt.Fprintln(os.Stderr, "aws-llama is not running. Start it with 'aws-llama serve' first.")
+			os.Exit(1)
+		}
+
+		requestURL := config.Current().RootUrl.ResolveReference(&url.URL{Path: "/roles"})
+		client := http.Client{Timeout: 10 * time.Second}
+		response, err := client.Get(requestURL.String())
+		if err != nil {
+			panic(err)
+		}
+		defer response.Body.Close()
+
+		var body struct {
+			Accounts []api.AccountRoles `json:"accounts"`
+		}
+		err = json.NewDecoder(response.Body).Decode(&body)
+		if err != nil {
+			panic(err)
+		}
+		if len(body.Accounts) == 0 {
+			fmt.Println("No logins seen yet. Run 'aws-llama refresh' and try again.")
+			return
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "ACCOUNT\tNICKNAME\tROLE\tSTATUS\tREASON")
+		for _, account := range body.Accounts {
+			for _, role := range account.Roles {
+				status := "excluded"
+				if role.Included {
+					status = "included"
+				}
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", role.AccountId, account.Nickname, role.RoleName, status, role.Reason)
+			}
+		}
+		w.Flush()
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(rolesCmd)
+}
@@ -3,21 +3,55 @@ package cmd
 import (
 	"aws-llama/api"
 	"aws-llama/browser"
+	"aws-llama/config"
+	"aws-llama/credentials"
+	"aws-llama/fakests"
 	"aws-llama/log"
+	"aws-llama/saml"
+	"context"
+	"time"
 
 	"github.com/spf13/cobra"
 )
 
+// How often to check ~/.aws-llama.json for changes.
+const CONFIG_WATCH_INTERVAL = 10 * time.Second
+
+var serveFakeSTS bool
+
 // serveCmd represents the serve command
 var serveCmd = &cobra.Command{
 	Use:   "serve",
 	Short: "Start the main webserver instance responsible for refreshing credentials",
 	Long:  `Start the main webserver instance responsible for refreshing credentials`,
 	Run: func(cmd *cobra.Command, args []string) {
+		if serveFakeSTS {
+			log.Logger.Warn("Using the fake STS: credentials won't work against AWS.")
+			saml.STS = fakests.New()
+		}
+
+		err := credentials.CredentialStore.Load()
+		if err != nil {
+			log.Logger.Errorf("Failed to load persisted credentials, starting empty: %s", err.Error())
+		}
+
+		_, err = api.LoadOrCreateToken()
+		if err != nil {
+			log.Logger.Errorf("Failed to create the credential-process token: %s", err.Error())
+		}
+
 		log.Logger.Debug("Starting webserver!")
 		r := api.CreateGinWebserver()
 		go api.RunWebserver(r)
 
+		// Re-check right away when accounts are added or changed.
+		go config.WatchConfig(CONFIG_WATCH_INTERVAL, browser.ForceRefresh)
+
+		// Keep IdP metadata fresh, so that logins don't wait for it.
+		go saml.WatchMetadata(context.Background(), saml.METADATA_REFRESH_INTERVAL)
+
+		browser.WatchForResume(context.Background())
+
 		log.Logger.Debug("Starting auth loop!")
 		browser.AuthenticationLoop()
 	},
@@ -35,4 +69,5 @@ func init() {
 	// Cobra supports local flags which will only run when this command
 	// is called directly, e.g.:
 	// serveCmd.Flags().BoolP("toggle", "t", false, "Help message for toggle")
+	serveCmd.Flags().BoolVar(&serveFakeSTS, "fake-sts", false, "Mint fake credentials instead of calling STS, for use with 'aws-llama dev-idp'.")
 }
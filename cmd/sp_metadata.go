@@ -0,0 +1,57 @@
+package cmd
+
+import (
+	"aws-llama/saml"
+	"encoding/pem"
+	"encoding/xml"
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+)
+
+var spMetadataCertificate bool
+
+// spMetadataCmd represents the sp-metadata command
+var spMetadataCmd = &cobra.Command{
+	Use:   "sp-metadata",
+	Short: "Print the SAML service provider metadata to register in the IdP.",
+	Long: `Prints the metadata of aws-llama as a SAML service provider: its entity ID, ACS
+URL and the certificate of the SP key pair. Register it in the IdP to have it
+verify signed AuthnRequests and encrypt assertions. A running 'serve' instance
+serves the same metadata at http://localhost:2600/saml/metadata.
+
+The key pair is read from sp_key_file and sp_cert_file in ~/.aws-llama.json, or
+generated as ~/.aws-llama-sp-key.pem and ~/.aws-llama-sp-cert.pem on first use.
+With encrypted assertions, upload the private key to the IAM SAML provider too, so
+that STS can decrypt them.
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if spMetadataCertificate {
+			_, cert, err := saml.ServiceProviderKeyPair()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "aws-llama: %s\n", err)
+				os.Exit(1)
+			}
+			pem.Encode(os.Stdout, &pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+			return
+		}
+
+		metadata, err := saml.ServiceProviderMetadata()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "aws-llama: %s\n", err)
+			os.Exit(1)
+		}
+		out, err := xml.MarshalIndent(metadata, "", "  ")
+		if err != nil {
+			panic(err)
+		}
+		fmt.Println(string(out))
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(spMetadataCmd)
+
+	spMetadataCmd.Flags().BoolVar(&spMetadataCertificate, "certificate", false, "Print only the PEM certificate.")
+}
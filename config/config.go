@@ -1,16 +1,128 @@
 package config
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"net/url"
 	"os"
 	"path/filepath"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"text/template"
 )
 
+const (
+	// Rewrite ~/.aws/credentials from scratch, backing up a foreign file once.
+	CredentialsModeReplace = "replace"
+	// Only update the profiles aws-llama owns, keeping everything else in the file.
+	CredentialsModeMerge = "merge"
+)
+
+const (
+	EncryptionModeNone = ""
+	// Random key stored in the Secret Service (via secret-tool).
+	EncryptionModeSecretService = "secret-service"
+	// Random key stored in the Linux kernel user keyring (via keyctl).
+	EncryptionModeKeyring = "keyring"
+	// Key derived from a passphrase (passphrase_file or $AWS_LLAMA_PASSPHRASE).
+	EncryptionModePassphrase = "passphrase"
+)
+
+// Encryption at rest of the browser storage state and the persisted credential store.
+type Encryption struct {
+	Mode           string `json:"mode"`
+	PassphraseFile string `json:"passphrase_file"`
+}
+
+const (
+	PasswordBackendNone          = ""
+	PasswordBackendSecretService = "secret-service"
+	PasswordBackendPass          = "pass"
+	PasswordBackendFile          = "file"
+	PasswordBackendEnv           = "env"
+)
+
+// Where to find the IdP password when it isn't in this file.
+type PasswordBackend struct {
+	Type string `json:"type"`
+	// Entry name for "pass". Defaults to aws-llama/<username>.
+	PassEntry string `json:"pass_entry"`
+	// Path of the encrypted password for "file". Defaults to ~/.aws-llama-password.
+	File string `json:"file"`
+	// Environment variable for "env". Defaults to AWS_LLAMA_PASSWORD.
+	Env string `json:"env"`
+}
+
+const (
+	// HTTP-Redirect when the IdP supports it, HTTP-POST otherwise.
+	BindingAuto     = ""
+	BindingRedirect = "redirect"
+	BindingPost     = "post"
+)
+
+// Upper bound AWS sets for the session of a role assumed through role chaining.
+const MAX_CHAINED_DURATION_SECONDS = 3600
+
+// A role assumed with sts:AssumeRole using the credentials of a SAML role.
+type ChainedRole struct {
+	// The source credentials, either by the profile they are written to or by the
+	// ARN of the SAML role.
+	SourceProfile string `json:"source_profile"`
+	SourceRoleARN string `json:"source_role_arn"`
+
+	RoleARN         string `json:"role_arn"`
+	ExternalID      string `json:"external_id"`
+	SessionName     string `json:"session_name"`
+	DurationSeconds int64  `json:"duration_seconds"`
+	// Profile name for the chained credentials. Defaults to profile_template.
+	Profile string `json:"profile"`
+}
+
 type Account struct {
-	MetadataURL string `json:"metadata_url"`
-	Nickname    string `json:"nickname"`
+	// Identifies the account in the credential store, RelayState and /login.
+	// Derived from the IdP metadata source when not set, so setting it keeps
+	// credentials attached to the account when that source changes.
+	ID string `json:"id"`
+
+	// The IdP metadata, exactly one of: fetched from a URL, read from a file, or
+	// inline XML.
+	MetadataURL  string `json:"metadata_url"`
+	MetadataFile string `json:"metadata_file"`
+	MetadataXML  string `json:"metadata_xml"`
+	// Overrides the SSO endpoint of the IdP metadata.
+	IdPSSOURL string `json:"idp_sso_url"`
+	// SHA-256 fingerprints of the IdP signing certificates to trust. Other
+	// certificates in the metadata are ignored.
+	IdPCertificateFingerprints []string `json:"idp_certificate_fingerprints"`
+	// Origins besides those of the IdP SSO endpoints that may post SAML
+	// responses, for IdPs that post them from another host.
+	AllowedOrigins []string `json:"allowed_origins"`
+
+	Nickname string `json:"nickname"`
+	// SAML binding used to send AuthnRequests to the IdP.
+	Binding string `json:"binding"`
+	// Sign AuthnRequests with the SP key. Defaults to false.
+	SignRequests *bool `json:"sign_requests"`
+
+	// Settings written to the account's profiles in ~/.aws/config (with manage_aws_config).
+	Region   string  `json:"region"`
+	Output   string  `json:"output"`
+	CliPager *string `json:"cli_pager"`
+
+	// Requested session length in seconds (900-43200). Defaults to the
+	// SessionDuration attribute of the assertion, or one hour.
+	SessionDuration int64 `json:"session_duration"`
+
+	Roles RoleFilter `json:"roles"`
+
+	// STS region, defaulting to one in the partition of the SAML provider ARN.
+	STSRegion string `json:"sts_region"`
+	// Custom STS endpoint URL, e.g. for a VPC endpoint or LocalStack.
+	STSEndpoint string `json:"sts_endpoint"`
 }
 
 type Config struct {
@@ -19,16 +131,218 @@ type Config struct {
 	RootUrl            *url.URL
 	ChromeUserDataDir  string
 	ListenPort         int
-	Username           string `json:"username"`
-	Password           string `json:"password"`
+	Username           string          `json:"username"`
+	Password           string          `json:"password"`
+	PasswordBackend    PasswordBackend `json:"password_backend"`
 	StorageStatePath   string
+	// Where the credential store is persisted between daemon restarts.
+	StatePath string
+	// Where the token that authorizes credential requests to the daemon is kept.
+	TokenPath string
+	// Where fetched IdP metadata is cached between daemon restarts. Not cached
+	// on disk when empty.
+	MetadataCacheDir string
+	// Go template used to name profiles, e.g. "{{.Nickname}}-{{.RoleName}}".
+	ProfileTemplate string `json:"profile_template"`
+	CredentialsMode string `json:"credentials_mode"`
+	// Serve credentials through `aws-llama credential-process` instead of writing them to disk.
+	CredentialProcess bool `json:"credential_process"`
+	// Write a managed profile for every role to ~/.aws/config as well.
+	ManageAWSConfig bool       `json:"manage_aws_config"`
+	Encryption      Encryption `json:"encryption"`
+	// Roles to assume from SAML-derived credentials after every refresh.
+	ChainedRoles []ChainedRole `json:"chained_roles"`
+	// Proxy URL and PEM CA bundle for requests to STS and the IdP metadata.
+	HTTPProxy string `json:"http_proxy"`
+	CABundle  string `json:"ca_bundle"`
+	// PEM key pair of the SP, used to sign AuthnRequests and decrypt assertions.
+	// Generated in the home directory when not set.
+	SPKeyFile  string `json:"sp_key_file"`
+	SPCertFile string `json:"sp_cert_file"`
 }
 
 func (c *Config) HasLogin() bool {
-	return c.Username != "" && c.Password != ""
+	return c.Username != "" && (c.Password != "" || c.PasswordBackend.Type != PasswordBackendNone)
+}
+
+func (c *Config) AccountForKey(key string) *Account {
+	for idx := range c.Accounts {
+		if c.Accounts[idx].Key() == key {
+			return &c.Accounts[idx]
+		}
+	}
+	return nil
+}
+
+// The stable key of the account: its id, or a hash of its metadata source.
+func (a *Account) Key() string {
+	if a.ID != "" {
+		return a.ID
+	}
+
+	var source string
+	switch {
+	case a.MetadataURL != "":
+		source = "metadata_url:" + a.MetadataURL
+	case a.MetadataFile != "":
+		source = "metadata_file:" + a.MetadataFile
+	default:
+		source = "metadata_xml:" + a.MetadataXML
+	}
+	sum := sha256.Sum256([]byte(source))
+	return hex.EncodeToString(sum[:8])
+}
+
+// Names the account in messages: its id, or where its metadata comes from.
+func (a *Account) Name() string {
+	switch {
+	case a.ID != "":
+		return a.ID
+	case a.MetadataURL != "":
+		return a.MetadataURL
+	case a.MetadataFile != "":
+		return a.MetadataFile
+	case a.Nickname != "":
+		return a.Nickname
+	default:
+		return "account with metadata_xml"
+	}
+}
+
+var sha256Fingerprint = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// Lowercases a certificate fingerprint and drops the colons and spaces IdPs
+// show it with.
+func NormalizeFingerprint(fingerprint string) string {
+	return strings.ToLower(strings.NewReplacer(":", "", " ", "").Replace(fingerprint))
+}
+
+func (a *Account) SignsRequests() bool {
+	return a.SignRequests != nil && *a.SignRequests
+}
+
+func (c *Config) validate() error {
+	switch c.CredentialsMode {
+	case CredentialsModeReplace, CredentialsModeMerge:
+	default:
+		return fmt.Errorf("invalid credentials_mode %q: expected %q or %q", c.CredentialsMode, CredentialsModeReplace, CredentialsModeMerge)
+	}
+	switch c.PasswordBackend.Type {
+	case PasswordBackendNone, PasswordBackendSecretService, PasswordBackendPass, PasswordBackendFile, PasswordBackendEnv:
+	default:
+		return fmt.Errorf("invalid password_backend type %q", c.PasswordBackend.Type)
+	}
+	switch c.Encryption.Mode {
+	case EncryptionModeNone, EncryptionModeSecretService, EncryptionModeKeyring, EncryptionModePassphrase:
+	default:
+		return fmt.Errorf("invalid encryption mode %q", c.Encryption.Mode)
+	}
+	keys := make(map[string]bool)
+	for _, account := range c.Accounts {
+		sources := 0
+		for _, source := range []string{account.MetadataURL, account.MetadataFile, account.MetadataXML} {
+			if source != "" {
+				sources++
+			}
+		}
+		if sources != 1 {
+			return fmt.Errorf("%s needs exactly one of metadata_url, metadata_file and metadata_xml", account.Name())
+		}
+		if keys[account.Key()] {
+			return fmt.Errorf("duplicate account %s: set a distinct id on each", account.Name())
+		}
+		keys[account.Key()] = true
+		if account.IdPSSOURL != "" {
+			parsed, err := url.Parse(account.IdPSSOURL)
+			if err != nil || !parsed.IsAbs() {
+				return fmt.Errorf("invalid idp_sso_url %q for %s: expected an absolute URL", account.IdPSSOURL, account.Name())
+			}
+		}
+		for _, origin := range account.AllowedOrigins {
+			parsed, err := url.Parse(origin)
+			if err != nil || parsed.Scheme == "" || parsed.Host == "" {
+				return fmt.Errorf("invalid allowed_origins entry %q for %s: expected e.g. https://idp.example.com", origin, account.Name())
+			}
+		}
+		for _, fingerprint := range account.IdPCertificateFingerprints {
+			if !sha256Fingerprint.MatchString(NormalizeFingerprint(fingerprint)) {
+				return fmt.Errorf("invalid idp_certificate_fingerprints entry %q for %s: expected a SHA-256 fingerprint", fingerprint, account.Name())
+			}
+		}
+		switch account.Binding {
+		case BindingAuto, BindingRedirect, BindingPost:
+		default:
+			return fmt.Errorf("invalid binding %q for %s: expected %q or %q", account.Binding, account.Name(), BindingRedirect, BindingPost)
+		}
+		if account.SessionDuration != 0 && (account.SessionDuration < 900 || account.SessionDuration > 43200) {
+			return fmt.Errorf("invalid session_duration %d for %s: must be between 900 and 43200 seconds", account.SessionDuration, account.Name())
+		}
+		for _, matcher := range []RoleMatcher{account.Roles.Include, account.Roles.Exclude} {
+			err := matcher.validate()
+			if err != nil {
+				return fmt.Errorf("invalid roles filter for %s: %w", account.Name(), err)
+			}
+		}
+	}
+	for _, chained := range c.ChainedRoles {
+		if chained.RoleARN == "" {
+			return fmt.Errorf("chained_roles entry without a role_arn")
+		}
+		if (chained.SourceProfile == "") == (chained.SourceRoleARN == "") {
+			return fmt.Errorf("chained role %s needs exactly one of source_profile and source_role_arn", chained.RoleARN)
+		}
+		// AWS caps sessions of roles assumed with role credentials at an hour,
+		// whatever the role's maximum session duration.
+		if chained.DurationSeconds != 0 && (chained.DurationSeconds < 900 || chained.DurationSeconds > MAX_CHAINED_DURATION_SECONDS) {
+			return fmt.Errorf("invalid duration_seconds %d for chained role %s: must be between 900 and %d seconds for role chaining", chained.DurationSeconds, chained.RoleARN, MAX_CHAINED_DURATION_SECONDS)
+		}
+	}
+	if c.HTTPProxy != "" {
+		_, err := url.Parse(c.HTTPProxy)
+		if err != nil {
+			return fmt.Errorf("invalid http_proxy %q: %w", c.HTTPProxy, err)
+		}
+	}
+	for _, account := range c.Accounts {
+		if account.STSEndpoint != "" {
+			_, err := url.Parse(account.STSEndpoint)
+			if err != nil {
+				return fmt.Errorf("invalid sts_endpoint %q for %s: %w", account.STSEndpoint, account.Name(), err)
+			}
+		}
+	}
+	if (c.SPKeyFile == "") != (c.SPCertFile == "") {
+		return fmt.Errorf("sp_key_file and sp_cert_file must be set together")
+	}
+	if c.ProfileTemplate != "" {
+		_, err := template.New("profile").Option("missingkey=error").Funcs(PROFILE_TEMPLATE_FUNCS).Parse(c.ProfileTemplate)
+		if err != nil {
+			return fmt.Errorf("invalid profile_template %q: %w", c.ProfileTemplate, err)
+		}
+	}
+	return nil
+}
+
+// Functions available to the profile_template besides the text/template builtins.
+var PROFILE_TEMPLATE_FUNCS = template.FuncMap{
+	"lower": strings.ToLower,
+	"upper": strings.ToUpper,
 }
 
-var CurrentConfig *Config
+// The config in effect. A reload swaps in a new Config rather than modifying
+// this one, so the handlers and goroutines reading it never race with it.
+var currentConfig atomic.Pointer[Config]
+
+// Returns the config in effect. Callers that need several settings to agree
+// should read it once; a reload may replace it between calls.
+func Current() *Config {
+	return currentConfig.Load()
+}
+
+// Puts config in effect.
+func SetCurrent(config *Config) {
+	currentConfig.Store(config)
+}
 
 func InitConfig() {
 	config, err := loadConfigFromJSON()
@@ -36,15 +350,22 @@ func InitConfig() {
 		panic(err)
 	}
 
-	CurrentConfig = config
+	SetCurrent(config)
 }
 
-func loadConfigFromJSON() (*Config, error) {
+func configPath() (string, error) {
 	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(homeDir, ".aws-llama.json"), nil
+}
+
+func loadConfigFromJSON() (*Config, error) {
+	configFp, err := configPath()
 	if err != nil {
 		return nil, err
 	}
-	configFp := filepath.Join(homeDir, ".aws-llama.json")
 
 	bytes, err := os.ReadFile(configFp)
 	if err != nil {
@@ -67,6 +388,18 @@ func loadConfigFromJSON() (*Config, error) {
 	if err != nil {
 		return nil, err
 	}
+	statePath, err := getStatePath()
+	if err != nil {
+		return nil, err
+	}
+	metadataCacheDir, err := getMetadataCacheDir()
+	if err != nil {
+		return nil, err
+	}
+	tokenPath, err := getTokenPath()
+	if err != nil {
+		return nil, err
+	}
 
 	config := Config{
 		RootUrl:            rootUrl,
@@ -74,6 +407,10 @@ func loadConfigFromJSON() (*Config, error) {
 		ChromeUserDataDir:  userDataDir,
 		ListenPort:         2600,
 		StorageStatePath:   storageStatePath,
+		StatePath:          statePath,
+		TokenPath:          tokenPath,
+		MetadataCacheDir:   metadataCacheDir,
+		CredentialsMode:    CredentialsModeReplace,
 	}
 	if bytes != nil {
 		err = json.Unmarshal(bytes, &config)
@@ -82,6 +419,11 @@ func loadConfigFromJSON() (*Config, error) {
 		}
 	}
 
+	err = config.validate()
+	if err != nil {
+		return nil, err
+	}
+
 	return &config, nil
 }
 
@@ -114,3 +456,30 @@ func getStorageStatePath() (string, error) {
 	}
 	return storagePath, nil
 }
+
+func getStatePath() (string, error) {
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(homeDir, ".aws-llama-state.json"), nil
+}
+
+func getMetadataCacheDir() (string, error) {
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(homeDir, ".aws-llama-metadata"), nil
+}
+
+func getTokenPath() (string, error) {
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(homeDir, ".aws-llama-token"), nil
+}
@@ -0,0 +1,60 @@
+package config
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateChainedRoleDuration(t *testing.T) {
+	cases := []struct {
+		duration int64
+		valid    bool
+	}{
+		{0, true},
+		{900, true},
+		{3600, true},
+		{899, false},
+		{3601, false},
+		{43200, false},
+	}
+	for _, c := range cases {
+		config := Config{
+			CredentialsMode: CredentialsModeReplace,
+			ChainedRoles: []ChainedRole{{
+				SourceProfile:   "llama-123456789012-landing",
+				RoleARN:         "arn:aws:iam::210987654321:role/workload-admin",
+				DurationSeconds: c.duration,
+			}},
+		}
+		err := config.validate()
+		if c.valid && err != nil {
+			t.Errorf("duration_seconds %d: unexpected error %s", c.duration, err)
+		}
+		if !c.valid && (err == nil || !strings.Contains(err.Error(), "duration_seconds")) {
+			t.Errorf("duration_seconds %d: expected it to be rejected, got %v", c.duration, err)
+		}
+	}
+}
+
+func TestValidateProfileTemplate(t *testing.T) {
+	cases := []struct {
+		template string
+		valid    bool
+	}{
+		{"{{.AccountId}}-{{.RoleName}}", true},
+		{"{{.Nickname}}-{{lower .RoleName}}", true},
+		{"{{upper .Role}}", true},
+		{"{{.RoleName", false},
+		{"{{title .RoleName}}", false},
+	}
+	for _, c := range cases {
+		config := Config{CredentialsMode: CredentialsModeReplace, ProfileTemplate: c.template}
+		err := config.validate()
+		if c.valid && err != nil {
+			t.Errorf("profile_template %q: unexpected error %s", c.template, err)
+		}
+		if !c.valid && (err == nil || !strings.Contains(err.Error(), "profile_template")) {
+			t.Errorf("profile_template %q: expected it to be rejected, got %v", c.template, err)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package config
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+)
+
+// Criteria matching roles from the assertion. A role matches if any criterion does.
+type RoleMatcher struct {
+	// Exact role ARNs.
+	ARNs []string `json:"arns"`
+	// Globs on the role name, e.g. "*-readonly".
+	Names []string `json:"names"`
+	// Regular expressions on the role ARN.
+	Patterns []string `json:"patterns"`
+	// Account IDs.
+	Accounts []string `json:"accounts"`
+}
+
+func (r *RoleMatcher) IsEmpty() bool {
+	return len(r.ARNs) == 0 && len(r.Names) == 0 && len(r.Patterns) == 0 && len(r.Accounts) == 0
+}
+
+func (r *RoleMatcher) validate() error {
+	for _, glob := range r.Names {
+		_, err := path.Match(glob, "")
+		if err != nil {
+			return fmt.Errorf("invalid role name glob %q: %w", glob, err)
+		}
+	}
+	for _, pattern := range r.Patterns {
+		_, err := regexp.Compile(pattern)
+		if err != nil {
+			return fmt.Errorf("invalid role pattern %q: %w", pattern, err)
+		}
+	}
+	return nil
+}
+
+// Which roles from the assertion to assume. Without an include filter, all roles
+// are included; excludes are applied afterwards.
+type RoleFilter struct {
+	Include RoleMatcher `json:"include"`
+	Exclude RoleMatcher `json:"exclude"`
+}
+
+// Describes the first criterion of the matcher that matches the role, or "".
+func (r *RoleMatcher) match(roleARN string, accountId string, roleName string) string {
+	for _, arn := range r.ARNs {
+		if arn == roleARN {
+			return "arn " + arn
+		}
+	}
+	for _, glob := range r.Names {
+		matched, err := path.Match(glob, roleName)
+		if err == nil && matched {
+			return "name " + glob
+		}
+	}
+	for _, pattern := range r.Patterns {
+		// Validated when the config is loaded.
+		matched, err := regexp.MatchString(pattern, roleARN)
+		if err == nil && matched {
+			return "pattern " + pattern
+		}
+	}
+	for _, account := range r.Accounts {
+		if account == accountId {
+			return "account " + account
+		}
+	}
+	return ""
+}
+
+// Returns whether the role should be assumed, and why.
+func (f *RoleFilter) Decide(roleARN string, accountId string, roleName string) (bool, string) {
+	if !f.Include.IsEmpty() {
+		reason := f.Include.match(roleARN, accountId, roleName)
+		if reason == "" {
+			return false, "not matched by the include filter"
+		}
+		if excluded := f.Exclude.match(roleARN, accountId, roleName); excluded != "" {
+			return false, "excluded by " + excluded
+		}
+		return true, "included by " + reason
+	}
+
+	if excluded := f.Exclude.match(roleARN, accountId, roleName); excluded != "" {
+		return false, "excluded by " + excluded
+	}
+	return true, "no include filter"
+}
@@ -0,0 +1,57 @@
+package config
+
+import (
+	"aws-llama/log"
+	"os"
+	"time"
+)
+
+// Re-reads the config file and puts it in effect.
+func ReloadConfig() error {
+	config, err := loadConfigFromJSON()
+	if err != nil {
+		return err
+	}
+
+	SetCurrent(config)
+	return nil
+}
+
+// Polls the config file every interval, reloading it and calling onChange
+// whenever it has been modified. An invalid config is logged and ignored, so
+// the previous one stays in effect. Never returns.
+func WatchConfig(interval time.Duration, onChange func()) {
+	configFp, err := configPath()
+	if err != nil {
+		log.Logger.Errorf("Not watching the config file for changes: %s", err.Error())
+		return
+	}
+
+	lastModified := modificationTime(configFp)
+	for {
+		time.Sleep(interval)
+
+		modified := modificationTime(configFp)
+		if modified.Equal(lastModified) {
+			continue
+		}
+		lastModified = modified
+
+		err := ReloadConfig()
+		if err != nil {
+			log.Logger.Errorf("Ignoring changes to %s: %s", configFp, err.Error())
+			continue
+		}
+		log.Logger.Info("Reloaded config from ", configFp)
+		onChange()
+	}
+}
+
+// Returns the zero time for a missing file, so creating or removing it counts as a change.
+func modificationTime(path string) time.Time {
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
@@ -0,0 +1,126 @@
+package credentials
+
+import (
+	"aws-llama/config"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/ini.v1"
+)
+
+func getConfigPath() (string, error) {
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(homeDir, ".aws/config"), nil
+}
+
+// ~/.aws/config prefixes every section except the default one with "profile ".
+func configSectionName(profileName string) string {
+	if profileName == "default" {
+		return profileName
+	}
+	return "profile " + profileName
+}
+
+// Quotes an argument for the shell-like splitting the AWS SDKs apply to credential_process.
+func quoteProcessArg(arg string) string {
+	if !strings.ContainsAny(arg, " \t\"") {
+		return arg
+	}
+	return "\"" + strings.ReplaceAll(arg, "\"", "\\\"") + "\""
+}
+
+func credentialProcessCommand(profileName string) (string, error) {
+	executable, err := os.Executable()
+	if err != nil {
+		return "", err
+	}
+
+	args := []string{executable, "credential-process", "--profile", profileName, "--wait"}
+	for idx, arg := range args {
+		args[idx] = quoteProcessArg(arg)
+	}
+	return strings.Join(args, " "), nil
+}
+
+func (a *AWSCredentialEntry) writeToConfigIni(iniFile *ini.File, profileName string) error {
+	section := iniFile.Section(configSectionName(profileName))
+	section.Comment = MANAGED_SECTION_MARKER
+
+	account := config.Current().AccountForKey(a.AccountKey)
+	if account != nil {
+		if account.Region != "" {
+			section.Key("region").SetValue(account.Region)
+		}
+		if account.Output != "" {
+			section.Key("output").SetValue(account.Output)
+		}
+		if account.CliPager != nil {
+			// An empty value is meaningful here: it disables the pager.
+			section.Key("cli_pager").SetValue(*account.CliPager)
+		}
+	}
+
+	if config.Current().CredentialProcess {
+		command, err := credentialProcessCommand(profileName)
+		if err != nil {
+			return err
+		}
+		section.Key("credential_process").SetValue(command)
+	}
+	return nil
+}
+
+// Whether contents has any section aws-llama owns.
+func hasManagedSections(contents []byte) bool {
+	for _, block := range splitIniBlocks(string(contents)) {
+		if block.managed {
+			return true
+		}
+	}
+	return false
+}
+
+// Merges the profiles aws-llama owns into ~/.aws/config. Unlike the credentials
+// file, the config file is never replaced wholesale. With no credentials, only
+// previously managed profiles are removed, and a file without any is left alone.
+func writeAWSConfig(credentials []AWSCredentialEntry, profileNames []string) error {
+	managed := ini.Empty()
+	for idx, credential := range credentials {
+		err := credential.writeToConfigIni(managed, profileNames[idx])
+		if err != nil {
+			return err
+		}
+	}
+
+	configPath, err := getConfigPath()
+	if err != nil {
+		return err
+	}
+	if len(credentials) == 0 {
+		existing, err := readIniForMerge(configPath)
+		if err != nil || !hasManagedSections(existing) {
+			return err
+		}
+	}
+
+	return updateFileLocked(configPath, func(path string, w io.Writer) error {
+		existing, err := readIniForMerge(path)
+		if err != nil {
+			return err
+		}
+		merged, err := mergeManagedSections(existing, managed)
+		if err != nil {
+			return fmt.Errorf("failed to merge into config file %s: %w", path, err)
+		}
+
+		_, err = w.Write(merged)
+		return err
+	})
+}
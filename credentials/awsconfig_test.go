@@ -0,0 +1,110 @@
+package credentials
+
+import (
+	"aws-llama/config"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStoreCredentialsMergesAWSConfig(t *testing.T) {
+	const profile = "llama-111111111111-developer"
+	command, err := credentialProcessCommand(profile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	foreign := "[default]\nregion=us-west-2\n\n[profile personal]\noutput = json\n"
+	stale := "; managed by aws-llama\n[profile llama-111111111111-developer]\nregion = us-east-1\n"
+
+	cases := []struct {
+		name              string
+		manageAWSConfig   bool
+		credentialProcess bool
+		// nil for no config file.
+		existing *string
+		// nil for no config file afterwards.
+		expected *string
+	}{
+		{
+			name:            "manage_aws_config",
+			manageAWSConfig: true,
+			existing:        &foreign,
+			expected:        ptr(foreign + "\n; managed by aws-llama\n[profile " + profile + "]\nregion = eu-central-1\noutput = text\n"),
+		},
+		{
+			name:              "credential_process",
+			credentialProcess: true,
+			expected:          ptr("; managed by aws-llama\n[profile " + profile + "]\nregion = eu-central-1\noutput = text\ncredential_process = " + command + "\n"),
+		},
+		{
+			name:     "disabled removes stale profiles",
+			existing: ptr(foreign + "\n" + stale),
+			expected: ptr(foreign + "\n"),
+		},
+		{
+			name:     "disabled leaves other files alone",
+			existing: &foreign,
+			expected: &foreign,
+		},
+		{
+			name: "disabled creates no file",
+		},
+	}
+	for _, c := range cases {
+		home := t.TempDir()
+		t.Setenv("HOME", home)
+		configPath := filepath.Join(home, ".aws", "config")
+		previousConfig := config.Current()
+		config.SetCurrent(&config.Config{
+			CredentialsMode:   config.CredentialsModeMerge,
+			ManageAWSConfig:   c.manageAWSConfig,
+			CredentialProcess: c.credentialProcess,
+			Accounts: []config.Account{{
+				ID:          "work",
+				MetadataURL: "https://idp.example.com/metadata",
+				Region:      "eu-central-1",
+				Output:      "text",
+			}},
+		})
+		t.Cleanup(func() { config.SetCurrent(previousConfig) })
+
+		if c.existing != nil {
+			err := os.MkdirAll(filepath.Dir(configPath), 0700)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = os.WriteFile(configPath, []byte(*c.existing), 0600)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		err := StoreCredentials([]AWSCredentialEntry{{
+			AccountId:  "111111111111",
+			RoleName:   "developer",
+			RoleARN:    "arn:aws:iam::111111111111:role/developer",
+			AccountKey: "work",
+			Credential: AWSCredential{AccessKeyId: "ASIA", SecretAccessKey: "secret", SessionToken: "token"},
+			Expiration: time.Now().Add(time.Hour),
+		}})
+		if err != nil {
+			t.Errorf("%s: %s", c.name, err)
+			continue
+		}
+
+		contents, err := os.ReadFile(configPath)
+		switch {
+		case c.expected == nil && !os.IsNotExist(err):
+			t.Errorf("%s: expected no config file, got %q (%v)", c.name, string(contents), err)
+		case c.expected != nil && err != nil:
+			t.Errorf("%s: %s", c.name, err)
+		case c.expected != nil && string(contents) != *c.expected:
+			t.Errorf("%s: expected\n%q\ngot\n%q", c.name, *c.expected, string(contents))
+		}
+	}
+}
+
+func ptr(s string) *string {
+	return &s
+}
@@ -0,0 +1,79 @@
+package credentials
+
+import (
+	"aws-llama/config"
+)
+
+// Finds the SAML entry whose credentials are used to assume the chained role.
+func ChainSource(chained *config.ChainedRole, samlEntries []AWSCredentialEntry) (*AWSCredentialEntry, error) {
+	if chained.SourceRoleARN != "" {
+		for idx := range samlEntries {
+			if samlEntries[idx].RoleARN == chained.SourceRoleARN {
+				return &samlEntries[idx], nil
+			}
+		}
+		return nil, nil
+	}
+
+	profileNames, err := ProfileNames(samlEntries)
+	if err != nil {
+		return nil, err
+	}
+	for idx, name := range profileNames {
+		if name == chained.SourceProfile {
+			return &samlEntries[idx], nil
+		}
+	}
+	return nil, nil
+}
+
+// Returns the configured chained role that produced the entry, if it's still configured.
+func chainedRoleFor(entry *AWSCredentialEntry, samlEntries []AWSCredentialEntry) *config.ChainedRole {
+	chainedRoles := config.Current().ChainedRoles
+	for idx := range chainedRoles {
+		chained := &chainedRoles[idx]
+		if chained.RoleARN != entry.RoleARN {
+			continue
+		}
+		source, err := ChainSource(chained, samlEntries)
+		if err == nil && source != nil && source.RoleARN == entry.SourceRoleARN {
+			return chained
+		}
+	}
+	return nil
+}
+
+// Returns the chained roles whose source credentials are available but which
+// have no credentials of their own yet.
+func MissingChainedRoles(entries []AWSCredentialEntry) []*config.ChainedRole {
+	samlEntries := make([]AWSCredentialEntry, 0, len(entries))
+	for _, entry := range entries {
+		if !entry.IsChained() {
+			samlEntries = append(samlEntries, entry)
+		}
+	}
+
+	missing := make([]*config.ChainedRole, 0)
+	chainedRoles := config.Current().ChainedRoles
+	for idx := range chainedRoles {
+		chained := &chainedRoles[idx]
+		source, err := ChainSource(chained, samlEntries)
+		if err != nil || source == nil || source.IsExpired() {
+			continue
+		}
+		if ChainedEntry(chained, source, entries) == nil {
+			missing = append(missing, chained)
+		}
+	}
+	return missing
+}
+
+// Returns the current entry of the chained role assumed from source, if any.
+func ChainedEntry(chained *config.ChainedRole, source *AWSCredentialEntry, entries []AWSCredentialEntry) *AWSCredentialEntry {
+	for idx := range entries {
+		if entries[idx].RoleARN == chained.RoleARN && entries[idx].SourceRoleARN == source.RoleARN {
+			return &entries[idx]
+		}
+	}
+	return nil
+}
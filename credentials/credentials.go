@@ -1,7 +1,10 @@
 package credentials
 
 import (
+	"aws-llama/atomicfile"
+	"aws-llama/config"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 	"strings"
@@ -22,32 +25,82 @@ type AWSCredential struct {
 }
 
 type AWSCredentialEntry struct {
-	AccountId   string
-	Credential  AWSCredential
-	MetadataURL string
+	AccountId  string
+	RoleName   string
+	RoleARN    string
+	Credential AWSCredential
+	// Key of the config.Account whose IdP granted the role.
+	AccountKey string
+	// Set for chained roles: the ARN of the SAML role whose credentials were
+	// used to assume this one.
+	SourceRoleARN string
+	// Set when the latest login to the account failed to assume the role: the
+	// entry keeps its previous credentials, and no longer triggers refreshes.
+	RefreshError string
 
 	// Time when the current credentials expire.
 	Expiration time.Time
 }
 
-func AWSCredentialEntryFromOutput(output *sts.AssumeRoleWithSAMLOutput, metadataURL string) (*AWSCredentialEntry, error) {
+func AWSCredentialEntryFromOutput(output *sts.AssumeRoleWithSAMLOutput, roleARN string, accountKey string) (*AWSCredentialEntry, error) {
 	accountId, err := ExtractAccountIdFromARN(*output.AssumedRoleUser.Arn)
 	if err != nil {
 		return nil, err
 	}
+	roleName, err := ExtractRoleNameFromARN(*output.AssumedRoleUser.Arn)
+	if err != nil {
+		return nil, err
+	}
 	credentialEntry := AWSCredentialEntry{
 		AccountId: accountId,
+		RoleName:  roleName,
+		RoleARN:   roleARN,
 		Credential: AWSCredential{
 			AccessKeyId:     *output.Credentials.AccessKeyId,
 			SecretAccessKey: *output.Credentials.SecretAccessKey,
 			SessionToken:    *output.Credentials.SessionToken,
 		},
-		MetadataURL: metadataURL,
-		Expiration:  *output.Credentials.Expiration,
+		AccountKey: accountKey,
+		Expiration: *output.Credentials.Expiration,
 	}
 	return &credentialEntry, nil
 }
 
+// Builds the entry for a chained role assumed with the credentials of source.
+func AWSCredentialEntryFromAssumeRoleOutput(output *sts.AssumeRoleOutput, roleARN string, source *AWSCredentialEntry) (*AWSCredentialEntry, error) {
+	accountId, err := ExtractAccountIdFromARN(*output.AssumedRoleUser.Arn)
+	if err != nil {
+		return nil, err
+	}
+	roleName, err := ExtractRoleNameFromARN(*output.AssumedRoleUser.Arn)
+	if err != nil {
+		return nil, err
+	}
+	credentialEntry := AWSCredentialEntry{
+		AccountId: accountId,
+		RoleName:  roleName,
+		RoleARN:   roleARN,
+		Credential: AWSCredential{
+			AccessKeyId:     *output.Credentials.AccessKeyId,
+			SecretAccessKey: *output.Credentials.SecretAccessKey,
+			SessionToken:    *output.Credentials.SessionToken,
+		},
+		AccountKey:    source.AccountKey,
+		SourceRoleARN: source.RoleARN,
+		Expiration:    *output.Credentials.Expiration,
+	}
+	return &credentialEntry, nil
+}
+
+func (a *AWSCredentialEntry) IsChained() bool {
+	return a.SourceRoleARN != ""
+}
+
+// Whether both entries hold credentials for the same role, obtained the same way.
+func (a *AWSCredentialEntry) sameRole(other *AWSCredentialEntry) bool {
+	return a.AccountId == other.AccountId && a.RoleName == other.RoleName && a.SourceRoleARN == other.SourceRoleARN
+}
+
 func ExtractAccountIdFromARN(arn string) (string, error) {
 	// Sample Input: arn:aws:sts::050283019178:assumed-role/developer/Val_Komarov@rapid7.com
 	// Sample Output: 050283019178
@@ -60,6 +113,21 @@ func ExtractAccountIdFromARN(arn string) (string, error) {
 	return account, nil
 }
 
+func ExtractRoleNameFromARN(arn string) (string, error) {
+	// Sample Input: arn:aws:sts::050283019178:assumed-role/developer/Val_Komarov@rapid7.com
+	// Sample Output: developer
+	splitStr := strings.SplitN(arn, ":", 6)
+	if len(splitStr) < 6 {
+		return "", fmt.Errorf("unable to extract role name from malformed ARN: %s", arn)
+	}
+
+	resource := strings.Split(splitStr[5], "/")
+	if len(resource) < 2 || resource[1] == "" {
+		return "", fmt.Errorf("unable to extract role name from malformed ARN: %s", arn)
+	}
+	return resource[1], nil
+}
+
 func getCredentialsPath() (string, error) {
 	homeDir, err := os.UserHomeDir()
 	if err != nil {
@@ -69,12 +137,7 @@ func getCredentialsPath() (string, error) {
 	return filepath.Join(homeDir, ".aws/credentials"), nil
 }
 
-func maybeBackupExistingCredentials() error {
-	credentialsPath, err := getCredentialsPath()
-	if err != nil {
-		return err
-	}
-
+func maybeBackupExistingCredentials(credentialsPath string) error {
 	contents, err := os.ReadFile(credentialsPath)
 	if err != nil {
 		if os.IsNotExist(err) {
@@ -90,54 +153,64 @@ func maybeBackupExistingCredentials() error {
 		return nil
 	}
 
-	// We know we need to backup credentials here.
+	// We know we need to backup credentials here. The original is left in place
+	// until it's atomically replaced by the new contents.
 	backupCredentialsPath := credentialsPath + ".bak"
-	err = os.Remove(backupCredentialsPath)
-	if err != nil {
-		if !os.IsNotExist(err) {
-			return err
-		}
-	}
-
-	return os.Rename(credentialsPath, backupCredentialsPath)
+	return atomicfile.Write(backupCredentialsPath, func(w io.Writer) error {
+		_, err := w.Write(contents)
+		return err
+	})
 }
 
 func writeIniToDisk(iniFile *ini.File) error {
-	err := maybeBackupExistingCredentials()
+	credentialsPath, err := getCredentialsPath()
 	if err != nil {
 		return err
 	}
 
+	return updateFileLocked(credentialsPath, func(path string, w io.Writer) error {
+		err := maybeBackupExistingCredentials(path)
+		if err != nil {
+			return err
+		}
+
+		_, err = io.WriteString(w, CREDENTIALS_HEADER+"\n")
+		if err != nil {
+			return err
+		}
+
+		return writeManagedSections(w, iniFile)
+	})
+}
+
+func mergeIniToDisk(iniFile *ini.File) error {
 	credentialsPath, err := getCredentialsPath()
-	if err != nil {
-		return nil
-	}
-	err = os.MkdirAll(filepath.Base(credentialsPath), 0755)
 	if err != nil {
 		return err
 	}
 
-	f, err := os.Create(credentialsPath)
-	if err != nil {
-		return err
-	}
-	defer f.Close()
+	return updateFileLocked(credentialsPath, func(path string, w io.Writer) error {
+		existing, err := readIniForMerge(path)
+		if err != nil {
+			return err
+		}
 
-	_, err = f.WriteString(CREDENTIALS_HEADER + "\n")
-	if err != nil {
-		return err
-	}
+		// A file written in replace mode is entirely ours; the header would otherwise
+		// make a later switch back to replace mode skip the backup of foreign profiles.
+		existing = removeCommentLine(existing, CREDENTIALS_HEADER)
+		merged, err := mergeManagedSections(existing, iniFile)
+		if err != nil {
+			return fmt.Errorf("failed to merge into credentials file %s: %w", path, err)
+		}
 
-	_, err = iniFile.WriteTo(f)
-	if err != nil {
+		_, err = w.Write(merged)
 		return err
-	}
-	return nil
+	})
 }
 
-func (a *AWSCredentialEntry) writeToIni(iniFile *ini.File) {
-	sectionName := fmt.Sprintf("%s-%s", PROFILE_PREFIX, a.AccountId)
+func (a *AWSCredentialEntry) writeToIni(iniFile *ini.File, sectionName string) {
 	section := iniFile.Section(sectionName)
+	section.Comment = MANAGED_SECTION_MARKER
 	section.Key("aws_access_key_id").SetValue(a.Credential.AccessKeyId)
 	section.Key("aws_secret_access_key").SetValue(a.Credential.SecretAccessKey)
 	if a.Credential.SessionToken != "" {
@@ -148,10 +221,64 @@ func (a *AWSCredentialEntry) writeToIni(iniFile *ini.File) {
 	}
 }
 
+// Drops entries for accounts that are no longer in the config, for roles the
+// account's role filter now excludes, and for chained roles that were removed.
+func configuredEntries(credentials []AWSCredentialEntry) []AWSCredentialEntry {
+	configured := make([]AWSCredentialEntry, 0, len(credentials))
+	for _, credential := range credentials {
+		if credential.IsChained() {
+			continue
+		}
+		account := config.Current().AccountForKey(credential.AccountKey)
+		if account == nil {
+			continue
+		}
+		included, _ := account.Roles.Decide(credential.RoleARN, credential.AccountId, credential.RoleName)
+		if included {
+			configured = append(configured, credential)
+		}
+	}
+
+	samlEntries := configured
+	for _, credential := range credentials {
+		if credential.IsChained() && chainedRoleFor(&credential, samlEntries) != nil {
+			configured = append(configured, credential)
+		}
+	}
+	return configured
+}
+
 func StoreCredentials(credentials []AWSCredentialEntry) error {
+	credentials = configuredEntries(credentials)
+	profileNames, err := ProfileNames(credentials)
+	if err != nil {
+		return err
+	}
+
+	current := config.Current()
+	// Merged even when neither option is set, so that turning them off removes
+	// the profiles written before.
+	if current.ManageAWSConfig || current.CredentialProcess {
+		err = writeAWSConfig(credentials, profileNames)
+	} else {
+		err = writeAWSConfig(nil, nil)
+	}
+	if err != nil {
+		return err
+	}
+
 	iniFile := ini.Empty()
-	for _, credential := range credentials {
-		credential.writeToIni(iniFile)
+	// With credential_process, secrets are served by `aws-llama credential-process`
+	// and only the config file refers to them. Writing an empty set also clears any
+	// previously managed profiles.
+	if !current.CredentialProcess {
+		for idx, credential := range credentials {
+			credential.writeToIni(iniFile, profileNames[idx])
+		}
+	}
+
+	if current.CredentialsMode == config.CredentialsModeMerge {
+		return mergeIniToDisk(iniFile)
 	}
 	return writeIniToDisk(iniFile)
 }
@@ -0,0 +1,83 @@
+package credentials
+
+import (
+	"aws-llama/atomicfile"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// How long to wait for another process to release the lock on a file we're writing.
+const FILE_LOCK_TIMEOUT = 10 * time.Second
+
+// Resolves symlinks so that a symlinked ~/.aws/credentials (e.g. from a dotfiles
+// repo) is updated in place rather than replaced by a regular file.
+func resolveWritePath(path string) (string, error) {
+	resolved, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return path, nil
+		}
+		return "", err
+	}
+	return resolved, nil
+}
+
+// Takes an advisory lock on path (via a sidecar ".lock" file, since path itself
+// gets replaced on every write). The returned function releases the lock.
+func lockPath(path string) (func(), error) {
+	lockFile, err := os.OpenFile(path+".lock", os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	deadline := time.Now().Add(FILE_LOCK_TIMEOUT)
+	for {
+		locked, err := tryLockFile(lockFile)
+		if err != nil {
+			lockFile.Close()
+			return nil, fmt.Errorf("failed to lock %s: %w", lockFile.Name(), err)
+		}
+		if locked {
+			break
+		}
+		if time.Now().After(deadline) {
+			lockFile.Close()
+			return nil, fmt.Errorf("timed out waiting for the lock on %s", lockFile.Name())
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	unlock := func() {
+		unlockFile(lockFile)
+		lockFile.Close()
+	}
+	return unlock, nil
+}
+
+// Locks path, then atomically replaces it with whatever update writes. update is
+// called with the lock held, so it can safely read the current contents first.
+func updateFileLocked(path string, update func(path string, w io.Writer) error) error {
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+
+	path, err = resolveWritePath(path)
+	if err != nil {
+		return err
+	}
+
+	unlock, err := lockPath(path)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	return atomicfile.Write(path, func(w io.Writer) error {
+		return update(path, w)
+	})
+}
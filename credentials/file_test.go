@@ -0,0 +1,125 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+
+package credentials
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestUpdateFileLockedFollowsSymlink(t *testing.T) {
+	dir := t.TempDir()
+	target := filepath.Join(dir, "dotfiles", "credentials")
+	link := filepath.Join(dir, ".aws", "credentials")
+	for _, path := range []string{target, link} {
+		err := os.MkdirAll(filepath.Dir(path), 0700)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := os.WriteFile(target, []byte("old"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Symlink(target, link)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = updateFileLocked(link, func(path string, w io.Writer) error {
+		if path != target {
+			t.Errorf("expected the update to see the symlink target, got %s", path)
+		}
+		_, err := io.WriteString(w, "new")
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Lstat(link)
+	if err != nil || info.Mode()&os.ModeSymlink == 0 {
+		t.Fatalf("expected the symlink to be kept, got %v (%v)", info, err)
+	}
+	contents, err := os.ReadFile(target)
+	if err != nil || string(contents) != "new" {
+		t.Errorf("expected the target to be updated, got %q (%v)", contents, err)
+	}
+}
+
+func TestUpdateFileLockedSerializesWriters(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "counter")
+	err := os.WriteFile(path, []byte("0"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Every writer increments the counter, with a pause between reading and
+	// writing that would lose updates without the lock.
+	const writers = 8
+	var wg sync.WaitGroup
+	errs := make(chan error, writers)
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- updateFileLocked(path, func(path string, w io.Writer) error {
+				contents, err := os.ReadFile(path)
+				if err != nil {
+					return err
+				}
+				count, err := strconv.Atoi(string(contents))
+				if err != nil {
+					return err
+				}
+				time.Sleep(20 * time.Millisecond)
+				_, err = fmt.Fprint(w, count+1)
+				return err
+			})
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	contents, err := os.ReadFile(path)
+	if err != nil || string(contents) != strconv.Itoa(writers) {
+		t.Errorf("expected %d serialized increments, got %q (%v)", writers, contents, err)
+	}
+}
+
+func TestLockPathExcludesOtherHolders(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "credentials")
+	unlock, err := lockPath(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Another open file description conflicts with the lock, as another process would.
+	lockFile, err := os.OpenFile(path+".lock", os.O_RDWR, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lockFile.Close()
+	locked, err := tryLockFile(lockFile)
+	if err != nil || locked {
+		t.Errorf("expected the lock to be held, got locked=%v (%v)", locked, err)
+	}
+
+	unlock()
+	locked, err = tryLockFile(lockFile)
+	if err != nil || !locked {
+		t.Errorf("expected the lock to be free after unlocking, got locked=%v (%v)", locked, err)
+	}
+	unlockFile(lockFile)
+}
@@ -0,0 +1,174 @@
+package credentials
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"gopkg.in/ini.v1"
+)
+
+// Comment placed above every section aws-llama owns when merging into an existing file.
+const MANAGED_SECTION_MARKER = "; managed by aws-llama"
+
+// A section of an INI file as it was written: the comment lines directly above
+// its header, the header, and every line up to the next section.
+type iniBlock struct {
+	// Empty for the lines before the first section.
+	name    string
+	managed bool
+	text    string
+}
+
+func isCommentLine(line string) bool {
+	trimmed := strings.TrimSpace(line)
+	return strings.HasPrefix(trimmed, ";") || strings.HasPrefix(trimmed, "#")
+}
+
+// Returns the name of the section a line starts, if it's a section header.
+func sectionHeaderName(line string) (string, bool) {
+	trimmed := strings.TrimSpace(line)
+	end := strings.Index(trimmed, "]")
+	if !strings.HasPrefix(trimmed, "[") || end < 0 {
+		return "", false
+	}
+	return strings.TrimSpace(trimmed[1:end]), true
+}
+
+// Splits the contents of an INI file into its sections, keeping every byte.
+func splitIniBlocks(contents string) []iniBlock {
+	blocks := []iniBlock{{}}
+	var lines []string
+	for _, line := range strings.SplitAfter(contents, "\n") {
+		name, isHeader := sectionHeaderName(line)
+		if !isHeader {
+			lines = append(lines, line)
+			continue
+		}
+
+		// The comment lines right above the header belong to the new section.
+		start := len(lines)
+		for start > 0 && isCommentLine(lines[start-1]) {
+			start--
+		}
+		blocks[len(blocks)-1].text = strings.Join(lines[:start], "")
+
+		block := iniBlock{name: name}
+		for _, comment := range lines[start:] {
+			if strings.TrimSpace(comment) == MANAGED_SECTION_MARKER {
+				block.managed = true
+			}
+		}
+		blocks = append(blocks, block)
+		lines = append(append([]string(nil), lines[start:]...), line)
+	}
+	blocks[len(blocks)-1].text = strings.Join(lines, "")
+	return blocks
+}
+
+// Renders a section aws-llama owns, below the marker comment.
+func renderManagedSection(section *ini.Section) string {
+	var text strings.Builder
+	text.WriteString(MANAGED_SECTION_MARKER + "\n")
+	text.WriteString("[" + section.Name() + "]\n")
+	for _, key := range section.Keys() {
+		text.WriteString(strings.TrimRight(key.Name()+" = "+key.Value(), " ") + "\n")
+	}
+	return text.String()
+}
+
+// Writes every section of managed, separated by blank lines.
+func writeManagedSections(w io.Writer, managed *ini.File) error {
+	rendered := make([]string, 0, len(managed.Sections()))
+	for _, section := range managed.Sections() {
+		if section.Name() != ini.DefaultSection {
+			rendered = append(rendered, renderManagedSection(section))
+		}
+	}
+	_, err := io.WriteString(w, strings.Join(rendered, "\n"))
+	return err
+}
+
+// Returns the trailing blank lines of text.
+func trailingBlankLines(text string) string {
+	trimmed := strings.TrimRight(text, " \t\r\n")
+	newline := strings.Index(text[len(trimmed):], "\n")
+	if newline < 0 {
+		return ""
+	}
+	return text[len(trimmed)+newline+1:]
+}
+
+// Reads an existing INI file for merging. A missing file yields no contents.
+func readIniForMerge(path string) ([]byte, error) {
+	contents, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return contents, nil
+}
+
+// Removes every line that consists of comment alone, e.g. a stale file header.
+func removeCommentLine(contents []byte, comment string) []byte {
+	lines := strings.SplitAfter(string(contents), "\n")
+	kept := make([]string, 0, len(lines))
+	for _, line := range lines {
+		if strings.TrimSpace(line) != comment {
+			kept = append(kept, line)
+		}
+	}
+	return []byte(strings.Join(kept, ""))
+}
+
+// Replaces the sections aws-llama owns in existing with the sections of managed.
+// Everything else is kept byte for byte. Owned sections that are no longer part
+// of managed are removed. Fails if a managed section has the name of a section
+// aws-llama doesn't own, rather than overwriting it.
+func mergeManagedSections(existing []byte, managed *ini.File) ([]byte, error) {
+	rendered := make(map[string]string)
+	names := make([]string, 0, len(managed.Sections()))
+	for _, section := range managed.Sections() {
+		if section.Name() == ini.DefaultSection {
+			continue
+		}
+		rendered[section.Name()] = renderManagedSection(section)
+		names = append(names, section.Name())
+	}
+
+	blocks := splitIniBlocks(string(existing))
+	for _, block := range blocks {
+		if _, ok := rendered[block.name]; ok && !block.managed {
+			return nil, fmt.Errorf("section [%s] wasn't written by aws-llama: rename or remove it, or change profile_template", block.name)
+		}
+	}
+
+	var merged strings.Builder
+	written := make(map[string]bool)
+	for _, block := range blocks {
+		if !block.managed {
+			merged.WriteString(block.text)
+			continue
+		}
+		text, ok := rendered[block.name]
+		if ok && !written[block.name] {
+			merged.WriteString(text + trailingBlankLines(block.text))
+			written[block.name] = true
+		}
+	}
+
+	for _, name := range names {
+		if written[name] {
+			continue
+		}
+		contents := merged.String()
+		if contents != "" && !strings.HasSuffix(contents, "\n") {
+			merged.WriteString("\n")
+		}
+		if strings.TrimSpace(contents) != "" && !strings.HasSuffix(contents, "\n\n") {
+			merged.WriteString("\n")
+		}
+		merged.WriteString(rendered[name])
+	}
+	return []byte(merged.String()), nil
+}
@@ -0,0 +1,154 @@
+package credentials
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gopkg.in/ini.v1"
+)
+
+// Builds a file of managed sections, each mapping aws_access_key_id to its value.
+func managedIni(profiles map[string]string) *ini.File {
+	iniFile := ini.Empty()
+	for name, accessKeyId := range profiles {
+		section := iniFile.Section(name)
+		section.Comment = MANAGED_SECTION_MARKER
+		section.Key("aws_access_key_id").SetValue(accessKeyId)
+	}
+	return iniFile
+}
+
+func TestMergeManagedSections(t *testing.T) {
+	cases := []struct {
+		name     string
+		existing string
+		managed  map[string]string
+		expected string
+		// Substring of the error, when the merge is expected to fail.
+		err string
+	}{
+		{
+			name:     "empty file",
+			existing: "",
+			managed:  map[string]string{"llama-dev": "NEW"},
+			expected: "; managed by aws-llama\n[llama-dev]\naws_access_key_id = NEW\n",
+		},
+		{
+			name:     "keeps foreign sections and comments byte for byte",
+			existing: "# top of file\n\n; my profile\n[personal]\naws_access_key_id=AKIA # not a comment\n  region   =  us-east-1\n",
+			managed:  map[string]string{"llama-dev": "NEW"},
+			expected: "# top of file\n\n; my profile\n[personal]\naws_access_key_id=AKIA # not a comment\n  region   =  us-east-1\n\n; managed by aws-llama\n[llama-dev]\naws_access_key_id = NEW\n",
+		},
+		{
+			name:     "appends after a file without a final newline",
+			existing: "[personal]\nregion=us-east-1",
+			managed:  map[string]string{"llama-dev": "NEW"},
+			expected: "[personal]\nregion=us-east-1\n\n; managed by aws-llama\n[llama-dev]\naws_access_key_id = NEW\n",
+		},
+		{
+			name:     "updates managed sections in place",
+			existing: "[first]\nregion=us-east-1\n\n; managed by aws-llama\n[llama-dev]\naws_access_key_id = OLD\naws_session_token = OLD\n\n[last]\nregion=eu-west-1\n",
+			managed:  map[string]string{"llama-dev": "NEW"},
+			expected: "[first]\nregion=us-east-1\n\n; managed by aws-llama\n[llama-dev]\naws_access_key_id = NEW\n\n[last]\nregion=eu-west-1\n",
+		},
+		{
+			name:     "removes stale managed sections",
+			existing: "[personal]\nregion=us-east-1\n\n; managed by aws-llama\n[llama-old]\naws_access_key_id = OLD\n\n; managed by aws-llama\n[llama-dev]\naws_access_key_id = OLD\n",
+			managed:  map[string]string{"llama-dev": "NEW"},
+			expected: "[personal]\nregion=us-east-1\n\n; managed by aws-llama\n[llama-dev]\naws_access_key_id = NEW\n",
+		},
+		{
+			name:     "removes every managed section when nothing is managed",
+			existing: "[personal]\nregion=us-east-1\n\n; managed by aws-llama\n[llama-dev]\naws_access_key_id = OLD\n",
+			managed:  map[string]string{},
+			expected: "[personal]\nregion=us-east-1\n\n",
+		},
+		{
+			name:     "refuses to overwrite a colliding foreign section",
+			existing: "; hand-written\n[llama-dev]\naws_access_key_id = MINE\nregion = us-east-1\n",
+			managed:  map[string]string{"llama-dev": "NEW"},
+			err:      "section [llama-dev] wasn't written by aws-llama",
+		},
+	}
+	for _, c := range cases {
+		merged, err := mergeManagedSections([]byte(c.existing), managedIni(c.managed))
+		if c.err != "" {
+			if err == nil || !strings.Contains(err.Error(), c.err) {
+				t.Errorf("%s: expected an error containing %q, got %v", c.name, c.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error %s", c.name, err)
+			continue
+		}
+		if string(merged) != c.expected {
+			t.Errorf("%s: expected\n%q\ngot\n%q", c.name, c.expected, string(merged))
+		}
+	}
+}
+
+func TestCredentialsBackupOnModeSwitch(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	credentialsPath := filepath.Join(home, ".aws", "credentials")
+	backupPath := credentialsPath + ".bak"
+
+	readFile := func(path string) string {
+		contents, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(contents)
+	}
+
+	handWritten := "[personal]\nregion = us-east-1\n"
+	err := os.MkdirAll(filepath.Dir(credentialsPath), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(credentialsPath, []byte(handWritten), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Replace mode moves the hand-written file aside, once.
+	for i := 0; i < 2; i++ {
+		err = writeIniToDisk(managedIni(map[string]string{"llama-dev": "FIRST"}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if backup := readFile(backupPath); backup != handWritten {
+			t.Fatalf("expected the hand-written file to be backed up, got %q", backup)
+		}
+	}
+	if !strings.HasPrefix(readFile(credentialsPath), CREDENTIALS_HEADER) {
+		t.Errorf("expected the replaced file to start with the header")
+	}
+
+	// Merge mode drops the header, so that the foreign profiles added since are
+	// backed up again when switching back to replace mode.
+	err = mergeIniToDisk(managedIni(map[string]string{"llama-dev": "SECOND"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	merged := readFile(credentialsPath)
+	if strings.Contains(merged, CREDENTIALS_HEADER) {
+		t.Errorf("expected merge mode to drop the header, got %q", merged)
+	}
+	merged = "[work]\nregion = eu-west-1\n\n" + merged
+	err = os.WriteFile(credentialsPath, []byte(merged), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = writeIniToDisk(managedIni(map[string]string{"llama-dev": "THIRD"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if backup := readFile(backupPath); backup != merged {
+		t.Errorf("expected the merged file to be backed up, got %q", backup)
+	}
+}
@@ -0,0 +1,98 @@
+package credentials
+
+import (
+	"aws-llama/config"
+	"aws-llama/encryption"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+const STATE_VERSION = 1
+
+type persistedState struct {
+	Version int
+	Entries []AWSCredentialEntry
+}
+
+// Serializes writers, so that a snapshot taken earlier can't overwrite a newer one.
+var writeLock sync.Mutex
+
+// Writes the current entries to the AWS credentials/config files and the state file.
+func (a *AWSCredentialStore) WriteToDisk() error {
+	writeLock.Lock()
+	defer writeLock.Unlock()
+
+	err := StoreCredentials(a.Entries())
+	if err != nil {
+		return err
+	}
+	return a.save()
+}
+
+// Writes all store entries to the state file so they survive a daemon restart.
+func (a *AWSCredentialStore) save() error {
+	state := persistedState{
+		Version: STATE_VERSION,
+		Entries: a.Entries(),
+	}
+	contents, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	contents, err = encryption.Seal(contents)
+	if err != nil {
+		return fmt.Errorf("failed to encrypt the credential store: %w", err)
+	}
+
+	return updateFileLocked(config.Current().StatePath, func(path string, w io.Writer) error {
+		_, err := w.Write(contents)
+		return err
+	})
+}
+
+// Replaces the store entries with the unexpired ones from the state file. A
+// missing state file leaves the store empty.
+func (a *AWSCredentialStore) Load() error {
+	entries, err := loadPersistedEntries()
+	if err != nil {
+		return err
+	}
+
+	unexpired := make([]AWSCredentialEntry, 0, len(entries))
+	for _, entry := range entries {
+		if !entry.IsExpired() {
+			unexpired = append(unexpired, entry)
+		}
+	}
+	a.ReplaceEntries(unexpired)
+	return nil
+}
+
+func loadPersistedEntries() ([]AWSCredentialEntry, error) {
+	statePath := config.Current().StatePath
+	contents, err := os.ReadFile(statePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	contents, err = encryption.Open(contents)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt state file %s: %w", statePath, err)
+	}
+
+	var state persistedState
+	err = json.Unmarshal(contents, &state)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse state file %s: %w", statePath, err)
+	}
+	if state.Version != STATE_VERSION {
+		return nil, fmt.Errorf("unsupported state file version %d in %s", state.Version, statePath)
+	}
+	return state.Entries, nil
+}
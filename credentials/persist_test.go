@@ -0,0 +1,53 @@
+package credentials
+
+import (
+	"aws-llama/config"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadDropsExpiredEntries(t *testing.T) {
+	statePath := filepath.Join(t.TempDir(), "state.json")
+	previousConfig := config.Current()
+	config.SetCurrent(&config.Config{StatePath: statePath})
+	t.Cleanup(func() { config.SetCurrent(previousConfig) })
+
+	store := NewAWSCredentialStore()
+	store.ReplaceEntries([]AWSCredentialEntry{
+		{AccountId: "111111111111", RoleName: "developer", AccountKey: "one", Expiration: time.Now().Add(time.Hour)},
+		{AccountId: "222222222222", RoleName: "expired", AccountKey: "one", Expiration: time.Now().Add(-time.Minute)},
+	})
+	err := store.save()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	loaded := NewAWSCredentialStore()
+	err = loaded.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := loaded.Entries()
+	if len(entries) != 1 || entries[0].RoleName != "developer" || entries[0].AccountKey != "one" {
+		t.Errorf("expected only the unexpired entry, got %+v", entries)
+	}
+}
+
+func TestLoadRejectsUnknownVersion(t *testing.T) {
+	statePath := filepath.Join(t.TempDir(), "state.json")
+	previousConfig := config.Current()
+	config.SetCurrent(&config.Config{StatePath: statePath})
+	t.Cleanup(func() { config.SetCurrent(previousConfig) })
+
+	err := os.WriteFile(statePath, []byte(`{"Version": 7, "Entries": []}`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = NewAWSCredentialStore().Load()
+	if err == nil || !strings.Contains(err.Error(), "unsupported state file version 7") {
+		t.Errorf("expected an unsupported version error, got %v", err)
+	}
+}
@@ -0,0 +1,58 @@
+package credentials
+
+import (
+	"fmt"
+	"time"
+)
+
+// The version of the credential_process output format understood by the AWS SDKs.
+const CREDENTIAL_PROCESS_VERSION = 1
+
+// JSON document printed by a credential_process, as documented in
+// https://docs.aws.amazon.com/cli/latest/userguide/cli-configure-sourcing-external.html
+type CredentialProcessOutput struct {
+	Version         int
+	AccessKeyId     string
+	SecretAccessKey string
+	SessionToken    string     `json:",omitempty"`
+	Expiration      *time.Time `json:",omitempty"`
+}
+
+func (a *AWSCredentialEntry) CredentialProcessOutput() CredentialProcessOutput {
+	output := CredentialProcessOutput{
+		Version:         CREDENTIAL_PROCESS_VERSION,
+		AccessKeyId:     a.Credential.AccessKeyId,
+		SecretAccessKey: a.Credential.SecretAccessKey,
+		SessionToken:    a.Credential.SessionToken,
+	}
+	if !a.Expiration.IsZero() {
+		expiration := a.Expiration.UTC()
+		output.Expiration = &expiration
+	}
+	return output
+}
+
+func (a *AWSCredentialEntry) IsExpired() bool {
+	return !a.Expiration.IsZero() && !time.Now().Before(a.Expiration)
+}
+
+// Reads credentials for a profile from the persisted store. Used when the daemon
+// isn't running.
+func CredentialProcessOutputFromState(profileName string) (*CredentialProcessOutput, error) {
+	store := NewAWSCredentialStore()
+	err := store.Load()
+	if err != nil {
+		return nil, err
+	}
+
+	entry, err := store.EntryForProfile(profileName)
+	if err != nil {
+		return nil, err
+	}
+	if entry == nil {
+		return nil, fmt.Errorf("no unexpired credentials for profile %s (is `aws-llama serve` running?)", profileName)
+	}
+
+	output := entry.CredentialProcessOutput()
+	return &output, nil
+}
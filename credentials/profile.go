@@ -0,0 +1,131 @@
+package credentials
+
+import (
+	"aws-llama/config"
+	"bytes"
+	"fmt"
+	"strings"
+	"text/template"
+)
+
+const DEFAULT_PROFILE_TEMPLATE = PROFILE_PREFIX + "-{{.AccountId}}-{{.RoleName}}"
+
+// Characters that would break the INI section header or are ambiguous for the AWS CLIs.
+const invalidProfileChars = "[]#;=\"'\\"
+
+// Values available to the profile_template.
+type ProfileNameData struct {
+	AccountId string
+	RoleName  string
+	Role      string
+	Nickname  string
+}
+
+func profileTemplate() (*template.Template, error) {
+	text := config.Current().ProfileTemplate
+	if text == "" {
+		text = DEFAULT_PROFILE_TEMPLATE
+	}
+
+	tpl, err := template.New("profile").Option("missingkey=error").Funcs(config.PROFILE_TEMPLATE_FUNCS).Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid profile_template %q: %w", text, err)
+	}
+	return tpl, nil
+}
+
+func profileNameData(entry *AWSCredentialEntry) ProfileNameData {
+	data := ProfileNameData{
+		AccountId: entry.AccountId,
+		RoleName:  entry.RoleName,
+		Role:      entry.RoleName,
+	}
+	account := config.Current().AccountForKey(entry.AccountKey)
+	if account != nil {
+		data.Nickname = account.Nickname
+	}
+	return data
+}
+
+func renderProfileName(tpl *template.Template, entry *AWSCredentialEntry) (string, error) {
+	var buf bytes.Buffer
+	err := tpl.Execute(&buf, profileNameData(entry))
+	if err != nil {
+		return "", fmt.Errorf("failed to render profile name for account %s role %s: %w", entry.AccountId, entry.RoleName, err)
+	}
+
+	name := buf.String()
+	err = validateProfileName(name)
+	if err != nil {
+		return "", fmt.Errorf("profile_template produced an invalid name for account %s role %s: %w", entry.AccountId, entry.RoleName, err)
+	}
+	return name, nil
+}
+
+func validateProfileName(name string) error {
+	if name == "" {
+		return fmt.Errorf("profile name is empty (is the account nickname set?)")
+	}
+	if strings.TrimSpace(name) != name || strings.ContainsAny(name, " \t\r\n") {
+		return fmt.Errorf("profile name %q contains whitespace", name)
+	}
+	if strings.ContainsAny(name, invalidProfileChars) {
+		return fmt.Errorf("profile name %q contains one of the characters %s", name, invalidProfileChars)
+	}
+	if name == "default" {
+		return fmt.Errorf("profile name %q would overwrite the default profile", name)
+	}
+	return nil
+}
+
+// Returns the profile names for all of the entries (in the same order), failing
+// if two entries would be written to the same profile.
+func ProfileNames(entries []AWSCredentialEntry) ([]string, error) {
+	tpl, err := profileTemplate()
+	if err != nil {
+		return nil, err
+	}
+
+	samlEntries := make([]AWSCredentialEntry, 0, len(entries))
+	for _, entry := range entries {
+		if !entry.IsChained() {
+			samlEntries = append(samlEntries, entry)
+		}
+	}
+
+	names := make([]string, len(entries))
+	owners := make(map[string]*AWSCredentialEntry)
+	for idx := range entries {
+		entry := &entries[idx]
+		name, err := profileNameFor(tpl, entry, samlEntries)
+		if err != nil {
+			return nil, err
+		}
+
+		owner, ok := owners[name]
+		if ok {
+			return nil, fmt.Errorf(
+				"profile name collision: %q is produced for both account %s role %s and account %s role %s; include more fields in profile_template",
+				name, owner.AccountId, owner.RoleName, entry.AccountId, entry.RoleName,
+			)
+		}
+		owners[name] = entry
+		names[idx] = name
+	}
+	return names, nil
+}
+
+// Chained roles may set an explicit profile name; everything else uses the template.
+func profileNameFor(tpl *template.Template, entry *AWSCredentialEntry, samlEntries []AWSCredentialEntry) (string, error) {
+	if entry.IsChained() {
+		chained := chainedRoleFor(entry, samlEntries)
+		if chained != nil && chained.Profile != "" {
+			err := validateProfileName(chained.Profile)
+			if err != nil {
+				return "", fmt.Errorf("invalid profile for chained role %s: %w", chained.RoleARN, err)
+			}
+			return chained.Profile, nil
+		}
+	}
+	return renderProfileName(tpl, entry)
+}
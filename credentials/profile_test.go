@@ -0,0 +1,109 @@
+package credentials
+
+import (
+	"aws-llama/config"
+	"strings"
+	"testing"
+)
+
+func setupProfileConfig(t *testing.T, profileTemplate string) {
+	previousConfig := config.Current()
+	config.SetCurrent(&config.Config{
+		ProfileTemplate: profileTemplate,
+		Accounts: []config.Account{
+			{ID: "work", Nickname: "work", MetadataURL: "https://idp.example.com/metadata/work"},
+			{ID: "blank", MetadataURL: "https://idp.example.com/metadata/blank"},
+		},
+	})
+	t.Cleanup(func() { config.SetCurrent(previousConfig) })
+}
+
+func TestProfileNames(t *testing.T) {
+	developer := AWSCredentialEntry{AccountId: "111111111111", RoleName: "Developer", AccountKey: "work"}
+	admin := AWSCredentialEntry{AccountId: "111111111111", RoleName: "Admin", AccountKey: "work"}
+	cases := []struct {
+		name     string
+		template string
+		entries  []AWSCredentialEntry
+		expected []string
+		// Substrings the error must contain, when it's expected to fail.
+		errorParts []string
+	}{
+		{
+			name:     "default template",
+			entries:  []AWSCredentialEntry{developer, admin},
+			expected: []string{"llama-111111111111-Developer", "llama-111111111111-Admin"},
+		},
+		{
+			name:     "functions",
+			template: "{{.Nickname}}-{{lower .RoleName}}",
+			entries:  []AWSCredentialEntry{developer},
+			expected: []string{"work-developer"},
+		},
+		{
+			name:       "collision names both roles",
+			template:   "{{.Nickname}}",
+			entries:    []AWSCredentialEntry{developer, admin},
+			errorParts: []string{`"work"`, "role Developer", "role Admin"},
+		},
+		{
+			name:       "forbidden characters",
+			template:   "[{{.RoleName}}]",
+			entries:    []AWSCredentialEntry{developer},
+			errorParts: []string{"role Developer", "contains one of the characters"},
+		},
+		{
+			name:       "whitespace",
+			template:   "{{.AccountId}} {{.RoleName}}",
+			entries:    []AWSCredentialEntry{developer},
+			errorParts: []string{"contains whitespace"},
+		},
+		{
+			name:       "empty nickname",
+			template:   "{{.Nickname}}",
+			entries:    []AWSCredentialEntry{{AccountId: "222222222222", RoleName: "Developer", AccountKey: "blank"}},
+			errorParts: []string{"profile name is empty"},
+		},
+		{
+			name:       "default profile",
+			template:   "default",
+			entries:    []AWSCredentialEntry{developer},
+			errorParts: []string{"would overwrite the default profile"},
+		},
+		{
+			name:       "unknown field",
+			template:   "{{.Account}}",
+			entries:    []AWSCredentialEntry{developer},
+			errorParts: []string{"failed to render profile name", "role Developer"},
+		},
+		{
+			name:       "parse error",
+			template:   "{{.RoleName",
+			entries:    []AWSCredentialEntry{developer},
+			errorParts: []string{"invalid profile_template"},
+		},
+	}
+	for _, c := range cases {
+		setupProfileConfig(t, c.template)
+		names, err := ProfileNames(c.entries)
+		if c.errorParts != nil {
+			if err == nil {
+				t.Errorf("%s: expected an error, got %v", c.name, names)
+				continue
+			}
+			for _, part := range c.errorParts {
+				if !strings.Contains(err.Error(), part) {
+					t.Errorf("%s: expected the error to contain %q, got %q", c.name, part, err.Error())
+				}
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error %s", c.name, err)
+			continue
+		}
+		if strings.Join(names, ",") != strings.Join(c.expected, ",") {
+			t.Errorf("%s: expected %v, got %v", c.name, c.expected, names)
+		}
+	}
+}
@@ -2,24 +2,162 @@ package credentials
 
 import (
 	"aws-llama/config"
+	"reflect"
+	"sync"
 	"time"
 )
 
-var CredentialStore AWSCredentialStore = AWSCredentialStore{Entries: make([]AWSCredentialEntry, 0)}
+var CredentialStore *AWSCredentialStore = NewAWSCredentialStore()
 
+// Holds the current credentials. Safe for concurrent use: all access goes through
+// methods, and getters return copies so callers never share the backing array.
 type AWSCredentialStore struct {
-	Entries []AWSCredentialEntry
+	lock    sync.RWMutex
+	entries []AWSCredentialEntry
+	// The role filters, by account key, that excluded every role granted in the
+	// latest login to the account.
+	filteredAccounts map[string]config.RoleFilter
+
+	subscribersLock sync.Mutex
+	subscribers     map[<-chan struct{}]chan struct{}
+}
+
+func NewAWSCredentialStore() *AWSCredentialStore {
+	return &AWSCredentialStore{entries: make([]AWSCredentialEntry, 0)}
+}
+
+// Returns a snapshot of all entries.
+func (a *AWSCredentialStore) Entries() []AWSCredentialEntry {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+
+	entries := make([]AWSCredentialEntry, len(a.entries))
+	copy(entries, a.entries)
+	return entries
 }
 
 func (a *AWSCredentialStore) UpsertEntry(entry AWSCredentialEntry) {
-	a.RemoveEntryForAccountId(entry.AccountId)
-	a.Entries = append(a.Entries, entry)
+	a.lock.Lock()
+	entries := a.without(&entry)
+	a.entries = append(entries, entry)
+	a.lock.Unlock()
+
+	a.notify()
+}
+
+// Removes the SAML credentials for a role (chained roles are kept).
+func (a *AWSCredentialStore) RemoveEntryForRole(accountId string, roleName string) {
+	a.lock.Lock()
+	a.entries = a.without(&AWSCredentialEntry{AccountId: accountId, RoleName: roleName})
+	a.lock.Unlock()
+
+	a.notify()
+}
+
+// Replaces the SAML credentials of an account with the outcome of a login:
+// entries holds the roles that were assumed, and failures the errors (by role
+// ARN) of those that weren't. A failed role keeps its previous entry, marked
+// with the error. Roles that were neither assumed nor failed, because the IdP
+// no longer grants them or the role filter excludes them, are dropped. Chained
+// roles are kept.
+func (a *AWSCredentialStore) ReplaceAccountEntries(accountKey string, entries []AWSCredentialEntry, failures map[string]string) {
+	a.lock.Lock()
+	replacement := make([]AWSCredentialEntry, 0, len(a.entries)+len(entries))
+	for _, entry := range a.entries {
+		if entry.AccountKey != accountKey || entry.IsChained() {
+			replacement = append(replacement, entry)
+			continue
+		}
+		failure, failed := failures[entry.RoleARN]
+		if failed {
+			entry.RefreshError = failure
+			replacement = append(replacement, entry)
+		}
+	}
+	replacement = append(replacement, entries...)
+	a.entries = replacement
+	delete(a.filteredAccounts, accountKey)
+	a.lock.Unlock()
+
+	a.notify()
+}
+
+// Records a login to account in which its role filter excluded every granted
+// role. Its SAML credentials are dropped, and it isn't logged in to again until
+// its filter changes.
+func (a *AWSCredentialStore) RecordFilteredLogin(account *config.Account) {
+	a.ReplaceAccountEntries(account.Key(), nil, nil)
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.filteredAccounts == nil {
+		a.filteredAccounts = make(map[string]config.RoleFilter)
+	}
+	a.filteredAccounts[account.Key()] = account.Roles
+}
+
+// Whether the account needs a login: it has no credentials, unless its latest
+// login granted no role its current filter includes.
+func (a *AWSCredentialStore) NeedsLogin(account *config.Account) bool {
+	if a.ContainsAccount(account.Key()) {
+		return false
+	}
+
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	filter, filtered := a.filteredAccounts[account.Key()]
+	return !filtered || !reflect.DeepEqual(filter, account.Roles)
+}
+
+// Replaces all entries at once, e.g. when loading persisted state.
+func (a *AWSCredentialStore) ReplaceEntries(entries []AWSCredentialEntry) {
+	replacement := make([]AWSCredentialEntry, len(entries))
+	copy(replacement, entries)
+
+	a.lock.Lock()
+	a.entries = replacement
+	a.lock.Unlock()
+
+	a.notify()
+}
+
+// Returns a channel that receives a value whenever the store changes. Changes
+// are coalesced: a slow subscriber sees one notification for several changes
+// and should read the current state with Entries().
+func (a *AWSCredentialStore) Subscribe() <-chan struct{} {
+	a.subscribersLock.Lock()
+	defer a.subscribersLock.Unlock()
+
+	if a.subscribers == nil {
+		a.subscribers = make(map[<-chan struct{}]chan struct{})
+	}
+	ch := make(chan struct{}, 1)
+	a.subscribers[ch] = ch
+	return ch
+}
+
+// Stops notifications for a channel returned by Subscribe and closes it.
+func (a *AWSCredentialStore) Unsubscribe(ch <-chan struct{}) {
+	a.subscribersLock.Lock()
+	defer a.subscribersLock.Unlock()
+
+	subscriber, ok := a.subscribers[ch]
+	if ok {
+		delete(a.subscribers, ch)
+		close(subscriber)
+	}
 }
 
-func (a *AWSCredentialStore) RemoveEntryForAccountId(accountId string) {
-	idx := a.indexForAccount(accountId)
-	if idx != -1 {
-		a.removeByIndex(idx)
+func (a *AWSCredentialStore) notify() {
+	a.subscribersLock.Lock()
+	defer a.subscribersLock.Unlock()
+
+	for _, subscriber := range a.subscribers {
+		select {
+		case subscriber <- struct{}{}:
+		default:
+			// A notification is already pending for this subscriber.
+		}
 	}
 }
 
@@ -27,7 +165,7 @@ func (a *AWSCredentialStore) ExpiringEntries(withinSeconds float64) []AWSCredent
 	currentTime := time.Now().UTC()
 	expiringEntries := make([]AWSCredentialEntry, 0)
 
-	for _, entry := range a.Entries {
+	for _, entry := range a.Entries() {
 		delta := entry.Expiration.Sub(currentTime)
 		if delta.Seconds() < withinSeconds {
 			expiringEntries = append(expiringEntries, entry)
@@ -37,51 +175,147 @@ func (a *AWSCredentialStore) ExpiringEntries(withinSeconds float64) []AWSCredent
 	return expiringEntries
 }
 
+// Returns the expiring entry that expires soonest.
 func (a *AWSCredentialStore) NextExpiringEntry(withinSeconds float64) *AWSCredentialEntry {
-	expiringEntries := a.ExpiringEntries(withinSeconds)
-	if len(expiringEntries) > 0 {
-		return &expiringEntries[0]
-	}
+	return soonestExpiring(a.ExpiringEntries(withinSeconds))
+}
 
-	return nil
+func soonestExpiring(entries []AWSCredentialEntry) *AWSCredentialEntry {
+	var soonest *AWSCredentialEntry
+	for idx := range entries {
+		if soonest == nil || entries[idx].Expiration.Before(soonest.Expiration) {
+			soonest = &entries[idx]
+		}
+	}
+	return soonest
 }
 
-func (a *AWSCredentialStore) ContainsMetadataURL(metadataURL string) bool {
-	for _, entry := range a.Entries {
-		if entry.MetadataURL == metadataURL {
+// Whether the account has credentials other than for roles that failed to refresh.
+func (a *AWSCredentialStore) ContainsAccount(accountKey string) bool {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+
+	for _, entry := range a.entries {
+		if entry.AccountKey == accountKey && entry.RefreshError == "" {
 			return true
 		}
 	}
 	return false
 }
 
-func NextMetadataURLForRefresh() string {
+// Returns the entries that are written to disk, along with their profile names.
+func (a *AWSCredentialStore) ProfileEntries() ([]AWSCredentialEntry, []string, error) {
+	entries := configuredEntries(a.Entries())
+	profileNames, err := ProfileNames(entries)
+	if err != nil {
+		return nil, nil, err
+	}
+	return entries, profileNames, nil
+}
+
+// Returns the entry that is written to the given profile, if any.
+func (a *AWSCredentialStore) EntryForProfile(profileName string) (*AWSCredentialEntry, error) {
+	entries, profileNames, err := a.ProfileEntries()
+	if err != nil {
+		return nil, err
+	}
+
+	for idx, name := range profileNames {
+		if name == profileName {
+			return &entries[idx], nil
+		}
+	}
+	return nil, nil
+}
+
+// Returns the key of the next account to log in to, or "" if none needs it.
+func NextAccountForRefresh() string {
+	current := config.Current()
 	// First return any configured accounts for which we don't have credentials yet.
-	for _, account := range config.CurrentConfig.Accounts {
-		if !CredentialStore.ContainsMetadataURL(account.MetadataURL) {
-			return account.MetadataURL
+	for idx := range current.Accounts {
+		account := &current.Accounts[idx]
+		if CredentialStore.NeedsLogin(account) {
+			return account.Key()
 		}
 	}
 
 	// Then return the next expiring one (if there is one)
-	entry := CredentialStore.NextExpiringEntry(config.CurrentConfig.RenewWithinSeconds)
+	entry := soonestExpiring(refreshableEntries(configuredEntries(CredentialStore.ExpiringEntries(current.RenewWithinSeconds))))
 	if entry != nil {
-		return entry.MetadataURL
+		return entry.AccountKey
 	}
 
 	// We've got nothing to refresh right now.
 	return ""
 }
 
-func (a *AWSCredentialStore) indexForAccount(accountId string) int {
-	for idx, entry := range a.Entries {
-		if entry.AccountId == accountId {
-			return idx
+// Whether a refresh may produce credentials for a profile that has no entry:
+// the profiles of an account without credentials, or of a chained role that
+// wasn't assumed yet, aren't known before they are. Chained roles may also name
+// their profile in the config.
+func ProfileMayAppear(profileName string) bool {
+	current := config.Current()
+	for idx := range current.Accounts {
+		account := &current.Accounts[idx]
+		if CredentialStore.NeedsLogin(account) {
+			return true
 		}
 	}
-	return -1
+	for _, chained := range current.ChainedRoles {
+		if chained.Profile == profileName {
+			return true
+		}
+	}
+	return len(MissingChainedRoles(configuredEntries(CredentialStore.Entries()))) > 0
 }
 
-func (a *AWSCredentialStore) removeByIndex(idx int) {
-	a.Entries = append(a.Entries[:idx], a.Entries[idx+1:]...)
+// Returns when the next refresh is due: right away if a configured account needs
+// a login, otherwise RenewWithinSeconds before the soonest expiration.
+// Returns false if there is nothing to refresh at all.
+func NextRefreshDeadline(now time.Time) (time.Time, bool) {
+	current := config.Current()
+	for idx := range current.Accounts {
+		account := &current.Accounts[idx]
+		if CredentialStore.NeedsLogin(account) {
+			return now, true
+		}
+	}
+
+	entries := configuredEntries(CredentialStore.Entries())
+	if len(MissingChainedRoles(entries)) > 0 {
+		return now, true
+	}
+
+	entry := soonestExpiring(refreshableEntries(entries))
+	if entry == nil {
+		return time.Time{}, false
+	}
+	renewWithin := time.Duration(current.RenewWithinSeconds * float64(time.Second))
+	return entry.Expiration.Add(-renewWithin), true
+}
+
+// Drops the entries of roles that failed to refresh: they're retried with the
+// next login to their account, but don't cause one, so that a role that keeps
+// failing can't trigger a login after every login.
+func refreshableEntries(entries []AWSCredentialEntry) []AWSCredentialEntry {
+	refreshable := make([]AWSCredentialEntry, 0, len(entries))
+	for _, entry := range entries {
+		if entry.RefreshError == "" {
+			refreshable = append(refreshable, entry)
+		}
+	}
+	return refreshable
+}
+
+// Returns a new slice without the entry for the same role as removed. Must be
+// called with the write lock held. Never modifies the current backing array,
+// which may still be referenced by an earlier copy.
+func (a *AWSCredentialStore) without(removed *AWSCredentialEntry) []AWSCredentialEntry {
+	entries := make([]AWSCredentialEntry, 0, len(a.entries)+1)
+	for _, entry := range a.entries {
+		if !entry.sameRole(removed) {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
 }
@@ -0,0 +1,199 @@
+package credentials
+
+import (
+	"aws-llama/config"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func testEntry(accountId string, roleName string, expiration time.Time) AWSCredentialEntry {
+	return AWSCredentialEntry{
+		AccountId:  accountId,
+		RoleName:   roleName,
+		AccountKey: "account-" + accountId,
+		Credential: AWSCredential{AccessKeyId: accountId + "-" + roleName},
+		Expiration: expiration,
+	}
+}
+
+func TestUpsertEntryReplacesSameRole(t *testing.T) {
+	store := NewAWSCredentialStore()
+	expiration := time.Now().Add(time.Hour)
+
+	store.UpsertEntry(testEntry("111111111111", "developer", expiration))
+	store.UpsertEntry(testEntry("111111111111", "read-only", expiration))
+	store.UpsertEntry(testEntry("111111111111", "developer", expiration.Add(time.Hour)))
+
+	entries := store.Entries()
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 entries, got %d: %+v", len(entries), entries)
+	}
+	for _, entry := range entries {
+		if entry.RoleName == "developer" && !entry.Expiration.Equal(expiration.Add(time.Hour)) {
+			t.Errorf("developer entry wasn't replaced: %+v", entry)
+		}
+	}
+}
+
+func TestEntriesReturnsSnapshot(t *testing.T) {
+	store := NewAWSCredentialStore()
+	expiration := time.Now().Add(time.Hour)
+	store.UpsertEntry(testEntry("111111111111", "a", expiration))
+	store.UpsertEntry(testEntry("111111111111", "b", expiration))
+	store.UpsertEntry(testEntry("111111111111", "c", expiration))
+
+	snapshot := store.Entries()
+	snapshot[0].RoleName = "modified"
+	store.RemoveEntryForRole("111111111111", "a")
+	store.UpsertEntry(testEntry("222222222222", "d", expiration))
+
+	if snapshot[1].RoleName != "b" || snapshot[2].RoleName != "c" {
+		t.Errorf("snapshot was modified by the store: %+v", snapshot)
+	}
+	for _, entry := range store.Entries() {
+		if entry.RoleName == "modified" || entry.RoleName == "a" {
+			t.Errorf("store was modified through a snapshot: %+v", entry)
+		}
+	}
+}
+
+func TestReplaceAccountEntries(t *testing.T) {
+	store := NewAWSCredentialStore()
+	expiration := time.Now().Add(time.Hour)
+	for _, roleName := range []string{"kept", "failed", "revoked"} {
+		entry := testEntry("111111111111", roleName, expiration)
+		entry.RoleARN = "arn:aws:iam::111111111111:role/" + roleName
+		store.UpsertEntry(entry)
+	}
+	chained := testEntry("222222222222", "chained", expiration)
+	chained.AccountKey = "account-111111111111"
+	chained.SourceRoleARN = "arn:aws:iam::111111111111:role/kept"
+	store.UpsertEntry(chained)
+	other := testEntry("333333333333", "other", expiration)
+	store.UpsertEntry(other)
+
+	refreshed := testEntry("111111111111", "kept", expiration.Add(time.Hour))
+	store.ReplaceAccountEntries("account-111111111111", []AWSCredentialEntry{refreshed}, map[string]string{
+		"arn:aws:iam::111111111111:role/failed": "AccessDenied",
+	})
+
+	roles := make(map[string]AWSCredentialEntry)
+	for _, entry := range store.Entries() {
+		roles[entry.RoleName] = entry
+	}
+	if len(roles) != 4 {
+		t.Fatalf("expected kept, failed, chained and other, got %+v", roles)
+	}
+	if !roles["kept"].Expiration.Equal(expiration.Add(time.Hour)) || roles["kept"].RefreshError != "" {
+		t.Errorf("kept wasn't replaced: %+v", roles["kept"])
+	}
+	if roles["failed"].RefreshError != "AccessDenied" || !roles["failed"].Expiration.Equal(expiration) {
+		t.Errorf("failed should keep its credentials and be marked: %+v", roles["failed"])
+	}
+	if _, ok := roles["revoked"]; ok {
+		t.Errorf("the revoked role wasn't dropped")
+	}
+}
+
+func TestFailedRolesDontTriggerRefreshes(t *testing.T) {
+	previousConfig := config.Current()
+	previousStore := CredentialStore
+	config.SetCurrent(&config.Config{
+		RenewWithinSeconds: 15 * 60,
+		Accounts:           []config.Account{{ID: "account-111111111111", MetadataURL: "https://idp.example.com/metadata"}},
+	})
+	CredentialStore = NewAWSCredentialStore()
+	t.Cleanup(func() {
+		config.SetCurrent(previousConfig)
+		CredentialStore = previousStore
+	})
+
+	expired := testEntry("111111111111", "broken", time.Now().Add(-time.Minute))
+	expired.RefreshError = "AccessDenied"
+	CredentialStore.UpsertEntry(expired)
+	if next := NextAccountForRefresh(); next != "account-111111111111" {
+		t.Errorf("expected an account with only failed roles to be refreshed, got %q", next)
+	}
+
+	CredentialStore.UpsertEntry(testEntry("111111111111", "developer", time.Now().Add(time.Hour)))
+	if next := NextAccountForRefresh(); next != "" {
+		t.Errorf("expected the failed role not to trigger a refresh, got %q", next)
+	}
+	deadline, ok := NextRefreshDeadline(time.Now())
+	if !ok || time.Until(deadline) < 30*time.Minute {
+		t.Errorf("expected the next refresh to be due to the developer role, got %s", deadline)
+	}
+}
+
+func TestSubscribeNotifiesAndCoalesces(t *testing.T) {
+	store := NewAWSCredentialStore()
+	changes := store.Subscribe()
+
+	expiration := time.Now().Add(time.Hour)
+	store.UpsertEntry(testEntry("111111111111", "a", expiration))
+	store.UpsertEntry(testEntry("111111111111", "b", expiration))
+
+	select {
+	case <-changes:
+	default:
+		t.Fatal("expected a change notification")
+	}
+	select {
+	case <-changes:
+		t.Fatal("expected notifications to be coalesced")
+	default:
+	}
+
+	store.Unsubscribe(changes)
+	store.UpsertEntry(testEntry("111111111111", "c", expiration))
+	_, open := <-changes
+	if open {
+		t.Error("expected the channel to be closed after Unsubscribe")
+	}
+}
+
+func TestExpiringEntries(t *testing.T) {
+	store := NewAWSCredentialStore()
+	store.UpsertEntry(testEntry("111111111111", "later", time.Now().Add(time.Hour)))
+	store.UpsertEntry(testEntry("111111111111", "soon", time.Now().Add(time.Minute)))
+
+	expiring := store.ExpiringEntries(5 * 60)
+	if len(expiring) != 1 || expiring[0].RoleName != "soon" {
+		t.Errorf("expected only the soon expiring entry, got %+v", expiring)
+	}
+}
+
+// Run with -race to catch unsynchronized access.
+func TestConcurrentAccess(t *testing.T) {
+	store := NewAWSCredentialStore()
+	expiration := time.Now().Add(time.Hour)
+
+	var wg sync.WaitGroup
+	for worker := 0; worker < 8; worker++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+
+			changes := store.Subscribe()
+			defer store.Unsubscribe(changes)
+			for i := 0; i < 100; i++ {
+				role := fmt.Sprintf("role-%d", i%5)
+				store.UpsertEntry(testEntry(fmt.Sprintf("%012d", worker), role, expiration))
+				store.Entries()
+				store.ExpiringEntries(60)
+				store.ContainsAccount("account-000000000000")
+				if i%10 == 0 {
+					store.RemoveEntryForRole(fmt.Sprintf("%012d", worker), role)
+				}
+			}
+		}(worker)
+	}
+	wg.Wait()
+
+	entries := store.Entries()
+	if len(entries) != 8*5 {
+		t.Errorf("expected %d entries, got %d", 8*5, len(entries))
+	}
+}
@@ -0,0 +1,404 @@
+// Package devidp is a local SAML IdP for developing and testing the login flow
+// without a real IdP tenant. It signs in configured test users through a login
+// form shaped like Okta's and grants them AWS roles.
+package devidp
+
+import (
+	"aws-llama/log"
+	"aws-llama/saml"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	crewjam "github.com/crewjam/saml"
+)
+
+const (
+	SESSION_COOKIE  = "aws_llama_dev_idp"
+	SESSION_MAX_AGE = 12 * time.Hour
+
+	DEFAULT_PROVIDER_ARN = "arn:aws:iam::123456789012:saml-provider/aws-llama-dev-idp"
+
+	ROLE_SESSION_NAME_ATTRIBUTE = saml.ROLE_SESSION_NAME_ATTRIBUTE
+
+	CERTIFICATE_NAME = "aws-llama dev IdP"
+)
+
+type User struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	// Role ARNs, or "role ARN,provider ARN" pairs, granted to the user.
+	Roles []string `json:"roles"`
+	// Sent as the SessionDuration attribute when set.
+	SessionDuration int64 `json:"session_duration"`
+}
+
+type Settings struct {
+	Users []User `json:"users"`
+	// SAML provider paired with the roles that don't name one.
+	ProviderARN string `json:"provider_arn"`
+	// ACS URLs of the service providers allowed to log in.
+	ACSURLs []string `json:"acs_urls"`
+	// Metadata of the only service provider allowed to log in instead, e.g. the
+	// output of 'aws-llama sp-metadata'. Assertions are encrypted for its certificate.
+	SPMetadataFile string                    `json:"sp_metadata_file"`
+	SPMetadata     *crewjam.EntityDescriptor `json:"-"`
+}
+
+// A single "dev" user (password "dev") with a developer and a read-only role.
+func DefaultSettings() Settings {
+	return Settings{
+		Users: []User{{
+			Username: "dev",
+			Password: "dev",
+			Roles: []string{
+				"arn:aws:iam::123456789012:role/developer",
+				"arn:aws:iam::123456789012:role/read-only",
+			},
+		}},
+		ProviderARN: DEFAULT_PROVIDER_ARN,
+	}
+}
+
+// Reads Settings from a JSON file.
+func LoadSettings(path string) (Settings, error) {
+	settings := Settings{ProviderARN: DEFAULT_PROVIDER_ARN}
+	bytes, err := os.ReadFile(path)
+	if err != nil {
+		return settings, err
+	}
+	err = json.Unmarshal(bytes, &settings)
+	if err != nil {
+		return settings, fmt.Errorf("invalid dev IdP settings %s: %w", path, err)
+	}
+	if settings.SPMetadataFile != "" {
+		settings.SPMetadata, err = LoadSPMetadata(settings.SPMetadataFile)
+		if err != nil {
+			return settings, err
+		}
+	}
+	return settings, nil
+}
+
+// Reads an SP EntityDescriptor from an XML file.
+func LoadSPMetadata(path string) (*crewjam.EntityDescriptor, error) {
+	bytes, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var metadata crewjam.EntityDescriptor
+	err = xml.Unmarshal(bytes, &metadata)
+	if err != nil {
+		return nil, fmt.Errorf("invalid SP metadata %s: %w", path, err)
+	}
+	return &metadata, nil
+}
+
+func (s *Settings) validate() error {
+	if len(s.Users) == 0 {
+		return fmt.Errorf("no users configured")
+	}
+	for _, user := range s.Users {
+		if user.Username == "" {
+			return fmt.Errorf("users need a username")
+		}
+		if len(user.Roles) == 0 {
+			return fmt.Errorf("user %s has no roles", user.Username)
+		}
+	}
+	if len(s.ACSURLs) == 0 && s.SPMetadata == nil {
+		return fmt.Errorf("no acs_urls or SP metadata configured")
+	}
+	return nil
+}
+
+func (s *Settings) user(username string) *User {
+	for idx := range s.Users {
+		if s.Users[idx].Username == username {
+			return &s.Users[idx]
+		}
+	}
+	return nil
+}
+
+// The values of the Role attribute for user.
+func (s *Settings) rolePairs(user *User) []string {
+	pairs := make([]string, 0, len(user.Roles))
+	for _, role := range user.Roles {
+		if !strings.Contains(role, ",") {
+			role = role + "," + s.ProviderARN
+		}
+		pairs = append(pairs, role)
+	}
+	return pairs
+}
+
+type IdP struct {
+	settings Settings
+	provider *crewjam.IdentityProvider
+
+	lock     sync.Mutex
+	sessions map[string]*crewjam.Session
+}
+
+// Creates an IdP served from baseURL, signing with key and cert.
+func New(baseURL url.URL, key *rsa.PrivateKey, cert *x509.Certificate, settings Settings) (*IdP, error) {
+	if settings.ProviderARN == "" {
+		settings.ProviderARN = DEFAULT_PROVIDER_ARN
+	}
+	err := settings.validate()
+	if err != nil {
+		return nil, err
+	}
+
+	idp := &IdP{
+		settings: settings,
+		sessions: make(map[string]*crewjam.Session),
+	}
+	idp.provider = &crewjam.IdentityProvider{
+		Key:                     key,
+		Certificate:             cert,
+		Logger:                  logger{},
+		MetadataURL:             *baseURL.ResolveReference(&url.URL{Path: "/metadata"}),
+		SSOURL:                  *baseURL.ResolveReference(&url.URL{Path: "/sso"}),
+		ServiceProviderProvider: idp,
+		SessionProvider:         idp,
+	}
+	return idp, nil
+}
+
+// The URL to use as an account's metadata_url.
+func (i *IdP) MetadataURL() url.URL {
+	return i.currentProvider().MetadataURL
+}
+
+func (i *IdP) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metadata", func(w http.ResponseWriter, r *http.Request) {
+		i.currentProvider().ServeMetadata(w, r)
+	})
+	mux.HandleFunc("/sso", func(w http.ResponseWriter, r *http.Request) {
+		i.currentProvider().ServeSSO(w, r)
+	})
+	return mux
+}
+
+// Replaces the signing key pair, the way IdPs rotate their certificate. The
+// metadata serves the new certificate from then on.
+func (i *IdP) RotateKey(key *rsa.PrivateKey, cert *x509.Certificate) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	provider := *i.provider
+	provider.Key = key
+	provider.Certificate = cert
+	i.provider = &provider
+}
+
+func (i *IdP) currentProvider() *crewjam.IdentityProvider {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	return i.provider
+}
+
+// Implements crewjam.ServiceProviderProvider. Without SP metadata, any service
+// provider is accepted as long as its assertions go to one of the ACS URLs.
+func (i *IdP) GetServiceProvider(r *http.Request, serviceProviderID string) (*crewjam.EntityDescriptor, error) {
+	if i.settings.SPMetadata != nil {
+		if i.settings.SPMetadata.EntityID != serviceProviderID {
+			return nil, os.ErrNotExist
+		}
+		return i.settings.SPMetadata, nil
+	}
+
+	services := make([]crewjam.IndexedEndpoint, 0, len(i.settings.ACSURLs))
+	for idx, acsURL := range i.settings.ACSURLs {
+		services = append(services, crewjam.IndexedEndpoint{
+			Binding:  crewjam.HTTPPostBinding,
+			Location: acsURL,
+			Index:    idx + 1,
+		})
+	}
+	return &crewjam.EntityDescriptor{
+		EntityID: serviceProviderID,
+		SPSSODescriptors: []crewjam.SPSSODescriptor{{
+			SSODescriptor: crewjam.SSODescriptor{
+				RoleDescriptor: crewjam.RoleDescriptor{
+					ProtocolSupportEnumeration: "urn:oasis:names:tc:SAML:2.0:protocol",
+				},
+			},
+			AssertionConsumerServices: services,
+		}},
+	}, nil
+}
+
+// Implements crewjam.SessionProvider: returns the session from the cookie, signs
+// in with the posted login form, or renders the login form.
+func (i *IdP) GetSession(w http.ResponseWriter, r *http.Request, req *crewjam.IdpAuthnRequest) *crewjam.Session {
+	if r.Method == "POST" && r.PostForm.Get("identifier") != "" {
+		user := i.settings.user(r.PostForm.Get("identifier"))
+		if user == nil || user.Password != r.PostForm.Get("credentials.passcode") {
+			i.sendLoginForm(w, req, "Unable to sign in")
+			return nil
+		}
+
+		session := i.newSession(user)
+		cookie := http.Cookie{
+			Name:     SESSION_COOKIE,
+			Value:    session.ID,
+			HttpOnly: true,
+			Path:     "/",
+		}
+		// Like Okta's "Keep me signed in": otherwise the session ends with the browser.
+		if r.PostForm.Get("rememberMe") != "" {
+			cookie.MaxAge = int(SESSION_MAX_AGE.Seconds())
+		}
+		http.SetCookie(w, &cookie)
+		return session
+	}
+
+	cookie, err := r.Cookie(SESSION_COOKIE)
+	if err == nil {
+		session := i.session(cookie.Value)
+		if session != nil {
+			return session
+		}
+	}
+
+	i.sendLoginForm(w, req, "")
+	return nil
+}
+
+func (i *IdP) newSession(user *User) *crewjam.Session {
+	now := crewjam.TimeNow()
+	attributes := []crewjam.Attribute{
+		attribute(saml.ROLE_ATTRIBUTE, i.settings.rolePairs(user)...),
+		attribute(ROLE_SESSION_NAME_ATTRIBUTE, user.Username),
+	}
+	if user.SessionDuration != 0 {
+		attributes = append(attributes, attribute(saml.SESSION_DURATION_ATTRIBUTE, strconv.FormatInt(user.SessionDuration, 10)))
+	}
+
+	session := &crewjam.Session{
+		ID:               randomHex(16),
+		CreateTime:       now,
+		ExpireTime:       now.Add(SESSION_MAX_AGE),
+		Index:            randomHex(16),
+		NameID:           user.Username,
+		UserName:         user.Username,
+		CustomAttributes: attributes,
+	}
+
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	i.sessions[session.ID] = session
+	return session
+}
+
+func (i *IdP) session(id string) *crewjam.Session {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	session, ok := i.sessions[id]
+	if !ok {
+		return nil
+	}
+	if crewjam.TimeNow().After(session.ExpireTime) {
+		delete(i.sessions, id)
+		return nil
+	}
+	return session
+}
+
+// Field names and the button label match Okta's sign-in widget, so the browser
+// automation works against the dev IdP too.
+var loginForm = template.Must(template.New("login").Parse(`<!DOCTYPE html>
+<html>
+<head><title>aws-llama dev IdP</title></head>
+<body>
+<h1>aws-llama dev IdP</h1>
+{{if .Message}}<p class="error">{{.Message}}</p>{{end}}
+<form method="post" action="{{.URL}}">
+<label>Username <input type="text" name="identifier" autocomplete="username" /></label>
+<label>Password <input type="password" name="credentials.passcode" autocomplete="current-password" /></label>
+<label><input type="checkbox" name="rememberMe" value="true" /> Keep me signed in</label>
+<input type="hidden" name="SAMLRequest" value="{{.SAMLRequest}}" />
+<input type="hidden" name="RelayState" value="{{.RelayState}}" />
+<input type="submit" value="Sign in" />
+</form>
+</body>
+</html>
+`))
+
+// Renders the login form, posting back to the SSO URL with the AuthnRequest so
+// the flow restarts once signed in.
+func (i *IdP) sendLoginForm(w http.ResponseWriter, req *crewjam.IdpAuthnRequest, message string) {
+	data := struct {
+		Message     string
+		URL         string
+		SAMLRequest string
+		RelayState  string
+	}{
+		Message:     message,
+		URL:         i.currentProvider().SSOURL.String(),
+		SAMLRequest: base64.StdEncoding.EncodeToString(req.RequestBuffer),
+		RelayState:  req.RelayState,
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if message != "" {
+		w.WriteHeader(http.StatusUnauthorized)
+	}
+	err := loginForm.Execute(w, data)
+	if err != nil {
+		log.Logger.Errorf("Failed to render the dev IdP login form: %s", err.Error())
+	}
+}
+
+func attribute(name string, values ...string) crewjam.Attribute {
+	attributeValues := make([]crewjam.AttributeValue, 0, len(values))
+	for _, value := range values {
+		attributeValues = append(attributeValues, crewjam.AttributeValue{Type: "xs:string", Value: value})
+	}
+	return crewjam.Attribute{
+		Name:       name,
+		NameFormat: "urn:oasis:names:tc:SAML:2.0:attrname-format:uri",
+		Values:     attributeValues,
+	}
+}
+
+func randomHex(n int) string {
+	buf := make([]byte, n)
+	_, err := rand.Read(buf)
+	if err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(buf)
+}
+
+// Sends crewjam's logging to log.Logger.
+type logger struct{}
+
+func (logger) Printf(format string, v ...interface{}) { log.Logger.Infof(format, v...) }
+func (logger) Print(v ...interface{})                 { log.Logger.Info(v...) }
+func (logger) Println(v ...interface{})               { log.Logger.Info(v...) }
+func (logger) Fatal(v ...interface{})                 { log.Logger.Fatal(v...) }
+func (logger) Fatalf(format string, v ...interface{}) { log.Logger.Fatalf(format, v...) }
+func (logger) Fatalln(v ...interface{})               { log.Logger.Fatal(v...) }
+func (logger) Panic(v ...interface{})                 { log.Logger.Panic(v...) }
+func (logger) Panicf(format string, v ...interface{}) { log.Logger.Panicf(format, v...) }
+func (logger) Panicln(v ...interface{})               { log.Logger.Panic(v...) }
@@ -0,0 +1,150 @@
+package devidp_test
+
+import (
+	"aws-llama/devidp"
+	"aws-llama/devidp/devidptest"
+	"aws-llama/log"
+	"aws-llama/saml"
+	"context"
+	"encoding/base64"
+	"net/url"
+	"strings"
+	"testing"
+
+	crewjam "github.com/crewjam/saml"
+	"github.com/crewjam/saml/samlsp"
+	"go.uber.org/zap"
+)
+
+const testACSURL = "http://localhost:2600/sso/saml"
+
+func newServer(t *testing.T) *devidptest.Server {
+	log.Logger = zap.NewNop().Sugar()
+	return devidptest.NewServer(t, devidp.Settings{
+		Users: []devidp.User{{
+			Username: "alice",
+			Password: "secret",
+			Roles: []string{
+				"arn:aws:iam::111111111111:role/developer",
+				"arn:aws:iam::222222222222:role/admin,arn:aws:iam::222222222222:saml-provider/Other",
+			},
+			SessionDuration: 7200,
+		}},
+		ProviderARN: "arn:aws:iam::111111111111:saml-provider/DevIdP",
+	})
+}
+
+// Returns a service provider for the IdP, the ID of its AuthnRequest and the URL
+// the request redirects to.
+func startLogin(t *testing.T, server *devidptest.Server, acsURL string) (*crewjam.ServiceProvider, string, string) {
+	metadata, err := samlsp.FetchMetadata(context.Background(), server.Server.Client(), server.MetadataURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	acs, _ := url.Parse(acsURL)
+	sp := &crewjam.ServiceProvider{
+		EntityID:    testACSURL,
+		AcsURL:      *acs,
+		IDPMetadata: metadata,
+	}
+	request, err := sp.MakeAuthenticationRequest(sp.GetSSOBindingLocation(crewjam.HTTPRedirectBinding), crewjam.HTTPRedirectBinding, crewjam.HTTPPostBinding)
+	if err != nil {
+		t.Fatal(err)
+	}
+	redirectURL, err := request.Redirect("relay", sp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sp, request.ID, redirectURL.String()
+}
+
+func attributeValues(assertion *crewjam.Assertion, name string) []string {
+	values := make([]string, 0)
+	for _, statement := range assertion.AttributeStatements {
+		for _, attribute := range statement.Attributes {
+			if attribute.Name != name {
+				continue
+			}
+			for _, value := range attribute.Values {
+				values = append(values, value.Value)
+			}
+		}
+	}
+	return values
+}
+
+func TestSignInIssuesRoleAttributes(t *testing.T) {
+	server := newServer(t)
+	sp, requestID, ssoURL := startLogin(t, server, testACSURL)
+
+	form, err := devidptest.SignIn(devidptest.NewClient(), ssoURL, "alice", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if form.Action != testACSURL || form.Values.Get("RelayState") != "relay" {
+		t.Errorf("unexpected response form: %+v", form)
+	}
+
+	raw, err := base64.StdEncoding.DecodeString(form.Values.Get("SAMLResponse"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertion, err := sp.ParseXMLResponse(raw, []string{requestID})
+	if err != nil {
+		t.Fatalf("the service provider rejected the response: %s", err)
+	}
+
+	roles := attributeValues(assertion, saml.ROLE_ATTRIBUTE)
+	expected := []string{
+		"arn:aws:iam::111111111111:role/developer,arn:aws:iam::111111111111:saml-provider/DevIdP",
+		"arn:aws:iam::222222222222:role/admin,arn:aws:iam::222222222222:saml-provider/Other",
+	}
+	if strings.Join(roles, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("unexpected roles %v, expected %v", roles, expected)
+	}
+	if duration := saml.ExtractSessionDurationFromAssertion(assertion); duration != 7200 {
+		t.Errorf("unexpected session duration %d", duration)
+	}
+	if names := attributeValues(assertion, devidp.ROLE_SESSION_NAME_ATTRIBUTE); len(names) != 1 || names[0] != "alice" {
+		t.Errorf("unexpected role session name %v", names)
+	}
+}
+
+func TestSignInRejectsWrongPassword(t *testing.T) {
+	server := newServer(t)
+	_, _, ssoURL := startLogin(t, server, testACSURL)
+
+	_, err := devidptest.SignIn(devidptest.NewClient(), ssoURL, "alice", "wrong")
+	if err == nil || !strings.Contains(err.Error(), "Unable to sign in") {
+		t.Errorf("expected the login form to reject the password, got %v", err)
+	}
+}
+
+func TestSessionCookieSkipsLoginForm(t *testing.T) {
+	server := newServer(t)
+	client := devidptest.NewClient()
+
+	_, _, ssoURL := startLogin(t, server, testACSURL)
+	_, err := devidptest.SignIn(client, ssoURL, "alice", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// With a session, the password is never asked for.
+	_, _, ssoURL = startLogin(t, server, testACSURL)
+	_, err = devidptest.SignIn(client, ssoURL, "alice", "wrong")
+	if err != nil {
+		t.Errorf("expected the session to be reused, got %s", err)
+	}
+}
+
+func TestRejectsUnknownACSURL(t *testing.T) {
+	server := newServer(t)
+	_, _, ssoURL := startLogin(t, server, "http://evil.example.com/sso/saml")
+
+	_, err := devidptest.SignIn(devidptest.NewClient(), ssoURL, "alice", "secret")
+	if err == nil || !strings.Contains(err.Error(), "400") {
+		t.Errorf("expected the AuthnRequest to be rejected, got %v", err)
+	}
+}
@@ -0,0 +1,171 @@
+// Package devidptest runs the dev IdP on an httptest server and signs in through
+// it the way a browser would.
+package devidptest
+
+import (
+	"aws-llama/devidp"
+	"aws-llama/saml"
+	"crypto/rsa"
+	"crypto/x509"
+	"fmt"
+	"html"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+)
+
+type Server struct {
+	*devidp.IdP
+	Server *httptest.Server
+}
+
+// Generating RSA keys is slow, so every server of a test binary shares one.
+var (
+	keyOnce sync.Once
+	key     *rsa.PrivateKey
+	cert    *x509.Certificate
+	keyErr  error
+)
+
+// Starts a dev IdP that is closed when the test ends. Without ACSURLs in
+// settings, it accepts assertions for aws-llama's default ACS URL.
+func NewServer(tb testing.TB, settings devidp.Settings) *Server {
+	keyOnce.Do(func() {
+		key, cert, keyErr = saml.GenerateKeyPair(devidp.CERTIFICATE_NAME)
+	})
+	if keyErr != nil {
+		tb.Fatal(keyErr)
+	}
+	if len(settings.ACSURLs) == 0 {
+		settings.ACSURLs = []string{"http://localhost:2600/sso/saml"}
+	}
+
+	var idp *devidp.IdP
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		idp.Handler().ServeHTTP(w, r)
+	}))
+	tb.Cleanup(server.Close)
+
+	baseURL, err := url.Parse(server.URL)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	idp, err = devidp.New(*baseURL, key, cert, settings)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return &Server{IdP: idp, Server: server}
+}
+
+func (s *Server) MetadataURLString() string {
+	metadataURL := s.MetadataURL()
+	return metadataURL.String()
+}
+
+// A client that keeps the IdP session cookie and doesn't follow redirects.
+func NewClient() *http.Client {
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		panic(err)
+	}
+	return &http.Client{
+		Jar:           jar,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error { return http.ErrUseLastResponse },
+	}
+}
+
+// The form a browser would post to the service provider.
+type Form struct {
+	Action string
+	Values url.Values
+}
+
+var (
+	formAction  = regexp.MustCompile(`<form method="post" action="([^"]*)"`)
+	hiddenInput = regexp.MustCompile(`<input type="hidden" name="([^"]*)" value="([^"]*)"`)
+)
+
+// Parses the form of an HTML page, keeping its hidden inputs.
+func ParseForm(body string) (*Form, error) {
+	action := formAction.FindStringSubmatch(body)
+	if action == nil {
+		return nil, fmt.Errorf("no form in page: %s", body)
+	}
+	form := Form{Action: html.UnescapeString(action[1]), Values: url.Values{}}
+	for _, input := range hiddenInput.FindAllStringSubmatch(body, -1) {
+		form.Values.Set(html.UnescapeString(input[1]), html.UnescapeString(input[2]))
+	}
+	return &form, nil
+}
+
+func readPage(response *http.Response) (string, error) {
+	defer response.Body.Close()
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		return "", err
+	}
+	if response.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s returned %d: %s", response.Request.URL, response.StatusCode, body)
+	}
+	return string(body), nil
+}
+
+// Follows ssoURL (where aws-llama's /login redirects with the HTTP-Redirect
+// binding), signing in with username and password unless client already has an
+// IdP session, and returns the SAML response form the IdP hands back.
+func SignIn(client *http.Client, ssoURL string, username string, password string) (*Form, error) {
+	response, err := client.Get(ssoURL)
+	if err != nil {
+		return nil, err
+	}
+	return signIn(client, response, username, password)
+}
+
+// Like SignIn, for the AuthnRequest form /login renders with the HTTP-POST binding.
+func SignInWithForm(client *http.Client, request *Form, username string, password string) (*Form, error) {
+	response, err := client.Post(request.Action, "application/x-www-form-urlencoded", strings.NewReader(request.Values.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	return signIn(client, response, username, password)
+}
+
+func signIn(client *http.Client, response *http.Response, username string, password string) (*Form, error) {
+	body, err := readPage(response)
+	if err != nil {
+		return nil, err
+	}
+	form, err := ParseForm(body)
+	if err != nil {
+		return nil, err
+	}
+	if form.Values.Get("SAMLResponse") != "" {
+		return form, nil
+	}
+
+	form.Values.Set("identifier", username)
+	form.Values.Set("credentials.passcode", password)
+	form.Values.Set("rememberMe", "true")
+	response, err = client.Post(form.Action, "application/x-www-form-urlencoded", strings.NewReader(form.Values.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	body, err = readPage(response)
+	if err != nil {
+		return nil, err
+	}
+	form, err = ParseForm(body)
+	if err != nil {
+		return nil, err
+	}
+	if form.Values.Get("SAMLResponse") == "" {
+		return nil, fmt.Errorf("no SAMLResponse after signing in: %s", body)
+	}
+	return form, nil
+}
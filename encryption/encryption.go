@@ -0,0 +1,194 @@
+package encryption
+
+import (
+	"aws-llama/config"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Prefix of every encrypted file. Anything without it is treated as plaintext,
+// which lets existing state files be migrated transparently.
+var magic = []byte("AWSLLAMA-ENC1\n")
+
+const saltSize = 16
+const keySize = 32
+
+// Provides the 32-byte AES key. The salt is stored alongside the ciphertext and
+// only matters for providers that derive the key from a passphrase.
+type keyProvider interface {
+	key(salt []byte) ([]byte, error)
+}
+
+var providerLock sync.Mutex
+var provider keyProvider
+
+// The settings provider was created for. A config reload that changes them
+// replaces the provider.
+var providerSettings config.Encryption
+
+// Salt used for everything sealed by this process, so a passphrase-derived key
+// only has to be derived once.
+var sealSalt []byte
+
+func currentProvider() (keyProvider, error) {
+	providerLock.Lock()
+	defer providerLock.Unlock()
+
+	settings := config.Current().Encryption
+	if provider != nil && providerSettings == settings {
+		return provider, nil
+	}
+
+	provider = nil
+	switch settings.Mode {
+	case config.EncryptionModeSecretService:
+		provider = &cachedKeyProvider{load: secretServiceKey}
+	case config.EncryptionModeKeyring:
+		provider = &cachedKeyProvider{load: kernelKeyringKey}
+	case config.EncryptionModePassphrase:
+		provider = &passphraseKeyProvider{passphraseFile: settings.PassphraseFile, keys: make(map[string][]byte)}
+	default:
+		return nil, fmt.Errorf("unsupported encryption mode: %q", settings.Mode)
+	}
+	providerSettings = settings
+	return provider, nil
+}
+
+func currentSealSalt() ([]byte, error) {
+	providerLock.Lock()
+	defer providerLock.Unlock()
+
+	if sealSalt == nil {
+		salt := make([]byte, saltSize)
+		_, err := io.ReadFull(rand.Reader, salt)
+		if err != nil {
+			return nil, err
+		}
+		sealSalt = salt
+	}
+	return sealSalt, nil
+}
+
+func Enabled() bool {
+	return config.Current().Encryption.Mode != config.EncryptionModeNone
+}
+
+func IsEncrypted(data []byte) bool {
+	return bytes.HasPrefix(data, magic)
+}
+
+// Encrypts plaintext with the configured key. Returns plaintext unchanged when
+// encryption is disabled.
+func Seal(plaintext []byte) ([]byte, error) {
+	if !Enabled() {
+		return plaintext, nil
+	}
+
+	provider, err := currentProvider()
+	if err != nil {
+		return nil, err
+	}
+
+	salt, err := currentSealSalt()
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(provider, salt)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	_, err = io.ReadFull(rand.Reader, nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	sealed := make([]byte, 0, len(magic)+len(salt)+len(nonce)+len(plaintext)+aead.Overhead())
+	sealed = append(sealed, magic...)
+	sealed = append(sealed, salt...)
+	sealed = append(sealed, nonce...)
+	// The header is authenticated too, so it can't be swapped between files.
+	return aead.Seal(sealed, nonce, plaintext, sealed), nil
+}
+
+// Decrypts data produced by Seal. Plaintext data is returned unchanged.
+func Open(data []byte) ([]byte, error) {
+	if !IsEncrypted(data) {
+		return data, nil
+	}
+
+	provider, err := currentProvider()
+	if err != nil {
+		return nil, fmt.Errorf("data is encrypted but encryption isn't usable: %w", err)
+	}
+
+	header := len(magic) + saltSize
+	if len(data) < header {
+		return nil, errors.New("encrypted data is truncated")
+	}
+	salt := data[len(magic):header]
+	aead, err := newAEAD(provider, salt)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < header+aead.NonceSize() {
+		return nil, errors.New("encrypted data is truncated")
+	}
+	nonce := data[header : header+aead.NonceSize()]
+	ciphertext := data[header+aead.NonceSize():]
+
+	plaintext, err := aead.Open(nil, nonce, ciphertext, data[:header+aead.NonceSize()])
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt (wrong key?): %w", err)
+	}
+	return plaintext, nil
+}
+
+func newAEAD(provider keyProvider, salt []byte) (cipher.AEAD, error) {
+	key, err := provider.key(salt)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Wraps a provider that stores a random key somewhere, fetching it only once.
+type cachedKeyProvider struct {
+	lock   sync.Mutex
+	load   func() ([]byte, error)
+	cached []byte
+}
+
+func (c *cachedKeyProvider) key(salt []byte) ([]byte, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.cached != nil {
+		return c.cached, nil
+	}
+	key, err := c.load()
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != keySize {
+		return nil, fmt.Errorf("stored encryption key has %d bytes, expected %d", len(key), keySize)
+	}
+	c.cached = key
+	return key, nil
+}
+
+func newRandomKey() ([]byte, error) {
+	key := make([]byte, keySize)
+	_, err := io.ReadFull(rand.Reader, key)
+	return key, err
+}
@@ -0,0 +1,162 @@
+package encryption
+
+import (
+	"aws-llama/config"
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Puts settings in effect, with a fresh provider and salt.
+func setupEncryption(t *testing.T, settings config.Encryption) {
+	previousConfig := config.Current()
+	config.SetCurrent(&config.Config{Encryption: settings})
+	reset := func() {
+		providerLock.Lock()
+		defer providerLock.Unlock()
+		provider = nil
+		providerSettings = config.Encryption{}
+		sealSalt = nil
+	}
+	reset()
+	t.Cleanup(func() {
+		config.SetCurrent(previousConfig)
+		reset()
+	})
+}
+
+// Writes a passphrase file and returns the settings using it.
+func passphraseSettings(t *testing.T, passphrase string) config.Encryption {
+	path := filepath.Join(t.TempDir(), "passphrase")
+	err := os.WriteFile(path, []byte(passphrase+"\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return config.Encryption{Mode: config.EncryptionModePassphrase, PassphraseFile: path}
+}
+
+func TestSealOpenRoundTrip(t *testing.T) {
+	t.Setenv(PASSPHRASE_ENV, "correct horse battery staple")
+	setupEncryption(t, config.Encryption{Mode: config.EncryptionModePassphrase})
+	plaintext := []byte(`{"Version": 1, "Entries": []}`)
+
+	sealed, err := Seal(plaintext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsEncrypted(sealed) || bytes.Contains(sealed, plaintext) {
+		t.Fatalf("expected sealed data to be encrypted, got %q", sealed)
+	}
+
+	opened, err := Open(sealed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(opened, plaintext) {
+		t.Errorf("expected %q, got %q", plaintext, opened)
+	}
+}
+
+func TestPassphraseFileRoundTrip(t *testing.T) {
+	settings := passphraseSettings(t, "from a file")
+	setupEncryption(t, settings)
+
+	sealed, err := Seal([]byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// As after a restart: the key is derived again from the passphrase and salt.
+	setupEncryption(t, settings)
+	opened, err := Open(sealed)
+	if err != nil || string(opened) != "secret" {
+		t.Errorf("expected the sealed data back, got %q (%v)", opened, err)
+	}
+}
+
+func TestOpenWithWrongPassphraseFails(t *testing.T) {
+	setupEncryption(t, passphraseSettings(t, "right"))
+	sealed, err := Seal([]byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	setupEncryption(t, passphraseSettings(t, "wrong"))
+	_, err = Open(sealed)
+	if err == nil || !strings.Contains(err.Error(), "wrong key") {
+		t.Errorf("expected a wrong key error, got %v", err)
+	}
+}
+
+func TestOpenTamperedDataFails(t *testing.T) {
+	setupEncryption(t, passphraseSettings(t, "right"))
+	sealed, err := Seal([]byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sealed[len(sealed)-1] ^= 1
+	_, err = Open(sealed)
+	if err == nil {
+		t.Errorf("expected tampered data to be rejected")
+	}
+	_, err = Open(sealed[:len(magic)+4])
+	if err == nil || !strings.Contains(err.Error(), "truncated") {
+		t.Errorf("expected truncated data to be rejected, got %v", err)
+	}
+}
+
+func TestPassphraseRequired(t *testing.T) {
+	t.Setenv(PASSPHRASE_ENV, "")
+	setupEncryption(t, config.Encryption{Mode: config.EncryptionModePassphrase})
+
+	_, err := Seal([]byte("secret"))
+	if err == nil || !strings.Contains(err.Error(), PASSPHRASE_ENV) {
+		t.Errorf("expected an error asking for a passphrase, got %v", err)
+	}
+}
+
+func TestDisabledEncryptionPassesPlaintext(t *testing.T) {
+	setupEncryption(t, config.Encryption{Mode: config.EncryptionModeNone})
+
+	sealed, err := Seal([]byte("plain"))
+	if err != nil || string(sealed) != "plain" {
+		t.Errorf("expected plaintext to be written as is, got %q (%v)", sealed, err)
+	}
+	opened, err := Open([]byte("plain"))
+	if err != nil || string(opened) != "plain" {
+		t.Errorf("expected plaintext to be read as is, got %q (%v)", opened, err)
+	}
+}
+
+func TestProviderFollowsConfigReload(t *testing.T) {
+	first := passphraseSettings(t, "first")
+	second := passphraseSettings(t, "second")
+	setupEncryption(t, first)
+	sealedFirst, err := Seal([]byte("first"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A reload to other settings uses a provider for them.
+	config.SetCurrent(&config.Config{Encryption: second})
+	_, err = Open(sealedFirst)
+	if err == nil {
+		t.Errorf("expected data sealed with the previous passphrase not to open")
+	}
+	sealedSecond, err := Seal([]byte("second"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config.SetCurrent(&config.Config{Encryption: first})
+	opened, err := Open(sealedFirst)
+	if err != nil || string(opened) != "first" {
+		t.Errorf("expected the first passphrase to be used again, got %q (%v)", opened, err)
+	}
+	_, err = Open(sealedSecond)
+	if err == nil {
+		t.Errorf("expected data sealed with the second passphrase not to open")
+	}
+}
@@ -0,0 +1,149 @@
+package encryption
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+const SECRET_SERVICE_NAME = "aws-llama"
+const SECRET_SERVICE_KEY_ATTRIBUTE = "state-encryption-key"
+const KEYRING_KEY_DESCRIPTION = "aws-llama:state-encryption-key"
+const PASSPHRASE_ENV = "AWS_LLAMA_PASSPHRASE"
+
+// Fetches the key from the Secret Service (GNOME Keyring, KWallet, ...) using
+// secret-tool, generating and storing a new one on first use. Only a lookup
+// that found nothing leads to a new key: replacing the key because the keyring
+// is locked or unreachable would make every encrypted file unreadable.
+func secretServiceKey() ([]byte, error) {
+	attributes := []string{"service", SECRET_SERVICE_NAME, "key", SECRET_SERVICE_KEY_ATTRIBUTE}
+
+	var stdout, stderr bytes.Buffer
+	lookupCmd := exec.Command("secret-tool", append([]string{"lookup"}, attributes...)...)
+	lookupCmd.Stdout = &stdout
+	lookupCmd.Stderr = &stderr
+	err := lookupCmd.Run()
+	if err == nil {
+		if stdout.Len() == 0 {
+			return nil, fmt.Errorf("secret-tool returned an empty encryption key")
+		}
+		return base64.StdEncoding.DecodeString(strings.TrimSpace(stdout.String()))
+	}
+	if !secretToolNotFound(err, stderr.Bytes()) {
+		return nil, fmt.Errorf("failed to look up the encryption key with secret-tool (is the keyring unlocked?): %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	// Not found: create a new key.
+	key, err := newRandomKey()
+	if err != nil {
+		return nil, err
+	}
+	storeArgs := append([]string{"store", "--label", "aws-llama state encryption key"}, attributes...)
+	storeCmd := exec.Command("secret-tool", storeArgs...)
+	storeCmd.Stdin = strings.NewReader(base64.StdEncoding.EncodeToString(key))
+	output, err := storeCmd.CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("failed to store encryption key with secret-tool: %w: %s", err, output)
+	}
+	return key, nil
+}
+
+// Fetches the key from the Linux kernel user keyring using keyctl, generating
+// and storing a new one on first use. The user keyring doesn't survive a reboot,
+// after which everything encrypted with the old key has to be recreated.
+func kernelKeyringKey() ([]byte, error) {
+	var stdout, stderr bytes.Buffer
+	searchCmd := exec.Command("keyctl", "search", "@u", "user", KEYRING_KEY_DESCRIPTION)
+	searchCmd.Stdout = &stdout
+	searchCmd.Stderr = &stderr
+	err := searchCmd.Run()
+	if err == nil {
+		keyId := strings.TrimSpace(stdout.String())
+		key, err := exec.Command("keyctl", "pipe", keyId).Output()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read encryption key %s from the kernel keyring: %w", keyId, err)
+		}
+		return key, nil
+	}
+	if !keyctlNotFound(err, stderr.Bytes()) {
+		return nil, fmt.Errorf("failed to look up the encryption key with keyctl: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	key, err := newRandomKey()
+	if err != nil {
+		return nil, err
+	}
+	addCmd := exec.Command("keyctl", "padd", "user", KEYRING_KEY_DESCRIPTION, "@u")
+	addCmd.Stdin = bytes.NewReader(key)
+	combined, err := addCmd.CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("failed to store encryption key with keyctl: %w: %s", err, combined)
+	}
+	return key, nil
+}
+
+// Whether a failed secret-tool lookup means that nothing matched: it then exits
+// with status 1 and no message, while a locked keyring, a dismissed unlock
+// prompt or a missing D-Bus session come with an error message.
+func secretToolNotFound(err error, stderr []byte) bool {
+	var exitErr *exec.ExitError
+	return errors.As(err, &exitErr) && exitErr.ExitCode() == 1 && len(bytes.TrimSpace(stderr)) == 0
+}
+
+// Whether a failed keyctl search means that the key doesn't exist (ENOKEY),
+// rather than e.g. that it was revoked or can't be read.
+func keyctlNotFound(err error, stderr []byte) bool {
+	var exitErr *exec.ExitError
+	return errors.As(err, &exitErr) && bytes.Contains(stderr, []byte("Required key not available"))
+}
+
+// Derives keys from a passphrase with scrypt, using the per-file salt.
+type passphraseKeyProvider struct {
+	lock           sync.Mutex
+	passphraseFile string
+	keys           map[string][]byte
+}
+
+func (p *passphraseKeyProvider) passphrase() ([]byte, error) {
+	if p.passphraseFile != "" {
+		contents, err := os.ReadFile(p.passphraseFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read passphrase_file: %w", err)
+		}
+		return bytes.TrimRight(contents, "\r\n"), nil
+	}
+
+	passphrase := os.Getenv(PASSPHRASE_ENV)
+	if passphrase == "" {
+		return nil, fmt.Errorf("passphrase encryption requires passphrase_file or $%s", PASSPHRASE_ENV)
+	}
+	return []byte(passphrase), nil
+}
+
+func (p *passphraseKeyProvider) key(salt []byte) ([]byte, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	key, ok := p.keys[string(salt)]
+	if ok {
+		return key, nil
+	}
+
+	passphrase, err := p.passphrase()
+	if err != nil {
+		return nil, err
+	}
+	key, err = scrypt.Key(passphrase, salt, 1<<15, 8, 1, keySize)
+	if err != nil {
+		return nil, err
+	}
+	p.keys[string(salt)] = key
+	return key, nil
+}
@@ -0,0 +1,90 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+
+package encryption
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Puts a fake command on the PATH that runs script, and returns the file it
+// logs its arguments to.
+func fakeCommand(t *testing.T, name string, script string) string {
+	dir := t.TempDir()
+	calls := filepath.Join(dir, "calls")
+	contents := "#!/bin/sh\necho \"$@\" >> " + calls + "\n" + script + "\n"
+	if err := os.WriteFile(filepath.Join(dir, name), []byte(contents), 0700); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	return calls
+}
+
+func commandCalls(t *testing.T, calls string) string {
+	contents, err := os.ReadFile(calls)
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	return string(contents)
+}
+
+func TestSecretServiceKeyKeepsKeyWhenKeyringUnavailable(t *testing.T) {
+	for name, lookup := range map[string]string{
+		"no D-Bus session": `echo "secret-tool: Cannot autolaunch D-Bus without X11 \$DISPLAY" >&2; exit 1`,
+		"locked keyring":   `echo "secret-tool: Cannot create an item in a locked collection" >&2; exit 1`,
+		"crashed":          `exit 2`,
+	} {
+		calls := fakeCommand(t, "secret-tool", `case "$1" in lookup) `+lookup+`;; esac`)
+
+		_, err := secretServiceKey()
+		if err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+		if strings.Contains(commandCalls(t, calls), "store") {
+			t.Errorf("%s: a new key was stored over the existing one", name)
+		}
+	}
+}
+
+func TestSecretServiceKeyCreatesMissingKey(t *testing.T) {
+	calls := fakeCommand(t, "secret-tool", `case "$1" in lookup) exit 1;; store) cat > /dev/null;; esac`)
+
+	key, err := secretServiceKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(key) != keySize || !strings.Contains(commandCalls(t, calls), "store") {
+		t.Errorf("expected a new key to be stored, got %d bytes and calls %q", len(key), commandCalls(t, calls))
+	}
+}
+
+func TestKernelKeyringKeyKeepsKeyWhenUnreadable(t *testing.T) {
+	for name, search := range map[string]string{
+		"permission denied": `echo "keyctl_search: Permission denied" >&2; exit 1`,
+		"revoked":           `echo "keyctl_search: Key has been revoked" >&2; exit 1`,
+	} {
+		calls := fakeCommand(t, "keyctl", `case "$1" in search) `+search+`;; esac`)
+
+		_, err := kernelKeyringKey()
+		if err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+		if strings.Contains(commandCalls(t, calls), "padd") {
+			t.Errorf("%s: a new key was stored over the existing one", name)
+		}
+	}
+}
+
+func TestKernelKeyringKeyCreatesMissingKey(t *testing.T) {
+	calls := fakeCommand(t, "keyctl", `case "$1" in search) echo "keyctl_search: Required key not available" >&2; exit 1;; padd) cat > /dev/null; echo 42;; esac`)
+
+	key, err := kernelKeyringKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(key) != keySize || !strings.Contains(commandCalls(t, calls), "padd") {
+		t.Errorf("expected a new key to be stored, got %d bytes and calls %q", len(key), commandCalls(t, calls))
+	}
+}
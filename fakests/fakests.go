@@ -0,0 +1,263 @@
+// Package fakests is an in-process saml.STSClient for tests. It checks SAML
+// assertions the way STS would and mints deterministic credentials, without
+// any network access.
+package fakests
+
+import (
+	"aws-llama/config"
+	"aws-llama/saml"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/beevik/etree"
+	crewjam "github.com/crewjam/saml"
+	"github.com/crewjam/saml/xmlenc"
+)
+
+// Used when the caller doesn't ask for a duration, like STS does.
+const DEFAULT_DURATION = 3600
+
+type Call struct {
+	Action          string
+	RoleARN         string
+	PrincipalARN    string
+	AccessKeyId     string
+	DurationSeconds int64
+}
+
+type FakeSTS struct {
+	// Defaults to time.Now.
+	Now func() time.Time
+	// MaxSessionDuration per role ARN. Longer requests fail like they do on AWS.
+	MaxDurations map[string]int64
+	// Errors returned for role ARNs instead of credentials.
+	Failures map[string]error
+	// Private key of the SAML provider, to decrypt encrypted assertions.
+	DecryptionKey *rsa.PrivateKey
+
+	lock   sync.Mutex
+	calls  []Call
+	issued map[string]string // AccessKeyId -> role ARN.
+}
+
+func New() *FakeSTS {
+	return &FakeSTS{
+		MaxDurations: make(map[string]int64),
+		Failures:     make(map[string]error),
+		issued:       make(map[string]string),
+	}
+}
+
+// Every call made so far, in order.
+func (f *FakeSTS) Calls() []Call {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return append([]Call(nil), f.calls...)
+}
+
+func (f *FakeSTS) now() time.Time {
+	if f.Now != nil {
+		return f.Now()
+	}
+	return time.Now()
+}
+
+func (f *FakeSTS) AssumeRoleWithSAML(account *config.Account, principalArn string, roleArn string, samlAssertion string, durationSeconds int64) (*sts.AssumeRoleWithSAMLOutput, error) {
+	f.record(Call{Action: "AssumeRoleWithSAML", RoleARN: roleArn, PrincipalARN: principalArn, DurationSeconds: durationSeconds})
+
+	assertion, err := f.decodeAssertion(samlAssertion)
+	if err != nil {
+		return nil, awserr.New("InvalidIdentityToken", err.Error(), nil)
+	}
+	now := f.now()
+	if assertion.Conditions != nil && !assertion.Conditions.NotOnOrAfter.IsZero() && !now.Before(assertion.Conditions.NotOnOrAfter) {
+		return nil, awserr.New("ExpiredTokenException", "Token must be redeemed within 5 minutes of issuance", nil)
+	}
+	if !grantsRole(assertion, roleArn, principalArn) {
+		return nil, awserr.New("AccessDenied", fmt.Sprintf("Not authorized to perform sts:AssumeRoleWithSAML on %s", roleArn), nil)
+	}
+
+	credential, err := f.mint(roleArn, assertion.ID, durationSeconds, now)
+	if err != nil {
+		return nil, err
+	}
+	sessionName := ""
+	if assertion.Subject != nil && assertion.Subject.NameID != nil {
+		sessionName = assertion.Subject.NameID.Value
+	}
+	user, err := assumedRoleUser(roleArn, sessionName)
+	if err != nil {
+		return nil, err
+	}
+	return &sts.AssumeRoleWithSAMLOutput{Credentials: credential, AssumedRoleUser: user}, nil
+}
+
+func (f *FakeSTS) AssumeRole(account *config.Account, accessKeyId string, secretAccessKey string, sessionToken string, input *sts.AssumeRoleInput) (*sts.AssumeRoleOutput, error) {
+	roleArn := *input.RoleArn
+	var durationSeconds int64
+	if input.DurationSeconds != nil {
+		durationSeconds = *input.DurationSeconds
+	}
+	f.record(Call{Action: "AssumeRole", RoleARN: roleArn, AccessKeyId: accessKeyId, DurationSeconds: durationSeconds})
+
+	f.lock.Lock()
+	_, ok := f.issued[accessKeyId]
+	f.lock.Unlock()
+	if !ok {
+		return nil, awserr.New("InvalidClientTokenId", "The security token included in the request is invalid.", nil)
+	}
+
+	credential, err := f.mint(roleArn, accessKeyId, durationSeconds, f.now())
+	if err != nil {
+		return nil, err
+	}
+	sessionName := ""
+	if input.RoleSessionName != nil {
+		sessionName = *input.RoleSessionName
+	}
+	user, err := assumedRoleUser(roleArn, sessionName)
+	if err != nil {
+		return nil, err
+	}
+	return &sts.AssumeRoleOutput{Credentials: credential, AssumedRoleUser: user}, nil
+}
+
+func (f *FakeSTS) record(call Call) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.calls = append(f.calls, call)
+}
+
+// Derives the credentials from the role and the session they're issued for, so
+// the same inputs always produce the same keys.
+func (f *FakeSTS) mint(roleArn string, session string, durationSeconds int64, now time.Time) (*sts.Credentials, error) {
+	if err, ok := f.Failures[roleArn]; ok {
+		return nil, err
+	}
+	if durationSeconds == 0 {
+		durationSeconds = DEFAULT_DURATION
+	}
+	if max, ok := f.MaxDurations[roleArn]; ok && durationSeconds > max {
+		return nil, awserr.New("ValidationError", "The requested DurationSeconds exceeds the MaxSessionDuration set for this role.", nil)
+	}
+
+	sum := sha256.Sum256([]byte(roleArn + "\n" + session))
+	accessKeyId := "ASIA" + strings.ToUpper(hex.EncodeToString(sum[:8]))
+	secretAccessKey := base64.StdEncoding.EncodeToString(sum[:30])
+	sessionToken := base64.StdEncoding.EncodeToString([]byte("fakests:" + roleArn + ":" + session))
+	expiration := now.Add(time.Duration(durationSeconds) * time.Second).UTC()
+
+	f.lock.Lock()
+	f.issued[accessKeyId] = roleArn
+	f.lock.Unlock()
+
+	return &sts.Credentials{
+		AccessKeyId:     &accessKeyId,
+		SecretAccessKey: &secretAccessKey,
+		SessionToken:    &sessionToken,
+		Expiration:      &expiration,
+	}, nil
+}
+
+// Builds the assumed role user STS returns, e.g.
+// arn:aws:sts::123456789012:assumed-role/developer/user@example.com.
+func assumedRoleUser(roleArn string, sessionName string) (*sts.AssumedRoleUser, error) {
+	parts := strings.SplitN(roleArn, ":", 6)
+	if len(parts) < 6 || !strings.HasPrefix(parts[5], "role/") {
+		return nil, awserr.New("ValidationError", fmt.Sprintf("%s is not a role ARN", roleArn), nil)
+	}
+	roleName := parts[5][strings.LastIndex(parts[5], "/")+1:]
+	arn := fmt.Sprintf("arn:%s:sts::%s:assumed-role/%s/%s", parts[1], parts[4], roleName, sessionName)
+	id := "AROA" + strings.ToUpper(hex.EncodeToString([]byte(roleName)))
+	if len(id) > 21 {
+		id = id[:21]
+	}
+	id += ":" + sessionName
+	return &sts.AssumedRoleUser{Arn: &arn, AssumedRoleId: &id}, nil
+}
+
+// Decodes a base64 SAMLResponse and returns its assertion, decrypted with
+// DecryptionKey if needed.
+func (f *FakeSTS) decodeAssertion(samlAssertion string) (*crewjam.Assertion, error) {
+	raw, err := base64.StdEncoding.DecodeString(samlAssertion)
+	if err != nil {
+		return nil, fmt.Errorf("SAMLAssertion is not valid base64: %w", err)
+	}
+	var response crewjam.Response
+	err = xml.Unmarshal(raw, &response)
+	if err != nil {
+		return nil, fmt.Errorf("SAMLAssertion is not a SAML response: %w", err)
+	}
+	if response.Assertion != nil {
+		return response.Assertion, nil
+	}
+	if response.EncryptedAssertion == nil {
+		return nil, fmt.Errorf("SAMLAssertion has no assertion")
+	}
+	if f.DecryptionKey == nil {
+		return nil, fmt.Errorf("SAMLAssertion is encrypted but the provider has no private key")
+	}
+	return f.decryptAssertion(raw)
+}
+
+// Decrypts the EncryptedAssertion of a response, like crewjam's ServiceProvider.
+func (f *FakeSTS) decryptAssertion(raw []byte) (*crewjam.Assertion, error) {
+	doc := etree.NewDocument()
+	err := doc.ReadFromBytes(raw)
+	if err != nil {
+		return nil, err
+	}
+	encryptedEl := doc.FindElement("//EncryptedAssertion")
+	if encryptedEl == nil {
+		return nil, fmt.Errorf("SAMLAssertion has no EncryptedAssertion")
+	}
+	dataEl := encryptedEl.FindElement("./EncryptedData")
+	if dataEl == nil {
+		return nil, fmt.Errorf("EncryptedAssertion has no EncryptedData")
+	}
+
+	var key interface{} = f.DecryptionKey
+	keyEl := encryptedEl.FindElement("./EncryptedKey")
+	if keyEl != nil {
+		key, err = xmlenc.Decrypt(f.DecryptionKey, keyEl)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt the assertion key: %w", err)
+		}
+	}
+	plaintext, err := xmlenc.Decrypt(key, dataEl)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt the assertion: %w", err)
+	}
+
+	var assertion crewjam.Assertion
+	err = xml.Unmarshal(plaintext, &assertion)
+	if err != nil {
+		return nil, err
+	}
+	return &assertion, nil
+}
+
+func grantsRole(assertion *crewjam.Assertion, roleArn string, principalArn string) bool {
+	for _, statement := range assertion.AttributeStatements {
+		for _, attribute := range statement.Attributes {
+			if attribute.Name != saml.ROLE_ATTRIBUTE {
+				continue
+			}
+			for _, value := range attribute.Values {
+				if value.Value == roleArn+","+principalArn {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
@@ -4,16 +4,20 @@ go 1.20
 
 require (
 	github.com/aws/aws-sdk-go v1.44.317
+	github.com/beevik/etree v1.1.0
 	github.com/crewjam/saml v0.4.13
 	github.com/gin-gonic/gin v1.9.1
+	github.com/godbus/dbus/v5 v5.1.0
 	github.com/playwright-community/playwright-go v0.4001.0
+	github.com/russellhaering/goxmldsig v1.2.0
 	github.com/spf13/cobra v1.7.0
 	go.uber.org/zap v1.25.0
+	golang.org/x/crypto v0.14.0
+	golang.org/x/term v0.13.0
 	gopkg.in/ini.v1 v1.67.0
 )
 
 require (
-	github.com/beevik/etree v1.1.0 // indirect
 	github.com/bytedance/sonic v1.9.1 // indirect
 	github.com/chenzhuoyu/base64x v0.0.0-20221115062448-fe3a3abad311 // indirect
 	github.com/crewjam/httperr v0.2.0 // indirect
@@ -39,13 +43,11 @@ require (
 	github.com/modern-go/reflect2 v1.0.2 // indirect
 	github.com/pelletier/go-toml/v2 v2.0.8 // indirect
 	github.com/pkg/errors v0.9.1 // indirect
-	github.com/russellhaering/goxmldsig v1.2.0 // indirect
 	github.com/spf13/pflag v1.0.5 // indirect
 	github.com/twitchyliquid64/golang-asm v0.15.1 // indirect
 	github.com/ugorji/go/codec v1.2.11 // indirect
 	go.uber.org/multierr v1.11.0 // indirect
 	golang.org/x/arch v0.3.0 // indirect
-	golang.org/x/crypto v0.14.0 // indirect
 	golang.org/x/net v0.17.0 // indirect
 	golang.org/x/sys v0.13.0 // indirect
 	golang.org/x/text v0.13.0 // indirect
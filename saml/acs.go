@@ -0,0 +1,166 @@
+package saml
+
+import (
+	"aws-llama/config"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/beevik/etree"
+	"github.com/crewjam/saml"
+)
+
+// How long the IdP has to answer an AuthnRequest, which includes the user
+// signing in and going through MFA.
+const AUTHN_REQUEST_TTL = 15 * time.Minute
+
+// How many unanswered AuthnRequests are kept; the oldest are dropped beyond
+// that, so that reloading /login can't grow the tracker without bounds.
+const MAX_OUTSTANDING_REQUESTS = 100
+
+type outstandingRequest struct {
+	accountKey string
+	expires    time.Time
+}
+
+// The AuthnRequests sent and not answered yet, and the assertions accepted, so
+// that only responses to our own requests are accepted, and each only once.
+type requestTracker struct {
+	lock       sync.Mutex
+	requests   map[string]outstandingRequest
+	assertions map[string]time.Time
+}
+
+var authnRequests = requestTracker{
+	requests:   make(map[string]outstandingRequest),
+	assertions: make(map[string]time.Time),
+}
+
+func (r *requestTracker) track(requestID string, accountKey string, now time.Time) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.prune(now)
+	for len(r.requests) >= MAX_OUTSTANDING_REQUESTS {
+		r.evictOldest()
+	}
+	r.requests[requestID] = outstandingRequest{accountKey: accountKey, expires: now.Add(AUTHN_REQUEST_TTL)}
+}
+
+// Drops the request that expires first, i.e. the one sent first.
+func (r *requestTracker) evictOldest() {
+	oldestID := ""
+	var oldest time.Time
+	for id, request := range r.requests {
+		if oldestID == "" || request.expires.Before(oldest) {
+			oldestID, oldest = id, request.expires
+		}
+	}
+	delete(r.requests, oldestID)
+}
+
+// The IDs of the unexpired requests sent for accountKey.
+func (r *requestTracker) outstanding(accountKey string, now time.Time) []string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.prune(now)
+	ids := make([]string, 0)
+	for id, request := range r.requests {
+		if request.accountKey == accountKey {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// Marks the request answered by an assertion, which is remembered until it
+// expires. Fails if either was used already, e.g. by a replayed response.
+func (r *requestTracker) accept(requestID string, accountKey string, assertionID string, assertionExpires time.Time, now time.Time) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.prune(now)
+	if _, ok := r.assertions[assertionID]; ok {
+		return fmt.Errorf("assertion %s was already used", assertionID)
+	}
+	request, ok := r.requests[requestID]
+	if !ok || request.accountKey != accountKey {
+		return fmt.Errorf("AuthnRequest %s isn't outstanding for this account", requestID)
+	}
+
+	delete(r.requests, requestID)
+	r.assertions[assertionID] = assertionExpires
+	return nil
+}
+
+func (r *requestTracker) prune(now time.Time) {
+	for id, request := range r.requests {
+		if now.After(request.expires) {
+			delete(r.requests, id)
+		}
+	}
+	for id, expires := range r.assertions {
+		if now.After(expires) {
+			delete(r.assertions, id)
+		}
+	}
+}
+
+// Checks that a parsed response answers an outstanding request of account, and
+// that its assertion wasn't accepted before.
+func acceptResponse(account *config.Account, rawResponse []byte, assertion *saml.Assertion) error {
+	doc := etree.NewDocument()
+	err := doc.ReadFromBytes(rawResponse)
+	if err != nil || doc.Root() == nil {
+		return fmt.Errorf("failed to read the SAML response: %v", err)
+	}
+	requestID := doc.Root().SelectAttrValue("InResponseTo", "")
+
+	now := time.Now()
+	expires := now.Add(AUTHN_REQUEST_TTL)
+	if assertion.Conditions != nil && !assertion.Conditions.NotOnOrAfter.IsZero() {
+		expires = assertion.Conditions.NotOnOrAfter
+	}
+	return authnRequests.accept(requestID, account.Key(), assertion.ID, expires, now)
+}
+
+// Checks the Origin header of a POST to the ACS: browsers set it to the origin
+// of the IdP page that posts the response. Without an Origin (non-browser
+// clients) or with "null" (set by browsers under strict referrer policies), the
+// request tracking of ParseResponse is what keeps foreign responses out.
+func CheckOrigin(account *config.Account, origin string) error {
+	if origin == "" || origin == "null" {
+		return nil
+	}
+
+	allowed := make([]string, 0, len(account.AllowedOrigins)+2)
+	allowed = append(allowed, account.AllowedOrigins...)
+	middleware, err := MiddlewareForAccount(account)
+	if err != nil {
+		return err
+	}
+	for _, descriptor := range middleware.ServiceProvider.IDPMetadata.IDPSSODescriptors {
+		for _, service := range descriptor.SingleSignOnServices {
+			allowed = append(allowed, originOf(service.Location))
+		}
+	}
+
+	for _, candidate := range allowed {
+		if candidate != "" && candidate == originOf(origin) {
+			return nil
+		}
+	}
+	return fmt.Errorf("origin %s isn't an SSO endpoint of %s or in its allowed_origins", origin, account.Name())
+}
+
+// The scheme://host[:port] of rawURL, or "" if it doesn't parse.
+func originOf(rawURL string) string {
+	parsed, err := url.Parse(rawURL)
+	if err != nil || parsed.Scheme == "" || parsed.Host == "" {
+		return ""
+	}
+	return strings.ToLower(parsed.Scheme + "://" + parsed.Host)
+}
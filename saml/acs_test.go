@@ -0,0 +1,77 @@
+package saml
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestRequestTrackerAcceptsEachResponseOnce(t *testing.T) {
+	tracker := requestTracker{
+		requests:   make(map[string]outstandingRequest),
+		assertions: make(map[string]time.Time),
+	}
+	now := time.Now()
+	tracker.track("id-1", "account", now)
+	tracker.track("id-2", "account", now)
+	tracker.track("id-3", "other", now)
+
+	if ids := tracker.outstanding("account", now); len(ids) != 2 {
+		t.Errorf("expected 2 outstanding requests, got %v", ids)
+	}
+	if err := tracker.accept("id-3", "account", "assertion-1", now.Add(time.Hour), now); err == nil {
+		t.Errorf("expected a request of another account to be rejected")
+	}
+	if err := tracker.accept("id-1", "account", "assertion-1", now.Add(time.Hour), now); err != nil {
+		t.Fatal(err)
+	}
+	if err := tracker.accept("id-1", "account", "assertion-2", now.Add(time.Hour), now); err == nil {
+		t.Errorf("expected an answered request to be rejected")
+	}
+	if err := tracker.accept("id-2", "account", "assertion-1", now.Add(time.Hour), now); err == nil {
+		t.Errorf("expected a used assertion to be rejected")
+	}
+
+	later := now.Add(AUTHN_REQUEST_TTL + time.Minute)
+	if ids := tracker.outstanding("account", later); len(ids) != 0 {
+		t.Errorf("expected expired requests to be dropped, got %v", ids)
+	}
+}
+
+func TestRequestTrackerEvictsOldestRequests(t *testing.T) {
+	tracker := requestTracker{
+		requests:   make(map[string]outstandingRequest),
+		assertions: make(map[string]time.Time),
+	}
+	now := time.Now()
+	for i := 0; i < MAX_OUTSTANDING_REQUESTS+10; i++ {
+		tracker.track(fmt.Sprintf("id-%d", i), "account", now.Add(time.Duration(i)*time.Millisecond))
+	}
+
+	ids := tracker.outstanding("account", now)
+	if len(ids) != MAX_OUTSTANDING_REQUESTS {
+		t.Fatalf("expected %d outstanding requests, got %d", MAX_OUTSTANDING_REQUESTS, len(ids))
+	}
+	for _, id := range []string{"id-0", "id-9"} {
+		if _, ok := tracker.requests[id]; ok {
+			t.Errorf("expected %s to be evicted", id)
+		}
+	}
+	last := fmt.Sprintf("id-%d", MAX_OUTSTANDING_REQUESTS+9)
+	if err := tracker.accept(last, "account", "assertion-1", now.Add(time.Hour), now); err != nil {
+		t.Errorf("expected the latest request to be kept: %s", err)
+	}
+}
+
+func TestOriginOf(t *testing.T) {
+	cases := map[string]string{
+		"https://IdP.example.com/app/sso?x=1": "https://idp.example.com",
+		"http://localhost:8080/sso":           "http://localhost:8080",
+		"not a url":                           "",
+	}
+	for rawURL, expected := range cases {
+		if origin := originOf(rawURL); origin != expected {
+			t.Errorf("originOf(%q) = %q, expected %q", rawURL, origin, expected)
+		}
+	}
+}
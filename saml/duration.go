@@ -0,0 +1,144 @@
+package saml
+
+import (
+	"aws-llama/config"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/crewjam/saml"
+)
+
+const SESSION_DURATION_ATTRIBUTE = "https://aws.amazon.com/SAML/Attributes/SessionDuration"
+
+// Limits STS puts on DurationSeconds, regardless of the role.
+const MIN_SESSION_DURATION = 900
+const MAX_SESSION_DURATION = 43200
+
+// Every role allows at least an hour, so this always works as the last fallback.
+const DEFAULT_SESSION_DURATION = 3600
+
+// Durations tried, in order, when STS rejects a duration as too long for the role.
+var fallbackDurations = []int64{43200, 36000, 28800, 21600, 14400, 7200, DEFAULT_SESSION_DURATION}
+
+// How long a duration STS rejected isn't retried for, so that raising the
+// MaxSessionDuration of a role takes effect without a restart.
+const ROLE_MAX_DURATION_TTL = 24 * time.Hour
+
+type roleMaxDuration struct {
+	duration int64
+	expires  time.Time
+}
+
+// Longest duration not (yet) rejected per role ARN, so durations STS rejected
+// aren't retried on every refresh.
+var roleMaxDurations = make(map[string]roleMaxDuration)
+var roleMaxDurationsLock sync.Mutex
+
+// Returns the SessionDuration attribute of the assertion in seconds, or 0.
+func ExtractSessionDurationFromAssertion(assertion *saml.Assertion) int64 {
+	for _, statement := range assertion.AttributeStatements {
+		for _, attribute := range statement.Attributes {
+			if attribute.Name != SESSION_DURATION_ATTRIBUTE || len(attribute.Values) == 0 {
+				continue
+			}
+			duration, err := strconv.ParseInt(strings.TrimSpace(attribute.Values[0].Value), 10, 64)
+			if err == nil {
+				return duration
+			}
+		}
+	}
+	return 0
+}
+
+// Picks the session duration to request: the account's session_duration if set,
+// otherwise the one from the assertion, clamped to what STS accepts. 0 means
+// none was asked for, leaving the STS default of one hour.
+func SessionDuration(configured int64, assertion *saml.Assertion) int64 {
+	duration := configured
+	if duration == 0 {
+		duration = ExtractSessionDurationFromAssertion(assertion)
+	}
+	if duration == 0 {
+		return 0
+	}
+
+	if duration < MIN_SESSION_DURATION {
+		return MIN_SESSION_DURATION
+	}
+	if duration > MAX_SESSION_DURATION {
+		return MAX_SESSION_DURATION
+	}
+	return duration
+}
+
+func isDurationTooLongError(err error) bool {
+	awsErr, ok := err.(awserr.Error)
+	if !ok || awsErr.Code() != "ValidationError" {
+		return false
+	}
+	return strings.Contains(awsErr.Message(), "DurationSeconds") || strings.Contains(awsErr.Message(), "MaxSessionDuration")
+}
+
+// Clamps the duration to the longest one known to work for the role.
+func clampToRoleMax(roleArn string, duration int64, now time.Time) int64 {
+	roleMaxDurationsLock.Lock()
+	defer roleMaxDurationsLock.Unlock()
+
+	max, ok := roleMaxDurations[roleArn]
+	if ok && now.After(max.expires) {
+		delete(roleMaxDurations, roleArn)
+		return duration
+	}
+	if ok && duration > max.duration {
+		return max.duration
+	}
+	return duration
+}
+
+func rememberRoleMax(roleArn string, duration int64, now time.Time) {
+	roleMaxDurationsLock.Lock()
+	defer roleMaxDurationsLock.Unlock()
+
+	roleMaxDurations[roleArn] = roleMaxDuration{duration: duration, expires: now.Add(ROLE_MAX_DURATION_TTL)}
+}
+
+// Assumes the role through STS for durationSeconds (0 for the STS default),
+// automatically retrying with a shorter duration if the role doesn't allow that long.
+func AssumeRoleWithSAML(account *config.Account, principalArn string, roleArn string, samlAssertion string, durationSeconds int64) (*sts.AssumeRoleWithSAMLOutput, error) {
+	return assumeWithDurationFallback(roleArn, durationSeconds, func(durationSeconds int64) (*sts.AssumeRoleWithSAMLOutput, error) {
+		return STS.AssumeRoleWithSAML(account, principalArn, roleArn, samlAssertion, durationSeconds)
+	})
+}
+
+// Calls assume with durationSeconds, falling back to shorter durations while STS
+// rejects them as exceeding the role's MaxSessionDuration.
+func assumeWithDurationFallback(roleArn string, durationSeconds int64, assume func(durationSeconds int64) (*sts.AssumeRoleWithSAMLOutput, error)) (*sts.AssumeRoleWithSAMLOutput, error) {
+	if durationSeconds == 0 {
+		return assume(0)
+	}
+
+	duration := clampToRoleMax(roleArn, durationSeconds, time.Now())
+	for {
+		output, err := assume(duration)
+		if err == nil || !isDurationTooLongError(err) {
+			return output, err
+		}
+
+		next := int64(0)
+		for _, fallback := range fallbackDurations {
+			if fallback < duration {
+				next = fallback
+				break
+			}
+		}
+		if next == 0 {
+			return nil, err
+		}
+		duration = next
+		rememberRoleMax(roleArn, duration, time.Now())
+	}
+}
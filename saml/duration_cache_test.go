@@ -0,0 +1,27 @@
+package saml
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRoleMaxDurationExpires(t *testing.T) {
+	roleArn := "arn:aws:iam::123456789012:role/cache-test"
+	now := time.Now()
+	rememberRoleMax(roleArn, 7200, now)
+	t.Cleanup(func() {
+		roleMaxDurationsLock.Lock()
+		delete(roleMaxDurations, roleArn)
+		roleMaxDurationsLock.Unlock()
+	})
+
+	if duration := clampToRoleMax(roleArn, 43200, now.Add(time.Hour)); duration != 7200 {
+		t.Errorf("expected the remembered maximum of 7200, got %d", duration)
+	}
+	if duration := clampToRoleMax(roleArn, 3600, now.Add(time.Hour)); duration != 3600 {
+		t.Errorf("expected a shorter duration to be kept, got %d", duration)
+	}
+	if duration := clampToRoleMax(roleArn, 43200, now.Add(ROLE_MAX_DURATION_TTL+time.Second)); duration != 43200 {
+		t.Errorf("expected the maximum to expire, got %d", duration)
+	}
+}
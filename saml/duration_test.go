@@ -0,0 +1,168 @@
+// An external test package, since fakests depends on saml.
+package saml_test
+
+import (
+	"aws-llama/config"
+	"aws-llama/fakests"
+	"aws-llama/saml"
+	"encoding/base64"
+	"encoding/xml"
+	"reflect"
+	"testing"
+	"time"
+
+	crewjam "github.com/crewjam/saml"
+)
+
+const PROVIDER_ARN = "arn:aws:iam::123456789012:saml-provider/llama"
+
+// Builds an assertion granting roleArn, with a SessionDuration attribute unless
+// sessionDuration is empty.
+func assertionFor(roleArn string, sessionDuration string) *crewjam.Assertion {
+	attributes := []crewjam.Attribute{{
+		Name:   saml.ROLE_ATTRIBUTE,
+		Values: []crewjam.AttributeValue{{Value: roleArn + "," + PROVIDER_ARN}},
+	}}
+	if sessionDuration != "" {
+		attributes = append(attributes, crewjam.Attribute{
+			Name:   saml.SESSION_DURATION_ATTRIBUTE,
+			Values: []crewjam.AttributeValue{{Value: sessionDuration}},
+		})
+	}
+	return &crewjam.Assertion{
+		ID:                  "assertion-" + roleArn,
+		AttributeStatements: []crewjam.AttributeStatement{{Attributes: attributes}},
+	}
+}
+
+// Encodes assertion as the base64 SAMLResponse STS expects.
+func encodeResponse(t *testing.T, assertion *crewjam.Assertion) string {
+	raw, err := xml.Marshal(crewjam.Response{Assertion: assertion})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.StdEncoding.EncodeToString(raw)
+}
+
+func setupFakeSTS(t *testing.T) *fakests.FakeSTS {
+	fake := fakests.New()
+	previousSTS := saml.STS
+	saml.STS = fake
+	t.Cleanup(func() { saml.STS = previousSTS })
+	return fake
+}
+
+// The DurationSeconds of every call made to fake.
+func requestedDurations(fake *fakests.FakeSTS) []int64 {
+	var durations []int64
+	for _, call := range fake.Calls() {
+		durations = append(durations, call.DurationSeconds)
+	}
+	return durations
+}
+
+func TestSessionDuration(t *testing.T) {
+	cases := []struct {
+		name       string
+		configured int64
+		attribute  string
+		expected   int64
+	}{
+		{"none", 0, "", 0},
+		{"attribute", 0, "28800", 28800},
+		{"attribute with whitespace", 0, " 7200 ", 7200},
+		{"invalid attribute", 0, "8h", 0},
+		{"configured wins over the attribute", 7200, "28800", 7200},
+		{"configured without attribute", 14400, "", 14400},
+		{"clamped to the minimum", 60, "", saml.MIN_SESSION_DURATION},
+		{"clamped to the maximum", 0, "86400", saml.MAX_SESSION_DURATION},
+	}
+	for _, c := range cases {
+		duration := saml.SessionDuration(c.configured, assertionFor("arn:aws:iam::123456789012:role/developer", c.attribute))
+		if duration != c.expected {
+			t.Errorf("%s: expected %d, got %d", c.name, c.expected, duration)
+		}
+	}
+}
+
+func TestAssumeRoleWithSAMLFallsBackToShorterDurations(t *testing.T) {
+	fake := setupFakeSTS(t)
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	fake.Now = func() time.Time { return now }
+	roleArn := "arn:aws:iam::123456789012:role/fallback"
+	fake.MaxDurations[roleArn] = 7200
+
+	assertion := assertionFor(roleArn, "43200")
+	duration := saml.SessionDuration(0, assertion)
+	output, err := saml.AssumeRoleWithSAML(nil, PROVIDER_ARN, roleArn, encodeResponse(t, assertion), duration)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !output.Credentials.Expiration.Equal(now.Add(2 * time.Hour)) {
+		t.Errorf("expected credentials for the role's maximum of 2 hours, got expiration %s", output.Credentials.Expiration)
+	}
+	expected := []int64{43200, 36000, 28800, 21600, 14400, 7200}
+	if durations := requestedDurations(fake); !reflect.DeepEqual(durations, expected) {
+		t.Errorf("expected durations %v, got %v", expected, durations)
+	}
+
+	// The next login starts at the duration that worked.
+	_, err = saml.AssumeRoleWithSAML(nil, PROVIDER_ARN, roleArn, encodeResponse(t, assertion), duration)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = append(expected, 7200)
+	if durations := requestedDurations(fake); !reflect.DeepEqual(durations, expected) {
+		t.Errorf("expected durations %v, got %v", expected, durations)
+	}
+}
+
+func TestAssumeRoleWithSAMLConfiguredDurationFallsBack(t *testing.T) {
+	fake := setupFakeSTS(t)
+	roleArn := "arn:aws:iam::123456789012:role/configured"
+	fake.MaxDurations[roleArn] = saml.DEFAULT_SESSION_DURATION
+
+	// session_duration takes precedence over the attribute, and still falls back
+	// when the role allows less.
+	account := &config.Account{SessionDuration: 10000}
+	assertion := assertionFor(roleArn, "43200")
+	duration := saml.SessionDuration(account.SessionDuration, assertion)
+	_, err := saml.AssumeRoleWithSAML(account, PROVIDER_ARN, roleArn, encodeResponse(t, assertion), duration)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []int64{10000, 7200, 3600}
+	if durations := requestedDurations(fake); !reflect.DeepEqual(durations, expected) {
+		t.Errorf("expected durations %v, got %v", expected, durations)
+	}
+}
+
+func TestAssumeRoleWithSAMLWithoutDuration(t *testing.T) {
+	fake := setupFakeSTS(t)
+	roleArn := "arn:aws:iam::123456789012:role/default"
+	fake.MaxDurations[roleArn] = saml.DEFAULT_SESSION_DURATION
+
+	assertion := assertionFor(roleArn, "")
+	_, err := saml.AssumeRoleWithSAML(nil, PROVIDER_ARN, roleArn, encodeResponse(t, assertion), saml.SessionDuration(0, assertion))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if durations := requestedDurations(fake); !reflect.DeepEqual(durations, []int64{0}) {
+		t.Errorf("expected a single call leaving the STS default, got %v", durations)
+	}
+}
+
+func TestAssumeRoleWithSAMLReturnsOtherErrors(t *testing.T) {
+	fake := setupFakeSTS(t)
+	roleArn := "arn:aws:iam::123456789012:role/denied"
+
+	// The assertion grants a different role.
+	assertion := assertionFor("arn:aws:iam::123456789012:role/other", "43200")
+	_, err := saml.AssumeRoleWithSAML(nil, PROVIDER_ARN, roleArn, encodeResponse(t, assertion), 43200)
+	if err == nil {
+		t.Fatal("expected the role to be denied")
+	}
+	if durations := requestedDurations(fake); len(durations) != 1 {
+		t.Errorf("expected no retries for errors other than the duration, got %v", durations)
+	}
+}
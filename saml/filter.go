@@ -0,0 +1,60 @@
+package saml
+
+import (
+	"aws-llama/config"
+	"fmt"
+	"path"
+	"strings"
+)
+
+// Whether a role from the assertion is assumed, and why.
+type RoleDecision struct {
+	RoleARN     string
+	ProviderARN string
+	AccountId   string
+	RoleName    string
+	Included    bool
+	Reason      string
+}
+
+// Splits an IAM role ARN (arn:aws:iam::123456789012:role/path/name) into its
+// account ID and role name.
+func SplitRoleARN(roleARN string) (accountId string, roleName string, err error) {
+	parts := strings.SplitN(roleARN, ":", 6)
+	if len(parts) != 6 || !strings.HasPrefix(parts[5], "role/") {
+		return "", "", fmt.Errorf("malformed role ARN: %s", roleARN)
+	}
+	return parts[4], path.Base(parts[5]), nil
+}
+
+// Applies the account's role filter: a role is assumed if it matches any include
+// criterion (or there are none) and no exclude criterion.
+func FilterRolePairs(pairs []*RolePair, filter config.RoleFilter) []RoleDecision {
+	decisions := make([]RoleDecision, 0, len(pairs))
+	for _, pair := range pairs {
+		decision := RoleDecision{RoleARN: pair.RoleARN, ProviderARN: pair.ProviderARN}
+		accountId, roleName, err := SplitRoleARN(pair.RoleARN)
+		if err != nil {
+			decision.Reason = err.Error()
+			decisions = append(decisions, decision)
+			continue
+		}
+		decision.AccountId = accountId
+		decision.RoleName = roleName
+
+		decision.Included, decision.Reason = filter.Decide(pair.RoleARN, accountId, roleName)
+		decisions = append(decisions, decision)
+	}
+	return decisions
+}
+
+// Returns the pairs of the included decisions.
+func IncludedPairs(decisions []RoleDecision) []*RolePair {
+	pairs := make([]*RolePair, 0, len(decisions))
+	for _, decision := range decisions {
+		if decision.Included {
+			pairs = append(pairs, &RolePair{RoleARN: decision.RoleARN, ProviderARN: decision.ProviderARN})
+		}
+	}
+	return pairs
+}
@@ -0,0 +1,124 @@
+package saml
+
+import (
+	"aws-llama/config"
+	"testing"
+)
+
+func TestFilterRolePairs(t *testing.T) {
+	const provider = "arn:aws:iam::123456789012:saml-provider/llama"
+	developer := "arn:aws:iam::123456789012:role/developer"
+	readonly := "arn:aws:iam::123456789012:role/billing-readonly"
+	legacy := "arn:aws:iam::123456789012:role/legacy/admin"
+	sandbox := "arn:aws:iam::210987654321:role/developer"
+	roles := []string{developer, readonly, legacy, sandbox}
+
+	cases := []struct {
+		name     string
+		filter   config.RoleFilter
+		included []string
+	}{
+		{
+			name:     "no filter",
+			included: roles,
+		},
+		{
+			name:     "name globs",
+			filter:   config.RoleFilter{Include: config.RoleMatcher{Names: []string{"*-readonly", "adm?n"}}},
+			included: []string{readonly, legacy},
+		},
+		{
+			name:     "patterns match the whole ARN",
+			filter:   config.RoleFilter{Include: config.RoleMatcher{Patterns: []string{`^arn:aws:iam::210987654321:`}}},
+			included: []string{sandbox},
+		},
+		{
+			name:     "accounts",
+			filter:   config.RoleFilter{Include: config.RoleMatcher{Accounts: []string{"123456789012"}}},
+			included: []string{developer, readonly, legacy},
+		},
+		{
+			name:     "arns",
+			filter:   config.RoleFilter{Include: config.RoleMatcher{ARNs: []string{sandbox}}},
+			included: []string{sandbox},
+		},
+		{
+			name:     "any include criterion",
+			filter:   config.RoleFilter{Include: config.RoleMatcher{Names: []string{"*-readonly"}, Accounts: []string{"210987654321"}}},
+			included: []string{readonly, sandbox},
+		},
+		{
+			name:     "exclude only",
+			filter:   config.RoleFilter{Exclude: config.RoleMatcher{Patterns: []string{`:role/legacy/`}}},
+			included: []string{developer, readonly, sandbox},
+		},
+		{
+			name: "exclude wins over include",
+			filter: config.RoleFilter{
+				Include: config.RoleMatcher{Accounts: []string{"123456789012"}},
+				Exclude: config.RoleMatcher{Names: []string{"developer"}, ARNs: []string{legacy}},
+			},
+			included: []string{readonly},
+		},
+		{
+			name: "exclude the same role as included",
+			filter: config.RoleFilter{
+				Include: config.RoleMatcher{ARNs: []string{developer}},
+				Exclude: config.RoleMatcher{ARNs: []string{developer}},
+			},
+			included: []string{},
+		},
+	}
+	for _, c := range cases {
+		pairs := make([]*RolePair, 0, len(roles))
+		for _, role := range roles {
+			pairs = append(pairs, &RolePair{RoleARN: role, ProviderARN: provider})
+		}
+
+		decisions := FilterRolePairs(pairs, c.filter)
+		included := IncludedPairs(decisions)
+		if len(included) != len(c.included) {
+			t.Errorf("%s: expected %v to be included, got %+v", c.name, c.included, decisions)
+			continue
+		}
+		for idx, pair := range included {
+			if pair.RoleARN != c.included[idx] || pair.ProviderARN != provider {
+				t.Errorf("%s: expected %v to be included, got %+v", c.name, c.included, decisions)
+				break
+			}
+		}
+		for _, decision := range decisions {
+			if decision.Reason == "" {
+				t.Errorf("%s: no reason given for %s", c.name, decision.RoleARN)
+			}
+		}
+	}
+}
+
+func TestFilterRolePairsReasons(t *testing.T) {
+	filter := config.RoleFilter{
+		Include: config.RoleMatcher{Names: []string{"dev*"}},
+		Exclude: config.RoleMatcher{Accounts: []string{"210987654321"}},
+	}
+	pairs := []*RolePair{
+		{RoleARN: "arn:aws:iam::123456789012:role/developer"},
+		{RoleARN: "arn:aws:iam::210987654321:role/developer"},
+		{RoleARN: "arn:aws:iam::123456789012:role/admin"},
+		{RoleARN: "not-an-arn"},
+	}
+	expected := []struct {
+		included bool
+		reason   string
+	}{
+		{true, "included by name dev*"},
+		{false, "excluded by account 210987654321"},
+		{false, "not matched by the include filter"},
+		{false, "malformed role ARN: not-an-arn"},
+	}
+	for idx, decision := range FilterRolePairs(pairs, filter) {
+		if decision.Included != expected[idx].included || decision.Reason != expected[idx].reason {
+			t.Errorf("%s: expected included=%v (%s), got included=%v (%s)",
+				decision.RoleARN, expected[idx].included, expected[idx].reason, decision.Included, decision.Reason)
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package saml
+
+import (
+	"aws-llama/config"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const SP_CERTIFICATE_NAME = "aws-llama"
+
+// Generates an RSA key and a self-signed certificate for it, valid for 10 years.
+func GenerateKeyPair(commonName string) (*rsa.PrivateKey, *x509.Certificate, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, err
+	}
+	template := x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().AddDate(10, 0, 0),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, nil, err
+	}
+	return key, cert, nil
+}
+
+// Loads a PEM RSA key (PKCS #1 or PKCS #8) and certificate.
+func LoadKeyPair(keyPath string, certPath string) (*rsa.PrivateKey, *x509.Certificate, error) {
+	keyPEM, err := os.ReadFile(keyPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	certPEM, err := os.ReadFile(certPath)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	keyBlock, _ := pem.Decode(keyPEM)
+	if keyBlock == nil {
+		return nil, nil, fmt.Errorf("no PEM data in %s", keyPath)
+	}
+	var key *rsa.PrivateKey
+	switch keyBlock.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(keyBlock.Bytes)
+	case "PRIVATE KEY":
+		var parsed any
+		parsed, err = x509.ParsePKCS8PrivateKey(keyBlock.Bytes)
+		if err == nil {
+			var ok bool
+			key, ok = parsed.(*rsa.PrivateKey)
+			if !ok {
+				err = fmt.Errorf("not an RSA key")
+			}
+		}
+	default:
+		err = fmt.Errorf("unsupported PEM block %q", keyBlock.Type)
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid key in %s: %w", keyPath, err)
+	}
+
+	certBlock, _ := pem.Decode(certPEM)
+	if certBlock == nil {
+		return nil, nil, fmt.Errorf("no PEM data in %s", certPath)
+	}
+	cert, err := x509.ParseCertificate(certBlock.Bytes)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid certificate in %s: %w", certPath, err)
+	}
+	if !key.PublicKey.Equal(cert.PublicKey) {
+		return nil, nil, fmt.Errorf("the certificate in %s doesn't match the key in %s", certPath, keyPath)
+	}
+	return key, cert, nil
+}
+
+// Loads the key pair at keyPath and certPath, generating it on first use.
+func LoadOrCreateKeyPair(keyPath string, certPath string, commonName string) (*rsa.PrivateKey, *x509.Certificate, error) {
+	_, err := os.Stat(keyPath)
+	if err == nil {
+		return LoadKeyPair(keyPath, certPath)
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, nil, err
+	}
+
+	key, cert, err := GenerateKeyPair(commonName)
+	if err != nil {
+		return nil, nil, err
+	}
+	err = os.MkdirAll(filepath.Dir(keyPath), 0700)
+	if err != nil {
+		return nil, nil, err
+	}
+	// Write the certificate first: a key without one is loaded (and fails) next time.
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+	err = os.WriteFile(certPath, certPEM, 0644)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	err = os.WriteFile(keyPath, keyPEM, 0600)
+	if err != nil {
+		return nil, nil, err
+	}
+	return key, cert, nil
+}
+
+// Returns the SP key pair: sp_key_file and sp_cert_file when configured,
+// otherwise ~/.aws-llama-sp-key.pem and ~/.aws-llama-sp-cert.pem, generated on
+// first use.
+func ServiceProviderKeyPair() (*rsa.PrivateKey, *x509.Certificate, error) {
+	current := config.Current()
+	if current.SPKeyFile != "" {
+		return LoadKeyPair(current.SPKeyFile, current.SPCertFile)
+	}
+
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return nil, nil, err
+	}
+	keyPath := filepath.Join(homeDir, ".aws-llama-sp-key.pem")
+	certPath := filepath.Join(homeDir, ".aws-llama-sp-cert.pem")
+	return LoadOrCreateKeyPair(keyPath, certPath, SP_CERTIFICATE_NAME)
+}
@@ -0,0 +1,50 @@
+package saml
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadOrCreateKeyPairPersistsKeys(t *testing.T) {
+	dir := t.TempDir()
+	keyPath := filepath.Join(dir, "key.pem")
+	certPath := filepath.Join(dir, "cert.pem")
+
+	key, cert, err := LoadOrCreateKeyPair(keyPath, certPath, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("key written with mode %v", info.Mode().Perm())
+	}
+
+	loadedKey, loadedCert, err := LoadOrCreateKeyPair(keyPath, certPath, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !key.Equal(loadedKey) || !cert.Equal(loadedCert) {
+		t.Errorf("the key pair changed when loaded again")
+	}
+}
+
+func TestLoadKeyPairRejectsMismatchedCertificate(t *testing.T) {
+	dir := t.TempDir()
+	_, _, err := LoadOrCreateKeyPair(filepath.Join(dir, "a-key.pem"), filepath.Join(dir, "a-cert.pem"), "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = LoadOrCreateKeyPair(filepath.Join(dir, "b-key.pem"), filepath.Join(dir, "b-cert.pem"), "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, _, err = LoadKeyPair(filepath.Join(dir, "a-key.pem"), filepath.Join(dir, "b-cert.pem"))
+	if err == nil {
+		t.Errorf("expected a mismatched key pair to be rejected")
+	}
+}
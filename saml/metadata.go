@@ -0,0 +1,547 @@
+package saml
+
+import (
+	"aws-llama/atomicfile"
+	"aws-llama/config"
+	"aws-llama/log"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/beevik/etree"
+	"github.com/crewjam/saml"
+	"github.com/crewjam/saml/samlsp"
+	dsig "github.com/russellhaering/goxmldsig"
+)
+
+// How long IdP metadata is used when it sets neither validUntil nor cacheDuration.
+const DEFAULT_METADATA_TTL = 24 * time.Hour
+
+// Lower bound for how long metadata is used, so that a tiny cacheDuration (or
+// an expired validUntil) doesn't refetch it for every login.
+const MIN_METADATA_TTL = 5 * time.Minute
+
+// How often WatchMetadata runs, and how long before it expires metadata is
+// refreshed.
+const METADATA_REFRESH_INTERVAL = 15 * time.Minute
+
+// Upper bound for the size of an IdP metadata document.
+const MAX_METADATA_SIZE = 10 * 1024 * 1024
+
+// Metadata fetched from a metadata_url, as persisted in config.MetadataCacheDir.
+type metadataCacheFile struct {
+	MetadataURL string
+	FetchedAt   time.Time
+	Expires     time.Time
+	Metadata    string
+}
+
+type cachedMetadata struct {
+	metadata *saml.EntityDescriptor
+	expires  time.Time
+}
+
+// Fetched metadata by metadata URL.
+type metadataCache struct {
+	lock     sync.Mutex
+	metadata map[string]*cachedMetadata
+}
+
+var fetchedMetadata = metadataCache{metadata: make(map[string]*cachedMetadata)}
+
+func (m *metadataCache) get(metadataURL string) (*cachedMetadata, bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	cached, ok := m.metadata[metadataURL]
+	return cached, ok
+}
+
+func (m *metadataCache) set(metadataURL string, cached *cachedMetadata) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.metadata[metadataURL] = cached
+}
+
+// A service provider, with what it was built from.
+type cachedMiddleware struct {
+	config     *config.Config
+	account    config.Account
+	metadata   *saml.EntityDescriptor
+	middleware *samlsp.Middleware
+}
+
+// Whether the middleware was built for the current settings of account.
+func (c *cachedMiddleware) builtFor(current *config.Config, account *config.Account) bool {
+	return c.config == current && reflect.DeepEqual(&c.account, account)
+}
+
+// Built service providers by account key.
+type middlewareCache struct {
+	lock        sync.Mutex
+	middlewares map[string]*cachedMiddleware
+}
+
+var builtMiddlewares = middlewareCache{middlewares: make(map[string]*cachedMiddleware)}
+
+func (m *middlewareCache) get(accountKey string) (*cachedMiddleware, bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	cached, ok := m.middlewares[accountKey]
+	return cached, ok
+}
+
+func (m *middlewareCache) set(accountKey string, cached *cachedMiddleware) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.middlewares[accountKey] = cached
+}
+
+// Returns the service provider for the IdP of account, built from its metadata
+// with its idp_sso_url and idp_certificate_fingerprints applied. It's built
+// again once the config is reloaded or the metadata of a metadata_url refetched.
+func MiddlewareForAccount(account *config.Account) (*samlsp.Middleware, error) {
+	current := config.Current()
+	cached, ok := builtMiddlewares.get(account.Key())
+	ok = ok && cached.builtFor(current, account)
+	if ok && account.MetadataURL == "" {
+		return cached.middleware, nil
+	}
+
+	metadata, err := accountMetadata(account)
+	if err != nil {
+		return nil, err
+	}
+	if ok && cached.metadata == metadata {
+		return cached.middleware, nil
+	}
+	return buildMiddleware(current, account, metadata)
+}
+
+// Builds the service provider of account from metadata, and caches it.
+func buildMiddleware(current *config.Config, account *config.Account, metadata *saml.EntityDescriptor) (*samlsp.Middleware, error) {
+	middleware, err := middlewareForMetadata(account, metadata)
+	if err != nil {
+		return nil, err
+	}
+	builtMiddlewares.set(account.Key(), &cachedMiddleware{
+		config:     current,
+		account:    *account,
+		metadata:   metadata,
+		middleware: middleware,
+	})
+	return middleware, nil
+}
+
+// Parses and verifies a SAML response from the IdP of account, which must
+// answer an outstanding AuthnRequest for it with an assertion not seen before.
+// When its signature doesn't verify, the IdP may have rotated its certificate
+// since the metadata was cached: the metadata is loaded again and the response
+// parsed once more.
+func ParseResponse(account *config.Account, rawResponse []byte) (*saml.Assertion, error) {
+	requestIDs := authnRequests.outstanding(account.Key(), time.Now())
+	if len(requestIDs) == 0 {
+		return nil, fmt.Errorf("no login to %s is in progress; responses are only accepted for logins started at /login", account.Name())
+	}
+
+	middleware, err := MiddlewareForAccount(account)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load the IdP metadata: %w", err)
+	}
+
+	assertion, err := middleware.ServiceProvider.ParseXMLResponse(rawResponse, requestIDs)
+	if err == nil {
+		return assertion, acceptResponse(account, rawResponse, assertion)
+	}
+	if !isSignatureError(err) {
+		return nil, describeResponseError(err)
+	}
+
+	log.Logger.Infof("SAML response for %s doesn't verify with the cached metadata, loading it again", account.Name())
+	metadata, err := reloadAccountMetadata(account)
+	if err != nil {
+		return nil, fmt.Errorf("the signature doesn't verify and reloading the IdP metadata failed: %w", err)
+	}
+	middleware, err = buildMiddleware(config.Current(), account, metadata)
+	if err != nil {
+		return nil, err
+	}
+	assertion, err = middleware.ServiceProvider.ParseXMLResponse(rawResponse, requestIDs)
+	if err != nil {
+		return nil, describeResponseError(err)
+	}
+	return assertion, acceptResponse(account, rawResponse, assertion)
+}
+
+// The SSO endpoint AuthnRequests for account are sent to.
+func SSOURL(account *config.Account) (string, error) {
+	middleware, err := MiddlewareForAccount(account)
+	if err != nil {
+		return "", err
+	}
+	_, location, err := chooseBinding(middleware, account.Binding)
+	return location, err
+}
+
+// Refetches the metadata of the configured accounts shortly before it expires,
+// so that logins don't wait for it.
+func WatchMetadata(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		refreshExpiringMetadata(time.Now().Add(interval))
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func refreshExpiringMetadata(deadline time.Time) {
+	for _, account := range config.Current().Accounts {
+		if account.MetadataURL == "" {
+			continue
+		}
+		cached, ok := fetchedMetadata.get(account.MetadataURL)
+		if ok && cached.expires.After(deadline) {
+			continue
+		}
+
+		var err error
+		if ok {
+			_, err = refreshMetadata(account.MetadataURL)
+		} else {
+			// Loads it from disk, or fetches it when that copy expired too.
+			_, err = metadataForURL(account.MetadataURL)
+		}
+		if err != nil {
+			log.Logger.Warnf("Failed to refresh the metadata of %s: %s", account.MetadataURL, err.Error())
+		}
+	}
+}
+
+func accountMetadata(account *config.Account) (*saml.EntityDescriptor, error) {
+	switch {
+	case account.MetadataURL != "":
+		return metadataForURL(account.MetadataURL)
+	case account.MetadataFile != "":
+		raw, err := os.ReadFile(account.MetadataFile)
+		if err != nil {
+			return nil, err
+		}
+		return parseMetadata(raw, account.MetadataFile)
+	default:
+		return parseMetadata([]byte(account.MetadataXML), "metadata_xml of "+account.Name())
+	}
+}
+
+// Fetches the metadata of a metadata_url again, and reads it again otherwise.
+func reloadAccountMetadata(account *config.Account) (*saml.EntityDescriptor, error) {
+	if account.MetadataURL != "" {
+		return refreshMetadata(account.MetadataURL)
+	}
+	return accountMetadata(account)
+}
+
+func parseMetadata(raw []byte, source string) (*saml.EntityDescriptor, error) {
+	metadata, err := samlsp.ParseMetadata(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid IdP metadata in %s: %w", source, err)
+	}
+	return metadata, nil
+}
+
+// Returns the metadata of metadataURL. It's fetched when neither memory nor the
+// disk cache has an unexpired copy; if fetching fails, an expired copy is used
+// rather than failing the login.
+func metadataForURL(metadataURL string) (*saml.EntityDescriptor, error) {
+	cached, ok := fetchedMetadata.get(metadataURL)
+	if !ok {
+		var err error
+		cached, err = loadCachedMetadata(metadataURL)
+		if err != nil {
+			log.Logger.Warnf("Ignoring the cached metadata of %s: %s", metadataURL, err.Error())
+		} else if cached != nil {
+			fetchedMetadata.set(metadataURL, cached)
+		}
+	}
+	if cached != nil && time.Now().Before(cached.expires) {
+		return cached.metadata, nil
+	}
+
+	metadata, err := refreshMetadata(metadataURL)
+	if err != nil {
+		if cached != nil {
+			log.Logger.Warnf("Failed to refresh the metadata of %s, using the copy that expired at %s: %s", metadataURL, cached.expires, err.Error())
+			return cached.metadata, nil
+		}
+		return nil, err
+	}
+	return metadata, nil
+}
+
+// Fetches the metadata of metadataURL and replaces the cached copy.
+func refreshMetadata(metadataURL string) (*saml.EntityDescriptor, error) {
+	raw, err := fetchMetadataXML(metadataURL)
+	if err != nil {
+		return nil, err
+	}
+
+	file := metadataCacheFile{
+		MetadataURL: metadataURL,
+		FetchedAt:   time.Now(),
+		Metadata:    string(raw),
+	}
+	cached, err := cachedMetadataFromFile(file)
+	if err != nil {
+		return nil, err
+	}
+	file.Expires = cached.expires
+
+	err = saveCachedMetadata(file)
+	if err != nil {
+		log.Logger.Warnf("Failed to cache the metadata of %s: %s", metadataURL, err.Error())
+	}
+	fetchedMetadata.set(metadataURL, cached)
+	return cached.metadata, nil
+}
+
+func middlewareForMetadata(account *config.Account, metadata *saml.EntityDescriptor) (*samlsp.Middleware, error) {
+	metadata, err := applyIdPSettings(account, metadata)
+	if err != nil {
+		return nil, err
+	}
+	return newServiceProvider(metadata)
+}
+
+// Returns a copy of metadata with the account's idp_sso_url as the SSO endpoint,
+// and only the signing certificates matching its idp_certificate_fingerprints.
+func applyIdPSettings(account *config.Account, metadata *saml.EntityDescriptor) (*saml.EntityDescriptor, error) {
+	if account.IdPSSOURL == "" && len(account.IdPCertificateFingerprints) == 0 {
+		return metadata, nil
+	}
+
+	fingerprints := make(map[string]bool)
+	for _, fingerprint := range account.IdPCertificateFingerprints {
+		fingerprints[config.NormalizeFingerprint(fingerprint)] = true
+	}
+
+	applied := *metadata
+	applied.IDPSSODescriptors = make([]saml.IDPSSODescriptor, len(metadata.IDPSSODescriptors))
+	copy(applied.IDPSSODescriptors, metadata.IDPSSODescriptors)
+	trusted := 0
+	for idx := range applied.IDPSSODescriptors {
+		descriptor := &applied.IDPSSODescriptors[idx]
+		if account.IdPSSOURL != "" {
+			descriptor.SingleSignOnServices = []saml.Endpoint{
+				{Binding: saml.HTTPRedirectBinding, Location: account.IdPSSOURL},
+				{Binding: saml.HTTPPostBinding, Location: account.IdPSSOURL},
+			}
+		}
+		if len(fingerprints) == 0 {
+			continue
+		}
+
+		keyDescriptors := make([]saml.KeyDescriptor, 0, len(descriptor.KeyDescriptors))
+		for _, keyDescriptor := range descriptor.KeyDescriptors {
+			if keyDescriptor.Use == "encryption" {
+				keyDescriptors = append(keyDescriptors, keyDescriptor)
+				continue
+			}
+			certificates := make([]saml.X509Certificate, 0)
+			for _, certificate := range keyDescriptor.KeyInfo.X509Data.X509Certificates {
+				if fingerprints[certificateFingerprint(certificate.Data)] {
+					certificates = append(certificates, certificate)
+				}
+			}
+			if len(certificates) > 0 {
+				keyDescriptor.KeyInfo.X509Data.X509Certificates = certificates
+				keyDescriptors = append(keyDescriptors, keyDescriptor)
+				trusted += len(certificates)
+			}
+		}
+		descriptor.KeyDescriptors = keyDescriptors
+	}
+
+	if len(fingerprints) > 0 && trusted == 0 {
+		return nil, fmt.Errorf("none of the IdP signing certificates of %s matches its idp_certificate_fingerprints", account.Name())
+	}
+	return &applied, nil
+}
+
+// The SHA-256 fingerprint of a base64 certificate from metadata, or "" if it
+// doesn't decode.
+func certificateFingerprint(data string) string {
+	der, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(data), ""))
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:])
+}
+
+// A response or assertion signature that doesn't verify with the IdP
+// certificates of the metadata.
+type signatureError struct {
+	element string
+	err     error
+}
+
+func (e *signatureError) Error() string {
+	return fmt.Sprintf("cannot validate signature on %s: %s", e.element, e.err)
+}
+
+func (e *signatureError) Unwrap() error {
+	return e.err
+}
+
+// Verifies signatures the way ServiceProvider does by default, but returns a
+// signatureError that ParseXMLResponse passes on as is.
+type signatureVerifier struct{}
+
+func (signatureVerifier) VerifySignature(validationContext *dsig.ValidationContext, el *etree.Element) error {
+	_, err := validationContext.Validate(el)
+	if err != nil {
+		return &signatureError{element: el.Tag, err: err}
+	}
+	return nil
+}
+
+// The signature errors of ServiceProvider.ParseXMLResponse, which a rotated IdP
+// certificate causes.
+func isSignatureError(err error) bool {
+	var responseErr *saml.InvalidResponseError
+	var sigErr *signatureError
+	return errors.As(err, &responseErr) && errors.As(responseErr.PrivateErr, &sigErr)
+}
+
+// ParseXMLResponse hides the reason a response was rejected behind
+// "Authentication failed"; it's only shown to the user running aws-llama.
+func describeResponseError(err error) error {
+	var responseErr *saml.InvalidResponseError
+	if errors.As(err, &responseErr) && responseErr.PrivateErr != nil {
+		return fmt.Errorf("%s: %w", responseErr.Error(), responseErr.PrivateErr)
+	}
+	return err
+}
+
+// How long metadata fetched at fetchedAt may be used: until its validUntil or
+// for its cacheDuration, whichever ends first.
+func metadataExpiry(metadata *saml.EntityDescriptor, fetchedAt time.Time) time.Time {
+	expires := fetchedAt.Add(DEFAULT_METADATA_TTL)
+	if metadata.CacheDuration > 0 {
+		expires = fetchedAt.Add(metadata.CacheDuration)
+	}
+	if !metadata.ValidUntil.IsZero() && metadata.ValidUntil.Before(expires) {
+		expires = metadata.ValidUntil
+	}
+
+	earliest := fetchedAt.Add(MIN_METADATA_TTL)
+	if expires.Before(earliest) {
+		return earliest
+	}
+	return expires
+}
+
+func cachedMetadataFromFile(file metadataCacheFile) (*cachedMetadata, error) {
+	metadata, err := parseMetadata([]byte(file.Metadata), file.MetadataURL)
+	if err != nil {
+		return nil, err
+	}
+	return &cachedMetadata{
+		metadata: metadata,
+		expires:  metadataExpiry(metadata, file.FetchedAt),
+	}, nil
+}
+
+func fetchMetadataXML(metadataURL string) ([]byte, error) {
+	httpClient, err := HTTPClient()
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := httpClient.Get(metadataURL)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching %s returned %s", metadataURL, response.Status)
+	}
+	return io.ReadAll(io.LimitReader(response.Body, MAX_METADATA_SIZE))
+}
+
+// The cache file of metadataURL, or "" when metadata isn't cached on disk.
+func metadataCachePath(metadataURL string) string {
+	cacheDir := config.Current().MetadataCacheDir
+	if cacheDir == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(metadataURL))
+	return filepath.Join(cacheDir, hex.EncodeToString(sum[:16])+".json")
+}
+
+// Returns nil without an error when metadataURL isn't cached.
+func loadCachedMetadata(metadataURL string) (*cachedMetadata, error) {
+	path := metadataCachePath(metadataURL)
+	if path == "" {
+		return nil, nil
+	}
+	contents, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var file metadataCacheFile
+	err = json.Unmarshal(contents, &file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	if file.MetadataURL != metadataURL {
+		return nil, nil
+	}
+	return cachedMetadataFromFile(file)
+}
+
+// Replaces the cache file atomically, so that another aws-llama process never
+// reads a partial file.
+func saveCachedMetadata(file metadataCacheFile) error {
+	path := metadataCachePath(file.MetadataURL)
+	if path == "" {
+		return nil
+	}
+	contents, err := json.Marshal(file)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return err
+	}
+	return atomicfile.Write(path, func(w io.Writer) error {
+		_, err := w.Write(contents)
+		return err
+	})
+}
@@ -0,0 +1,211 @@
+package saml
+
+import (
+	"aws-llama/config"
+	"aws-llama/log"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/crewjam/saml"
+	"go.uber.org/zap"
+)
+
+// Serves the metadata of an IdP and counts how often it's fetched. Fetches fail
+// while failing is set.
+func serveIdPMetadata(t *testing.T) (*httptest.Server, *atomic.Int32, *atomic.Bool) {
+	key, cert, err := GenerateKeyPair("test IdP")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var fetches atomic.Int32
+	var failing atomic.Bool
+	var metadata []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		if failing.Load() {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write(metadata)
+	}))
+	t.Cleanup(server.Close)
+
+	baseURL, _ := url.Parse(server.URL)
+	idp := saml.IdentityProvider{
+		Key:         key,
+		Certificate: cert,
+		MetadataURL: *baseURL.ResolveReference(&url.URL{Path: "/metadata"}),
+		SSOURL:      *baseURL.ResolveReference(&url.URL{Path: "/sso"}),
+	}
+	metadata, err = xml.Marshal(idp.Metadata())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return server, &fetches, &failing
+}
+
+func setupMetadataCache(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+
+	rootUrl, _ := url.Parse("http://localhost:2600")
+	previousConfig := config.Current()
+	config.SetCurrent(&config.Config{
+		RootUrl:          rootUrl,
+		MetadataCacheDir: filepath.Join(home, ".aws-llama-metadata"),
+	})
+	previousLogger := log.Logger
+	log.Logger = zap.NewNop().Sugar()
+	t.Cleanup(func() {
+		config.SetCurrent(previousConfig)
+		log.Logger = previousLogger
+		fetchedMetadata = metadataCache{metadata: make(map[string]*cachedMetadata)}
+		builtMiddlewares = middlewareCache{middlewares: make(map[string]*cachedMiddleware)}
+	})
+}
+
+func TestMetadataExpiry(t *testing.T) {
+	fetchedAt := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	cases := []struct {
+		name     string
+		metadata saml.EntityDescriptor
+		expected time.Time
+	}{
+		{"default", saml.EntityDescriptor{}, fetchedAt.Add(DEFAULT_METADATA_TTL)},
+		{"cacheDuration", saml.EntityDescriptor{CacheDuration: time.Hour}, fetchedAt.Add(time.Hour)},
+		{"validUntil", saml.EntityDescriptor{ValidUntil: fetchedAt.Add(2 * time.Hour)}, fetchedAt.Add(2 * time.Hour)},
+		{"earliest of both", saml.EntityDescriptor{CacheDuration: 3 * time.Hour, ValidUntil: fetchedAt.Add(2 * time.Hour)}, fetchedAt.Add(2 * time.Hour)},
+		{"expired validUntil", saml.EntityDescriptor{ValidUntil: fetchedAt.Add(-time.Hour)}, fetchedAt.Add(MIN_METADATA_TTL)},
+	}
+	for _, c := range cases {
+		if expires := metadataExpiry(&c.metadata, fetchedAt); !expires.Equal(c.expected) {
+			t.Errorf("%s: expected expiry %s, got %s", c.name, c.expected, expires)
+		}
+	}
+}
+
+func TestMetadataForURLUsesDiskCache(t *testing.T) {
+	setupMetadataCache(t)
+	server, fetches, _ := serveIdPMetadata(t)
+	metadataURL := server.URL + "/metadata"
+	account := &config.Account{MetadataURL: metadataURL}
+
+	_, err := MiddlewareForAccount(account)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// As after a daemon restart.
+	fetchedMetadata = metadataCache{metadata: make(map[string]*cachedMetadata)}
+	middleware, err := MiddlewareForAccount(account)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fetches.Load() != 1 {
+		t.Errorf("expected the metadata to be fetched once, got %d fetches", fetches.Load())
+	}
+	if middleware.ServiceProvider.GetSSOBindingLocation(saml.HTTPRedirectBinding) != server.URL+"/sso" {
+		t.Errorf("unexpected IdP metadata loaded from disk")
+	}
+}
+
+func TestMetadataForURLFallsBackToExpiredMetadata(t *testing.T) {
+	setupMetadataCache(t)
+	server, fetches, failing := serveIdPMetadata(t)
+	metadataURL := server.URL + "/metadata"
+	account := &config.Account{MetadataURL: metadataURL}
+
+	_, err := MiddlewareForAccount(account)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Age the cached copy past its TTL and restart.
+	path := metadataCachePath(metadataURL)
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var file metadataCacheFile
+	if err := json.Unmarshal(contents, &file); err != nil {
+		t.Fatal(err)
+	}
+	file.FetchedAt = file.FetchedAt.Add(-2 * DEFAULT_METADATA_TTL)
+	if err := saveCachedMetadata(file); err != nil {
+		t.Fatal(err)
+	}
+	fetchedMetadata = metadataCache{metadata: make(map[string]*cachedMetadata)}
+
+	failing.Store(true)
+	_, err = MiddlewareForAccount(account)
+	if err != nil {
+		t.Errorf("expected the expired copy to be used while the IdP is down, got %s", err)
+	}
+	if fetches.Load() != 2 {
+		t.Errorf("expected a refetch of the expired metadata, got %d fetches", fetches.Load())
+	}
+}
+
+func TestMiddlewareForAccountIsCached(t *testing.T) {
+	setupMetadataCache(t)
+	server, _, _ := serveIdPMetadata(t)
+	account := &config.Account{MetadataURL: server.URL + "/metadata"}
+
+	first, err := MiddlewareForAccount(account)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := MiddlewareForAccount(account)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first != second {
+		t.Errorf("expected the middleware to be reused")
+	}
+
+	// As after the metadata was refetched.
+	fetchedMetadata = metadataCache{metadata: make(map[string]*cachedMetadata)}
+	refetched, err := MiddlewareForAccount(account)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if refetched == second {
+		t.Errorf("expected the middleware to be rebuilt after a metadata refetch")
+	}
+
+	reloaded := *config.Current()
+	config.SetCurrent(&reloaded)
+	afterReload, err := MiddlewareForAccount(account)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if afterReload == refetched {
+		t.Errorf("expected the middleware to be rebuilt after a config reload")
+	}
+}
+
+func TestIsSignatureError(t *testing.T) {
+	cases := []struct {
+		name     string
+		err      error
+		expected bool
+	}{
+		{"signature", &saml.InvalidResponseError{PrivateErr: &signatureError{element: "Response", err: errors.New("bad digest")}}, true},
+		{"other response error", &saml.InvalidResponseError{PrivateErr: errors.New("cannot validate signature on Response")}, false},
+		{"plain", errors.New("cannot validate signature on Response"), false},
+	}
+	for _, c := range cases {
+		if isSignatureError(c.err) != c.expected {
+			t.Errorf("%s: expected %v", c.name, c.expected)
+		}
+	}
+}
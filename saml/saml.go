@@ -2,51 +2,93 @@ package saml
 
 import (
 	"aws-llama/config"
-	"context"
 	"fmt"
-	"net/http"
 	"net/url"
 	"strings"
+	"time"
 
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/sts"
 	"github.com/crewjam/saml"
 	"github.com/crewjam/saml/samlsp"
+	dsig "github.com/russellhaering/goxmldsig"
 )
 
+const (
+	ACS_PATH         = "/sso/saml"
+	SP_METADATA_PATH = "/saml/metadata"
+)
+
+// Attribute listing the "role ARN,provider ARN" pairs an assertion grants.
+const ROLE_ATTRIBUTE = "https://aws.amazon.com/SAML/Attributes/Role"
+
+// Attribute naming the session of the assumed roles.
+const ROLE_SESSION_NAME_ATTRIBUTE = "https://aws.amazon.com/SAML/Attributes/RoleSessionName"
+
 type RolePair struct {
 	RoleARN     string
 	ProviderARN string
 }
 
-var middlewareCache map[string]*samlsp.Middleware = make(map[string]*samlsp.Middleware)
-
-func MakeRedirectUrl(m *samlsp.Middleware, relayState string) (*url.URL, error) {
-	// Adapted from Middleware.HandleStartAuthFlow.
-	var binding, bindingLocation string
-	if m.Binding != "" {
-		binding = m.Binding
-		bindingLocation = m.ServiceProvider.GetSSOBindingLocation(binding)
-	} else {
-		binding = saml.HTTPRedirectBinding
-		bindingLocation = m.ServiceProvider.GetSSOBindingLocation(binding)
-		if bindingLocation == "" {
-			binding = saml.HTTPPostBinding
-			bindingLocation = m.ServiceProvider.GetSSOBindingLocation(binding)
+// Where routeLogin sends the browser: a redirect to RedirectURL (HTTP-Redirect
+// binding), or an HTML page posting the AuthnRequest (HTTP-POST binding).
+type AuthnRequest struct {
+	RedirectURL *url.URL
+	PostPage    []byte
+}
+
+// Picks the SAML binding for an account's binding setting (config.Binding*),
+// given the bindings the IdP supports.
+func chooseBinding(m *samlsp.Middleware, setting string) (string, string, error) {
+	var candidates []string
+	switch setting {
+	case config.BindingRedirect:
+		candidates = []string{saml.HTTPRedirectBinding}
+	case config.BindingPost:
+		candidates = []string{saml.HTTPPostBinding}
+	default:
+		candidates = []string{saml.HTTPRedirectBinding, saml.HTTPPostBinding}
+	}
+
+	for _, binding := range candidates {
+		location := m.ServiceProvider.GetSSOBindingLocation(binding)
+		if location != "" {
+			return binding, location, nil
 		}
 	}
+	return "", "", fmt.Errorf("the IdP has no SSO endpoint for binding %s", strings.Join(candidates, " or "))
+}
+
+// Builds an AuthnRequest to the IdP of account, with the binding it's configured
+// for, and tracks it until it's answered. The account key is sent as
+// RelayState. Adapted from Middleware.HandleStartAuthFlow.
+func MakeAuthnRequest(m *samlsp.Middleware, account *config.Account) (*AuthnRequest, error) {
+	// Copied so that signing is only turned on for the accounts that opt in.
+	serviceProvider := m.ServiceProvider
+	if !account.SignsRequests() {
+		serviceProvider.SignatureMethod = ""
+	}
 
-	authReq, err := m.ServiceProvider.MakeAuthenticationRequest(bindingLocation, binding, m.ResponseBinding)
+	binding, bindingLocation, err := chooseBinding(m, account.Binding)
 	if err != nil {
 		return nil, err
 	}
 
-	if binding != saml.HTTPRedirectBinding {
-		return nil, fmt.Errorf("unsupported binding type: %s", binding)
+	authReq, err := serviceProvider.MakeAuthenticationRequest(bindingLocation, binding, m.ResponseBinding)
+	if err != nil {
+		return nil, err
 	}
+	relayState := account.Key()
+	authnRequests.track(authReq.ID, relayState, time.Now())
 
-	redirectURL, err := authReq.Redirect(relayState, &m.ServiceProvider)
-	return redirectURL, err
+	if binding == saml.HTTPPostBinding {
+		page := "<!DOCTYPE html><html><head><title>Signing in...</title></head><body>" + string(authReq.Post(relayState)) + "</body></html>"
+		return &AuthnRequest{PostPage: []byte(page)}, nil
+	}
+
+	redirectURL, err := authReq.Redirect(relayState, &serviceProvider)
+	if err != nil {
+		return nil, err
+	}
+	return &AuthnRequest{RedirectURL: redirectURL}, nil
 }
 
 func ExtractPairsFromAssertion(assertion *saml.Assertion) ([]*RolePair, error) {
@@ -54,7 +96,7 @@ func ExtractPairsFromAssertion(assertion *saml.Assertion) ([]*RolePair, error) {
 
 	for _, statement := range assertion.AttributeStatements {
 		for _, attribute := range statement.Attributes {
-			if attribute.Name == "https://aws.amazon.com/SAML/Attributes/Role" {
+			if attribute.Name == ROLE_ATTRIBUTE {
 				for _, value := range attribute.Values {
 					pair, err := ExtractPairFromString(value.Value)
 					if err != nil {
@@ -82,52 +124,80 @@ func ExtractPairFromString(s string) (*RolePair, error) {
 	return &pair, nil
 }
 
-func AssumeRoleWithSAML(principalArn string, roleArn string, samlAssertion string) (*sts.AssumeRoleWithSAMLOutput, error) {
-	stsSession := session.Must(session.NewSession())
-	client := sts.New(stsSession)
-	assumeRoleInput := sts.AssumeRoleWithSAMLInput{
-		PrincipalArn:  &principalArn,
-		RoleArn:       &roleArn,
-		SAMLAssertion: &samlAssertion,
+// Builds the service provider for an IdP (nil when only the SP's own metadata
+// is needed), with the SP key pair to sign requests and decrypt assertions.
+func newServiceProvider(idpMetadata *saml.EntityDescriptor) (*samlsp.Middleware, error) {
+	key, cert, err := ServiceProviderKeyPair()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load the SP key pair: %w", err)
 	}
-	output, err := client.AssumeRoleWithSAML(&assumeRoleInput)
-
-	return output, err
-}
 
-func FetchSAMLMetadata(metadataURL string) (*saml.EntityDescriptor, error) {
-	url, err := url.Parse(metadataURL)
+	rootUrl := config.Current().RootUrl
+	middleware, err := samlsp.New(samlsp.Options{
+		URL:         *rootUrl,
+		EntityID:    EntityID(),
+		Key:         key,
+		Certificate: cert,
+		IDPMetadata: idpMetadata,
+		// Only accounts with sign_requests sign their AuthnRequests, but the
+		// metadata always lists the signing certificate.
+		SignRequest: true,
+	})
 	if err != nil {
 		return nil, err
 	}
+	middleware.ServiceProvider.SignatureMethod = dsig.RSASHA256SignatureMethod
+	middleware.ServiceProvider.SignatureVerifier = signatureVerifier{}
+	middleware.ServiceProvider.AcsURL = *rootUrl.ResolveReference(&url.URL{Path: ACS_PATH})
+	middleware.ServiceProvider.MetadataURL = *rootUrl.ResolveReference(&url.URL{Path: SP_METADATA_PATH})
+	return middleware, nil
+}
 
-	metadata, err := samlsp.FetchMetadata(context.Background(), http.DefaultClient, *url)
-	return metadata, err
+// The URL the IdP posts SAML responses to.
+func ACSURL() string {
+	return config.Current().RootUrl.ResolveReference(&url.URL{Path: ACS_PATH}).String()
 }
 
-func MiddlewareForURL(metadataURL string) (*samlsp.Middleware, error) {
-	middleware, ok := middlewareCache[metadataURL]
-	if ok {
-		return middleware, nil
-	}
+// Where the SP metadata is served.
+func SPMetadataURL() string {
+	return config.Current().RootUrl.ResolveReference(&url.URL{Path: SP_METADATA_PATH}).String()
+}
 
-	metadata, err := FetchSAMLMetadata(metadataURL)
+// The SP entity ID, which IdPs use as the audience of assertions. It's the ACS
+// URL, as it has always been, so existing IdP apps keep working.
+func EntityID() string {
+	return ACSURL()
+}
+
+// The SP metadata to register in the IdP: entity ID, ACS URL and the
+// certificate for signed requests and encrypted assertions.
+func ServiceProviderMetadata() (*saml.EntityDescriptor, error) {
+	middleware, err := newServiceProvider(nil)
 	if err != nil {
 		return nil, err
 	}
+	metadata := middleware.ServiceProvider.Metadata()
 
-	middleware, err = samlsp.New(samlsp.Options{
-		URL:               *config.CurrentConfig.RootUrl,
-		IDPMetadata:       metadata,
-		AllowIDPInitiated: true, // Prevent request tracking validation.
-	})
-	// Reconfigure to pass validation checks.
-	middleware.ServiceProvider.AcsURL = *middleware.ServiceProvider.AcsURL.ResolveReference(&url.URL{Path: "/sso/saml"})
-	middleware.ServiceProvider.MetadataURL = *middleware.ServiceProvider.MetadataURL.ResolveReference(&url.URL{Path: "/sso/saml"})
-	if err != nil {
-		return nil, err
+	// Requests are only signed for the accounts that opt in, so IdPs mustn't
+	// expect signatures otherwise.
+	signsRequests := false
+	for _, account := range config.Current().Accounts {
+		signsRequests = signsRequests || account.SignsRequests()
 	}
 
-	middlewareCache[metadataURL] = middleware
-	return middleware, nil
+	// Only advertise what routeSAML handles: no logout, no artifact binding.
+	for idx := range metadata.SPSSODescriptors {
+		descriptor := &metadata.SPSSODescriptors[idx]
+		descriptor.AuthnRequestsSigned = &signsRequests
+		descriptor.SingleLogoutServices = nil
+		descriptor.NameIDFormats = nil
+		services := make([]saml.IndexedEndpoint, 0, len(descriptor.AssertionConsumerServices))
+		for _, service := range descriptor.AssertionConsumerServices {
+			if service.Binding == saml.HTTPPostBinding {
+				services = append(services, service)
+			}
+		}
+		descriptor.AssertionConsumerServices = services
+	}
+	return metadata, nil
 }
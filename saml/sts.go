@@ -0,0 +1,230 @@
+package saml
+
+import (
+	"aws-llama/config"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	awscredentials "github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/endpoints"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sts"
+)
+
+const HTTP_TIMEOUT = 30 * time.Second
+
+// The STS calls made for SAML logins and chained roles.
+type STSClient interface {
+	AssumeRoleWithSAML(account *config.Account, principalArn string, roleArn string, samlAssertion string, durationSeconds int64) (*sts.AssumeRoleWithSAMLOutput, error)
+	AssumeRole(account *config.Account, accessKeyId string, secretAccessKey string, sessionToken string, input *sts.AssumeRoleInput) (*sts.AssumeRoleOutput, error)
+}
+
+// STSClient that calls AWS.
+type AWSSTSClient struct{}
+
+// The STSClient used to assume roles. Tests replace it with a fakests.FakeSTS.
+var STS STSClient = AWSSTSClient{}
+
+// STS region used for a partition when the account doesn't set sts_region.
+var partitionRegions = map[string]string{
+	endpoints.AwsPartitionID:      "us-east-1",
+	endpoints.AwsUsGovPartitionID: "us-gov-west-1",
+	endpoints.AwsCnPartitionID:    "cn-north-1",
+	endpoints.AwsIsoPartitionID:   "us-iso-east-1",
+	endpoints.AwsIsoBPartitionID:  "us-isob-east-1",
+}
+
+// Returns the partition of an ARN, e.g. "aws-us-gov" for
+// arn:aws-us-gov:iam::123456789012:saml-provider/Okta.
+func PartitionFromARN(arn string) (string, error) {
+	parts := strings.SplitN(arn, ":", 3)
+	if len(parts) < 3 || parts[0] != "arn" || parts[1] == "" {
+		return "", fmt.Errorf("unable to extract partition from malformed ARN: %s", arn)
+	}
+	return parts[1], nil
+}
+
+// The settings an HTTP client is built from.
+type httpSettings struct {
+	proxy    string
+	caBundle string
+}
+
+// Where an STS client sends its requests.
+type stsTarget struct {
+	region   string
+	endpoint string
+}
+
+// The HTTP client and the STS sessions using it, shared by every request so that
+// connections are reused. Rebuilt when the HTTP settings change.
+type sharedClients struct {
+	lock       sync.Mutex
+	settings   httpSettings
+	httpClient *http.Client
+	sessions   map[stsTarget]*session.Session
+}
+
+var clients sharedClients
+
+// Returns the HTTP client for outgoing requests (STS and IdP metadata), honoring
+// the http_proxy and ca_bundle settings.
+func HTTPClient() (*http.Client, error) {
+	clients.lock.Lock()
+	defer clients.lock.Unlock()
+
+	return clients.currentHTTPClient()
+}
+
+// Must be called with the lock held.
+func (c *sharedClients) currentHTTPClient() (*http.Client, error) {
+	current := config.Current()
+	settings := httpSettings{proxy: current.HTTPProxy, caBundle: current.CABundle}
+	if c.httpClient != nil && c.settings == settings {
+		return c.httpClient, nil
+	}
+
+	httpClient, err := newHTTPClient(settings)
+	if err != nil {
+		return nil, err
+	}
+	c.settings = settings
+	c.httpClient = httpClient
+	c.sessions = make(map[stsTarget]*session.Session)
+	return httpClient, nil
+}
+
+func newHTTPClient(settings httpSettings) (*http.Client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+
+	if settings.proxy != "" {
+		proxyURL, err := url.Parse(settings.proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid http_proxy: %w", err)
+		}
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+
+	if settings.caBundle != "" {
+		pem, err := os.ReadFile(settings.caBundle)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read ca_bundle: %w", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in ca_bundle %s", settings.caBundle)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+
+	return &http.Client{Transport: transport, Timeout: HTTP_TIMEOUT}, nil
+}
+
+// Returns the STS region and custom endpoint (if any) for the account. The
+// endpoint is, in order of preference: the account's sts_endpoint, the regional
+// endpoint of its sts_region, or the regional endpoint of the partition of arn
+// (the SAML provider or role being assumed).
+func stsTargetFor(account *config.Account, arn string) (stsTarget, error) {
+	var target stsTarget
+	if account != nil {
+		target.region = account.STSRegion
+		target.endpoint = account.STSEndpoint
+	}
+	if target.region == "" {
+		partition, err := PartitionFromARN(arn)
+		if err != nil {
+			return stsTarget{}, err
+		}
+		target.region = partitionRegions[partition]
+		if target.region == "" {
+			return stsTarget{}, fmt.Errorf("unknown partition %q in %s: set sts_region for the account", partition, arn)
+		}
+	}
+	return target, nil
+}
+
+// Returns the session for target, creating it on first use.
+func (c *sharedClients) session(target stsTarget) (*session.Session, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	httpClient, err := c.currentHTTPClient()
+	if err != nil {
+		return nil, err
+	}
+	stsSession, ok := c.sessions[target]
+	if ok {
+		return stsSession, nil
+	}
+
+	awsConfig := aws.Config{
+		HTTPClient:          httpClient,
+		Region:              aws.String(target.region),
+		STSRegionalEndpoint: endpoints.RegionalSTSEndpoint,
+	}
+	if target.endpoint != "" {
+		awsConfig.Endpoint = aws.String(target.endpoint)
+	}
+	stsSession, err = session.NewSession(&awsConfig)
+	if err != nil {
+		return nil, err
+	}
+	c.sessions[target] = stsSession
+	return stsSession, nil
+}
+
+// Creates an STS client for the account, authenticated with credentials (see
+// stsTargetFor for the endpoint). Clients for the same endpoint share their
+// session and connections.
+func NewSTSClient(account *config.Account, arn string, credentials *awscredentials.Credentials) (*sts.STS, error) {
+	target, err := stsTargetFor(account, arn)
+	if err != nil {
+		return nil, err
+	}
+	stsSession, err := clients.session(target)
+	if err != nil {
+		return nil, err
+	}
+	return sts.New(stsSession, &aws.Config{Credentials: credentials}), nil
+}
+
+// Assumes the role for durationSeconds (0 for the STS default).
+func (AWSSTSClient) AssumeRoleWithSAML(account *config.Account, principalArn string, roleArn string, samlAssertion string, durationSeconds int64) (*sts.AssumeRoleWithSAMLOutput, error) {
+	// AssumeRoleWithSAML is authenticated by the assertion, not by AWS credentials.
+	client, err := NewSTSClient(account, principalArn, awscredentials.AnonymousCredentials)
+	if err != nil {
+		return nil, err
+	}
+
+	assumeRoleInput := sts.AssumeRoleWithSAMLInput{
+		PrincipalArn:  &principalArn,
+		RoleArn:       &roleArn,
+		SAMLAssertion: &samlAssertion,
+	}
+	if durationSeconds != 0 {
+		assumeRoleInput.DurationSeconds = &durationSeconds
+	}
+	return client.AssumeRoleWithSAML(&assumeRoleInput)
+}
+
+// Assumes a role with sts:AssumeRole, authenticating with the given (usually
+// SAML-derived) credentials.
+func (AWSSTSClient) AssumeRole(account *config.Account, accessKeyId string, secretAccessKey string, sessionToken string, input *sts.AssumeRoleInput) (*sts.AssumeRoleOutput, error) {
+	credentials := awscredentials.NewStaticCredentials(accessKeyId, secretAccessKey, sessionToken)
+	client, err := NewSTSClient(account, *input.RoleArn, credentials)
+	if err != nil {
+		return nil, err
+	}
+	return client.AssumeRole(input)
+}
@@ -0,0 +1,133 @@
+package saml
+
+import (
+	"aws-llama/config"
+	"strings"
+	"testing"
+
+	awscredentials "github.com/aws/aws-sdk-go/aws/credentials"
+)
+
+func TestPartitionFromARN(t *testing.T) {
+	cases := []struct {
+		arn       string
+		partition string
+		valid     bool
+	}{
+		{"arn:aws:iam::123456789012:saml-provider/Okta", "aws", true},
+		{"arn:aws-cn:iam::123456789012:role/developer", "aws-cn", true},
+		{"arn:aws-us-gov:iam::123456789012:saml-provider/Okta", "aws-us-gov", true},
+		{"arn::iam::123456789012:role/developer", "", false},
+		{"not-an-arn", "", false},
+	}
+	for _, c := range cases {
+		partition, err := PartitionFromARN(c.arn)
+		if c.valid && (err != nil || partition != c.partition) {
+			t.Errorf("%s: expected partition %q, got %q (%v)", c.arn, c.partition, partition, err)
+		}
+		if !c.valid && err == nil {
+			t.Errorf("%s: expected an error, got %q", c.arn, partition)
+		}
+	}
+}
+
+func TestNewSTSClientEndpoints(t *testing.T) {
+	previousConfig := config.Current()
+	config.SetCurrent(&config.Config{})
+	t.Cleanup(func() { config.SetCurrent(previousConfig) })
+
+	cases := []struct {
+		name     string
+		account  *config.Account
+		arn      string
+		expected string
+		err      string
+	}{
+		{
+			name:     "aws",
+			arn:      "arn:aws:iam::123456789012:saml-provider/Okta",
+			expected: "https://sts.us-east-1.amazonaws.com",
+		},
+		{
+			name:     "aws-cn",
+			arn:      "arn:aws-cn:iam::123456789012:saml-provider/Okta",
+			expected: "https://sts.cn-north-1.amazonaws.com.cn",
+		},
+		{
+			name:     "aws-us-gov",
+			arn:      "arn:aws-us-gov:iam::123456789012:saml-provider/Okta",
+			expected: "https://sts.us-gov-west-1.amazonaws.com",
+		},
+		{
+			name:     "sts_region",
+			account:  &config.Account{STSRegion: "eu-central-1"},
+			arn:      "arn:aws:iam::123456789012:saml-provider/Okta",
+			expected: "https://sts.eu-central-1.amazonaws.com",
+		},
+		{
+			name:     "sts_region without a known partition",
+			account:  &config.Account{STSRegion: "eu-central-1"},
+			arn:      "arn:aws-unknown:iam::123456789012:saml-provider/Okta",
+			expected: "https://sts.eu-central-1.amazonaws.com",
+		},
+		{
+			name:     "sts_endpoint",
+			account:  &config.Account{STSEndpoint: "https://vpce-1234.sts.us-east-1.vpce.amazonaws.com"},
+			arn:      "arn:aws:iam::123456789012:saml-provider/Okta",
+			expected: "https://vpce-1234.sts.us-east-1.vpce.amazonaws.com",
+		},
+		{
+			name: "unknown partition",
+			arn:  "arn:aws-unknown:iam::123456789012:saml-provider/Okta",
+			err:  "set sts_region",
+		},
+	}
+	for _, c := range cases {
+		client, err := NewSTSClient(c.account, c.arn, awscredentials.AnonymousCredentials)
+		if c.err != "" {
+			if err == nil || !strings.Contains(err.Error(), c.err) {
+				t.Errorf("%s: expected an error containing %q, got %v", c.name, c.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", c.name, err)
+			continue
+		}
+		if client.Endpoint != c.expected {
+			t.Errorf("%s: expected endpoint %s, got %s", c.name, c.expected, client.Endpoint)
+		}
+	}
+}
+
+func TestNewSTSClientReusesConnections(t *testing.T) {
+	previousConfig := config.Current()
+	config.SetCurrent(&config.Config{})
+	t.Cleanup(func() { config.SetCurrent(previousConfig) })
+
+	arn := "arn:aws:iam::123456789012:saml-provider/Okta"
+	first, err := NewSTSClient(nil, arn, awscredentials.AnonymousCredentials)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := NewSTSClient(nil, arn, awscredentials.NewStaticCredentials("ASIA", "secret", "token"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.Config.HTTPClient != second.Config.HTTPClient {
+		t.Errorf("expected the clients to share their HTTP client")
+	}
+	if first.Config.Credentials == second.Config.Credentials {
+		t.Errorf("expected each client to keep its own credentials")
+	}
+
+	// Other HTTP settings get another HTTP client.
+	config.SetCurrent(&config.Config{HTTPProxy: "http://proxy.example.com:3128"})
+	third, err := NewSTSClient(nil, arn, awscredentials.AnonymousCredentials)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if third.Config.HTTPClient == first.Config.HTTPClient {
+		t.Errorf("expected a new HTTP client after http_proxy changed")
+	}
+}
@@ -0,0 +1,48 @@
+package scheduler
+
+import "time"
+
+// Abstracts time so the scheduler can be driven by a fake clock in tests.
+type Clock interface {
+	Now() time.Time
+	// Time elapsed on a clock that, unlike the wall clock, stops while the
+	// machine is asleep and isn't affected by changes to the system time.
+	Monotonic() time.Duration
+	NewTimer(d time.Duration) Timer
+}
+
+type Timer interface {
+	C() <-chan time.Time
+	Stop() bool
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+var processStart = time.Now()
+
+func (realClock) Monotonic() time.Duration {
+	return time.Since(processStart)
+}
+
+func (realClock) NewTimer(d time.Duration) Timer {
+	return &realTimer{timer: time.NewTimer(d)}
+}
+
+type realTimer struct {
+	timer *time.Timer
+}
+
+func (r *realTimer) C() <-chan time.Time {
+	return r.timer.C
+}
+
+func (r *realTimer) Stop() bool {
+	return r.timer.Stop()
+}
+
+// The system clock.
+var RealClock Clock = realClock{}
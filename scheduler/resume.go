@@ -0,0 +1,46 @@
+package scheduler
+
+import (
+	"context"
+	"time"
+)
+
+// A reading of both the wall and the monotonic clock.
+type clockReading struct {
+	wall      time.Time
+	monotonic time.Duration
+}
+
+func readClocks(clock Clock) clockReading {
+	return clockReading{wall: clock.Now(), monotonic: clock.Monotonic()}
+}
+
+// Calls onJump whenever the wall clock moves further than the monotonic clock
+// between two ticks, which happens when the machine was suspended (the monotonic
+// clock stops while asleep) or the system time was changed.
+func WatchClockJumps(ctx context.Context, clock Clock, interval time.Duration, threshold time.Duration, onJump func(jump time.Duration)) {
+	previous := readClocks(clock)
+	for {
+		timer := clock.NewTimer(interval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C():
+			now := readClocks(clock)
+			jump := clockJump(previous, now)
+			previous = now
+			if jump > threshold || jump < -threshold {
+				onJump(jump)
+			}
+		}
+	}
+}
+
+// Returns how much further the wall clock moved than the monotonic clock between
+// two readings.
+func clockJump(previous clockReading, now clockReading) time.Duration {
+	wallElapsed := now.wall.Round(0).Sub(previous.wall.Round(0))
+	monotonicElapsed := now.monotonic - previous.monotonic
+	return wallElapsed - monotonicElapsed
+}
@@ -0,0 +1,48 @@
+package scheduler
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/godbus/dbus/v5"
+)
+
+// Calls onResume whenever systemd-logind reports that the system woke up from
+// suspend or hibernation. Returns an error if the system bus isn't available.
+func WatchSleep(ctx context.Context, onResume func()) error {
+	conn, err := dbus.ConnectSystemBus()
+	if err != nil {
+		return fmt.Errorf("failed to connect to the system bus: %w", err)
+	}
+	defer conn.Close()
+
+	err = conn.AddMatchSignal(
+		dbus.WithMatchInterface("org.freedesktop.login1.Manager"),
+		dbus.WithMatchMember("PrepareForSleep"),
+		dbus.WithMatchObjectPath("/org/freedesktop/login1"),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to subscribe to logind sleep signals: %w", err)
+	}
+
+	signals := make(chan *dbus.Signal, 10)
+	conn.Signal(signals)
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case signal, ok := <-signals:
+			if !ok {
+				return fmt.Errorf("system bus connection closed")
+			}
+			if signal.Name != "org.freedesktop.login1.Manager.PrepareForSleep" || len(signal.Body) != 1 {
+				continue
+			}
+			// The argument is true before going to sleep and false after waking up.
+			sleeping, ok := signal.Body[0].(bool)
+			if ok && !sleeping {
+				onResume()
+			}
+		}
+	}
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+
+package scheduler
+
+import (
+	"context"
+	"errors"
+)
+
+// Sleep notifications are only implemented for systemd-logind; elsewhere resumes
+// are detected through WatchClockJumps.
+func WatchSleep(ctx context.Context, onResume func()) error {
+	return errors.New("sleep notifications are not supported on this platform")
+}
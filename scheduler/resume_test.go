@@ -0,0 +1,80 @@
+package scheduler
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestClockJump(t *testing.T) {
+	cases := []struct {
+		name     string
+		elapse   func(clock *fakeClock)
+		expected time.Duration
+	}{
+		{
+			name:     "no jump",
+			elapse:   func(clock *fakeClock) { clock.Advance(30 * time.Second) },
+			expected: 0,
+		},
+		{
+			name: "forward after a suspend",
+			elapse: func(clock *fakeClock) {
+				clock.JumpWallClock(2 * time.Hour)
+				clock.Advance(30 * time.Second)
+			},
+			expected: 2 * time.Hour,
+		},
+		{
+			name: "backward after the system time was changed",
+			elapse: func(clock *fakeClock) {
+				clock.Advance(30 * time.Second)
+				clock.JumpWallClock(-5 * time.Minute)
+			},
+			expected: -5 * time.Minute,
+		},
+	}
+	for _, c := range cases {
+		clock := newFakeClock()
+		previous := readClocks(clock)
+		c.elapse(clock)
+		jump := clockJump(previous, readClocks(clock))
+		if jump != c.expected {
+			t.Errorf("%s: expected a jump of %s, got %s", c.name, c.expected, jump)
+		}
+	}
+}
+
+func TestWatchClockJumps(t *testing.T) {
+	clock := newFakeClock()
+	jumps := make(chan time.Duration, 10)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go WatchClockJumps(ctx, clock, 30*time.Second, time.Minute, func(jump time.Duration) {
+		jumps <- jump
+	})
+
+	// Regular ticks and drift below the threshold aren't jumps.
+	<-clock.created
+	clock.Advance(30 * time.Second)
+	<-clock.created
+	clock.JumpWallClock(30 * time.Second)
+	clock.Advance(30 * time.Second)
+	<-clock.created
+	select {
+	case jump := <-jumps:
+		t.Fatalf("unexpected jump of %s", jump)
+	default:
+	}
+
+	clock.JumpWallClock(time.Hour)
+	clock.Advance(30 * time.Second)
+	select {
+	case jump := <-jumps:
+		if jump != time.Hour {
+			t.Errorf("expected a jump of 1h, got %s", jump)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the jump")
+	}
+}
@@ -0,0 +1,179 @@
+package scheduler
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"sync/atomic"
+	"time"
+)
+
+const DEFAULT_MIN_BACKOFF = 30 * time.Second
+const DEFAULT_MAX_BACKOFF = 30 * time.Minute
+const DEFAULT_NOT_READY_DELAY = 10 * time.Second
+
+// Returned (wrapped) by a refresh that couldn't start yet, e.g. because the
+// network is still down after a resume. It's retried after NotReadyDelay and
+// doesn't count as a failure for the backoff.
+var ErrNotReady = errors.New("not ready to refresh")
+
+// Returned (via backoff) when a refresh reported success but there is still
+// something due, so that a refresh which silently did nothing can't spin.
+var ErrStillDue = errors.New("refresh finished but credentials are still due")
+
+// Runs refresh whenever the deadline returned by nextDeadline has passed, and
+// sleeps until then otherwise. Failed refreshes are retried with jittered
+// exponential backoff.
+type Scheduler struct {
+	clock Clock
+	// Performs the refresh.
+	refresh func() error
+	// Returns when the next refresh is due, or false if nothing is scheduled.
+	nextDeadline func(now time.Time) (time.Time, bool)
+	wake         chan struct{}
+	// Set by WakeSkippingBackoff, cleared when the wake up is handled.
+	skipBackoff atomic.Bool
+
+	MinBackoff    time.Duration
+	MaxBackoff    time.Duration
+	NotReadyDelay time.Duration
+	// Returns a value in [0, 1); replaceable for deterministic tests.
+	Random func() float64
+	// Optionally called after a failed refresh with the delay until the retry.
+	OnRetry func(err error, delay time.Duration)
+
+	failures int
+	retryAt  time.Time
+}
+
+func New(refresh func() error, nextDeadline func(now time.Time) (time.Time, bool), clock Clock) *Scheduler {
+	return &Scheduler{
+		clock:         clock,
+		refresh:       refresh,
+		nextDeadline:  nextDeadline,
+		wake:          make(chan struct{}, 1),
+		MinBackoff:    DEFAULT_MIN_BACKOFF,
+		MaxBackoff:    DEFAULT_MAX_BACKOFF,
+		NotReadyDelay: DEFAULT_NOT_READY_DELAY,
+		Random:        rand.Float64,
+	}
+}
+
+// Makes the scheduler re-evaluate its deadline right away. A pending backoff
+// is kept, so that clients asking for credentials while refreshes fail can't
+// cause a refresh each. Safe to call from any goroutine; calls made while the
+// scheduler is busy are coalesced.
+func (s *Scheduler) Wake() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+		// A wake up is already pending.
+	}
+}
+
+// Like Wake, but also drops any pending backoff, for events that may have fixed
+// what made refreshes fail: a config change, or the network coming back after
+// a resume.
+func (s *Scheduler) WakeSkippingBackoff() {
+	s.skipBackoff.Store(true)
+	s.Wake()
+}
+
+// Runs the scheduler until ctx is cancelled.
+func (s *Scheduler) Run(ctx context.Context) {
+	for {
+		wait, due := s.nextWait()
+		if due {
+			s.runRefresh()
+			continue
+		}
+
+		var timer Timer
+		var fired <-chan time.Time
+		if wait >= 0 {
+			timer = s.clock.NewTimer(wait)
+			fired = timer.C()
+		}
+
+		select {
+		case <-ctx.Done():
+			if timer != nil {
+				timer.Stop()
+			}
+			return
+		case <-fired:
+		case <-s.wake:
+			if timer != nil {
+				timer.Stop()
+			}
+			if s.skipBackoff.Swap(false) {
+				s.retryAt = time.Time{}
+			}
+		}
+	}
+}
+
+// Returns how long to sleep, or due=true if a refresh should run now. A
+// negative wait means there's nothing scheduled until the next Wake.
+func (s *Scheduler) nextWait() (wait time.Duration, due bool) {
+	now := s.clock.Now()
+	if !s.retryAt.IsZero() {
+		if !now.Before(s.retryAt) {
+			return 0, true
+		}
+		return s.retryAt.Sub(now), false
+	}
+
+	deadline, ok := s.nextDeadline(now)
+	if !ok {
+		return -1, false
+	}
+	if !now.Before(deadline) {
+		return 0, true
+	}
+	return deadline.Sub(now), false
+}
+
+func (s *Scheduler) runRefresh() {
+	err := s.refresh()
+	if err == nil {
+		deadline, ok := s.nextDeadline(s.clock.Now())
+		if ok && !s.clock.Now().Before(deadline) {
+			err = ErrStillDue
+		}
+	}
+
+	if errors.Is(err, ErrNotReady) {
+		s.retryAt = s.clock.Now().Add(s.NotReadyDelay)
+		if s.OnRetry != nil {
+			s.OnRetry(err, s.NotReadyDelay)
+		}
+		return
+	}
+	if err != nil {
+		s.failures++
+		delay := s.Backoff(s.failures)
+		s.retryAt = s.clock.Now().Add(delay)
+		if s.OnRetry != nil {
+			s.OnRetry(err, delay)
+		}
+		return
+	}
+	s.failures = 0
+	s.retryAt = time.Time{}
+}
+
+// Returns the delay before retry number attempt (starting at 1): exponential
+// from MinBackoff up to MaxBackoff, with the upper half jittered.
+func (s *Scheduler) Backoff(attempt int) time.Duration {
+	backoff := s.MinBackoff
+	for i := 1; i < attempt && backoff < s.MaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > s.MaxBackoff {
+		backoff = s.MaxBackoff
+	}
+
+	half := backoff / 2
+	return half + time.Duration(s.Random()*float64(backoff-half))
+}
@@ -0,0 +1,277 @@
+package scheduler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+type fakeClock struct {
+	lock      sync.Mutex
+	now       time.Time
+	monotonic time.Duration
+	timers    []*fakeTimer
+	created   chan struct{}
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{
+		now:     time.Date(2023, 8, 1, 12, 0, 0, 0, time.UTC),
+		created: make(chan struct{}, 100),
+	}
+}
+
+func (f *fakeClock) Now() time.Time {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.now
+}
+
+func (f *fakeClock) Monotonic() time.Duration {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.monotonic
+}
+
+func (f *fakeClock) NewTimer(d time.Duration) Timer {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	timer := &fakeTimer{clock: f, at: f.now.Add(d), c: make(chan time.Time, 1)}
+	f.timers = append(f.timers, timer)
+	f.created <- struct{}{}
+	return timer
+}
+
+func (f *fakeClock) Advance(d time.Duration) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.now = f.now.Add(d)
+	f.monotonic += d
+	for _, timer := range f.timers {
+		if !timer.stopped && !timer.fired && !f.now.Before(timer.at) {
+			timer.fired = true
+			timer.c <- f.now
+		}
+	}
+}
+
+// Moves the wall clock alone, like a suspend or a change of the system time does.
+// Timers
+// follow the monotonic clock, so none of them fire.
+func (f *fakeClock) JumpWallClock(d time.Duration) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.now = f.now.Add(d)
+	for _, timer := range f.timers {
+		timer.at = timer.at.Add(d)
+	}
+}
+
+type fakeTimer struct {
+	clock   *fakeClock
+	at      time.Time
+	c       chan time.Time
+	fired   bool
+	stopped bool
+}
+
+func (f *fakeTimer) C() <-chan time.Time {
+	return f.c
+}
+
+func (f *fakeTimer) Stop() bool {
+	f.clock.lock.Lock()
+	defer f.clock.lock.Unlock()
+
+	wasActive := !f.fired && !f.stopped
+	f.stopped = true
+	return wasActive
+}
+
+func fixedDeadline(deadline time.Time) func(time.Time) (time.Time, bool) {
+	return func(time.Time) (time.Time, bool) {
+		return deadline, true
+	}
+}
+
+func TestNextWait(t *testing.T) {
+	clock := newFakeClock()
+	now := clock.Now()
+
+	s := New(nil, fixedDeadline(now.Add(10*time.Minute)), clock)
+	wait, due := s.nextWait()
+	if due || wait != 10*time.Minute {
+		t.Errorf("expected to wait 10m, got wait=%s due=%v", wait, due)
+	}
+
+	s = New(nil, fixedDeadline(now.Add(-time.Second)), clock)
+	_, due = s.nextWait()
+	if !due {
+		t.Error("expected a past deadline to be due")
+	}
+
+	s = New(nil, func(time.Time) (time.Time, bool) { return time.Time{}, false }, clock)
+	wait, due = s.nextWait()
+	if due || wait >= 0 {
+		t.Errorf("expected nothing to be scheduled, got wait=%s due=%v", wait, due)
+	}
+}
+
+func TestBackoffAfterFailures(t *testing.T) {
+	clock := newFakeClock()
+	failing := func() error { return errors.New("boom") }
+	s := New(failing, fixedDeadline(clock.Now()), clock)
+	s.MinBackoff = 10 * time.Second
+	s.MaxBackoff = 60 * time.Second
+	s.Random = func() float64 { return 0 }
+
+	expected := []time.Duration{5 * time.Second, 10 * time.Second, 20 * time.Second, 30 * time.Second, 30 * time.Second}
+	for _, delay := range expected {
+		s.runRefresh()
+		wait, due := s.nextWait()
+		if due || wait != delay {
+			t.Fatalf("expected to retry in %s, got wait=%s due=%v", delay, wait, due)
+		}
+	}
+
+	s.Random = func() float64 { return 0.999999 }
+	if backoff := s.Backoff(1); backoff < 9*time.Second || backoff > 10*time.Second {
+		t.Errorf("expected jitter to stay within the backoff, got %s", backoff)
+	}
+}
+
+func TestSuccessResetsBackoff(t *testing.T) {
+	clock := newFakeClock()
+	deadline := clock.Now()
+	var err error = errors.New("boom")
+	s := New(func() error { return err }, func(time.Time) (time.Time, bool) { return deadline, true }, clock)
+
+	s.runRefresh()
+	if s.failures != 1 {
+		t.Fatalf("expected 1 failure, got %d", s.failures)
+	}
+
+	err = nil
+	deadline = clock.Now().Add(time.Hour)
+	s.runRefresh()
+	if s.failures != 0 || !s.retryAt.IsZero() {
+		t.Errorf("expected backoff to be reset, got failures=%d retryAt=%s", s.failures, s.retryAt)
+	}
+}
+
+func TestStillDueCountsAsFailure(t *testing.T) {
+	clock := newFakeClock()
+	var retryErr error
+	s := New(func() error { return nil }, fixedDeadline(clock.Now()), clock)
+	s.OnRetry = func(err error, delay time.Duration) { retryErr = err }
+
+	s.runRefresh()
+	if !errors.Is(retryErr, ErrStillDue) {
+		t.Errorf("expected ErrStillDue, got %v", retryErr)
+	}
+}
+
+func TestRunRefreshesAtDeadlineAndOnWake(t *testing.T) {
+	clock := newFakeClock()
+	refreshed := make(chan struct{}, 10)
+
+	var lock sync.Mutex
+	deadline := clock.Now().Add(time.Hour)
+	s := New(func() error {
+		lock.Lock()
+		deadline = clock.Now().Add(time.Hour)
+		lock.Unlock()
+		refreshed <- struct{}{}
+		return nil
+	}, func(time.Time) (time.Time, bool) {
+		lock.Lock()
+		defer lock.Unlock()
+		return deadline, true
+	}, clock)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.Run(ctx)
+
+	// Sleeps until the deadline.
+	<-clock.created
+	select {
+	case <-refreshed:
+		t.Fatal("refreshed before the deadline")
+	default:
+	}
+	clock.Advance(time.Hour)
+	waitFor(t, refreshed)
+
+	// Wakes early when asked to, e.g. after a config change.
+	<-clock.created
+	lock.Lock()
+	deadline = clock.Now()
+	lock.Unlock()
+	s.Wake()
+	waitFor(t, refreshed)
+}
+
+func TestWakeKeepsPendingBackoff(t *testing.T) {
+	clock := newFakeClock()
+	refreshed := make(chan struct{}, 10)
+	s := New(func() error {
+		refreshed <- struct{}{}
+		return errors.New("IdP is down")
+	}, fixedDeadline(clock.Now()), clock)
+	s.Random = func() float64 { return 0 }
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.Run(ctx)
+
+	// The first attempt fails and backs off.
+	waitFor(t, refreshed)
+	<-clock.created
+
+	// Clients asking for credentials don't cut the backoff short.
+	for i := 0; i < 3; i++ {
+		s.Wake()
+		<-clock.created
+	}
+	select {
+	case <-refreshed:
+		t.Fatal("a wake up bypassed the backoff")
+	default:
+	}
+
+	// A config change does.
+	s.WakeSkippingBackoff()
+	waitFor(t, refreshed)
+}
+
+func waitFor(t *testing.T, c <-chan struct{}) {
+	t.Helper()
+	select {
+	case <-c:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for a refresh")
+	}
+}
+
+func TestNotReadyDoesNotBackOff(t *testing.T) {
+	clock := newFakeClock()
+	notReady := func() error { return fmt.Errorf("%w: network is down", ErrNotReady) }
+	s := New(notReady, fixedDeadline(clock.Now()), clock)
+
+	for i := 0; i < 3; i++ {
+		s.runRefresh()
+		wait, due := s.nextWait()
+		if due || wait != s.NotReadyDelay {
+			t.Fatalf("expected to retry in %s, got wait=%s due=%v", s.NotReadyDelay, wait, due)
+		}
+	}
+	if s.failures != 0 {
+		t.Errorf("expected no failures to be counted, got %d", s.failures)
+	}
+}
@@ -0,0 +1,112 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+
+package secrets
+
+import (
+	"aws-llama/config"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Puts a fake command on the PATH that runs script with $STORE set to a
+// directory it can keep entries in.
+func fakeCommand(t *testing.T, name string, script string) string {
+	dir := t.TempDir()
+	store := filepath.Join(dir, "store")
+	err := os.Mkdir(store, 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents := "#!/bin/sh\nSTORE=" + store + "\n" + script + "\n"
+	err = os.WriteFile(filepath.Join(dir, name), []byte(contents), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	return store
+}
+
+func TestPassBackend(t *testing.T) {
+	// pass show <entry>, pass insert --multiline --force <entry>
+	fakeCommand(t, "pass", `case "$1" in
+show) cat "$STORE/$(echo "$2" | tr / _)" 2>/dev/null || { echo "Error: $2 is not in the password store." >&2; exit 1; } ;;
+insert) cat > "$STORE/$(echo "$4" | tr / _)" ;;
+esac`)
+
+	cases := []struct {
+		name  string
+		entry string
+	}{
+		{"default entry", ""},
+		{"configured entry", "work/idp"},
+	}
+	for _, c := range cases {
+		backend, err := NewBackend(config.PasswordBackend{Type: config.PasswordBackendPass, PassEntry: c.entry})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = backend.Get("me@example.com")
+		if err == nil {
+			t.Errorf("%s: expected a missing entry to fail", c.name)
+		}
+
+		err = backend.Set("me@example.com", "hunter2")
+		if err != nil {
+			t.Fatalf("%s: %s", c.name, err)
+		}
+		password, err := backend.Get("me@example.com")
+		if err != nil || password != "hunter2" {
+			t.Errorf("%s: expected the stored password, got %q (%v)", c.name, password, err)
+		}
+	}
+}
+
+func TestPassBackendReadsFirstLine(t *testing.T) {
+	store := fakeCommand(t, "pass", `cat "$STORE/entry"`)
+	err := os.WriteFile(filepath.Join(store, "entry"), []byte("hunter2\nusername: me@example.com\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	password, err := (&passBackend{entry: "entry"}).Get("me@example.com")
+	if err != nil || password != "hunter2" {
+		t.Errorf("expected only the first line, got %q (%v)", password, err)
+	}
+}
+
+func TestSecretServiceBackend(t *testing.T) {
+	// secret-tool lookup service aws-llama username <username>,
+	// secret-tool store --label <label> service aws-llama username <username>
+	store := fakeCommand(t, "secret-tool", `case "$1" in
+lookup) cat "$STORE/$5" 2>/dev/null || exit 1 ;;
+store) cat > "$STORE/$7" ;;
+esac`)
+	backend, err := NewBackend(config.PasswordBackend{Type: config.PasswordBackendSecretService})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = backend.Get("me@example.com")
+	if err == nil || !strings.Contains(err.Error(), "set-password") {
+		t.Errorf("expected a missing password to point at set-password, got %v", err)
+	}
+
+	err = backend.Set("me@example.com", "hunter2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = backend.Set("other@example.com", "other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	password, err := backend.Get("me@example.com")
+	if err != nil || password != "hunter2" {
+		t.Errorf("expected the password stored for the username, got %q (%v)", password, err)
+	}
+	if _, err := os.Stat(filepath.Join(store, "other@example.com")); err != nil {
+		t.Errorf("expected passwords to be stored per username: %v", err)
+	}
+}
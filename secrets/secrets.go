@@ -0,0 +1,195 @@
+package secrets
+
+import (
+	"aws-llama/atomicfile"
+	"aws-llama/config"
+	"aws-llama/encryption"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+const SECRET_SERVICE_NAME = "aws-llama"
+const DEFAULT_PASSWORD_ENV = "AWS_LLAMA_PASSWORD"
+const DEFAULT_PASS_PREFIX = "aws-llama/"
+
+// A place the IdP password can be kept instead of ~/.aws-llama.json.
+type Backend interface {
+	Get(username string) (string, error)
+	Set(username string, password string) error
+}
+
+func NewBackend(settings config.PasswordBackend) (Backend, error) {
+	switch settings.Type {
+	case config.PasswordBackendSecretService:
+		return &secretServiceBackend{}, nil
+	case config.PasswordBackendPass:
+		return &passBackend{entry: settings.PassEntry}, nil
+	case config.PasswordBackendFile:
+		return &fileBackend{path: settings.File}, nil
+	case config.PasswordBackendEnv:
+		return &envBackend{name: settings.Env}, nil
+	default:
+		return nil, fmt.Errorf("unsupported password backend: %q", settings.Type)
+	}
+}
+
+// Returns the IdP password: the plaintext one from the config if set, otherwise
+// the one from the configured password backend.
+func LoginPassword() (string, error) {
+	current := config.Current()
+	if current.Password != "" {
+		return current.Password, nil
+	}
+
+	backend, err := NewBackend(current.PasswordBackend)
+	if err != nil {
+		return "", err
+	}
+	return backend.Get(current.Username)
+}
+
+// Uses secret-tool to talk to the Secret Service (GNOME Keyring, KWallet, ...).
+type secretServiceBackend struct{}
+
+func (s *secretServiceBackend) attributes(username string) []string {
+	return []string{"service", SECRET_SERVICE_NAME, "username", username}
+}
+
+func (s *secretServiceBackend) Get(username string) (string, error) {
+	var stdout bytes.Buffer
+	lookupCmd := exec.Command("secret-tool", append([]string{"lookup"}, s.attributes(username)...)...)
+	lookupCmd.Stdout = &stdout
+	err := lookupCmd.Run()
+	if err != nil || stdout.Len() == 0 {
+		return "", fmt.Errorf("no password for %s in the Secret Service (run `aws-llama login set-password`): %v", username, err)
+	}
+	return stdout.String(), nil
+}
+
+func (s *secretServiceBackend) Set(username string, password string) error {
+	storeArgs := append([]string{"store", "--label", "aws-llama password for " + username}, s.attributes(username)...)
+	storeCmd := exec.Command("secret-tool", storeArgs...)
+	storeCmd.Stdin = strings.NewReader(password)
+	output, err := storeCmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to store password with secret-tool: %w: %s", err, output)
+	}
+	return nil
+}
+
+// Uses the standard unix password manager (https://www.passwordstore.org/).
+type passBackend struct {
+	entry string
+}
+
+func (p *passBackend) entryName(username string) string {
+	if p.entry != "" {
+		return p.entry
+	}
+	return DEFAULT_PASS_PREFIX + username
+}
+
+func (p *passBackend) Get(username string) (string, error) {
+	output, err := exec.Command("pass", "show", p.entryName(username)).Output()
+	if err != nil {
+		return "", fmt.Errorf("failed to read %s from pass: %w", p.entryName(username), err)
+	}
+	// Like most pass integrations, only the first line is the password.
+	password, _, _ := strings.Cut(string(output), "\n")
+	return password, nil
+}
+
+func (p *passBackend) Set(username string, password string) error {
+	insertCmd := exec.Command("pass", "insert", "--multiline", "--force", p.entryName(username))
+	insertCmd.Stdin = strings.NewReader(password + "\n")
+	output, err := insertCmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to store %s in pass: %w: %s", p.entryName(username), err, output)
+	}
+	return nil
+}
+
+// Keeps the password in a file encrypted with the configured encryption mode.
+// The file holds a single password, so the username is ignored.
+type fileBackend struct {
+	path string
+}
+
+func (f *fileBackend) filePath() (string, error) {
+	if f.path != "" {
+		return f.path, nil
+	}
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(homeDir, ".aws-llama-password"), nil
+}
+
+func (f *fileBackend) Get(username string) (string, error) {
+	path, err := f.filePath()
+	if err != nil {
+		return "", err
+	}
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read password file (run `aws-llama login set-password`): %w", err)
+	}
+	if !encryption.IsEncrypted(contents) {
+		return "", fmt.Errorf("password file %s is not encrypted", path)
+	}
+	password, err := encryption.Open(contents)
+	if err != nil {
+		return "", err
+	}
+	return string(password), nil
+}
+
+func (f *fileBackend) Set(username string, password string) error {
+	if !encryption.Enabled() {
+		return errors.New("the file password backend requires encryption.mode to be set")
+	}
+	path, err := f.filePath()
+	if err != nil {
+		return err
+	}
+	contents, err := encryption.Seal([]byte(password))
+	if err != nil {
+		return err
+	}
+	return atomicfile.Write(path, func(w io.Writer) error {
+		_, err := w.Write(contents)
+		return err
+	})
+}
+
+// Reads the password from an environment variable, e.g. one populated by a
+// password manager's CLI in the service definition.
+type envBackend struct {
+	name string
+}
+
+func (e *envBackend) variable() string {
+	if e.name != "" {
+		return e.name
+	}
+	return DEFAULT_PASSWORD_ENV
+}
+
+func (e *envBackend) Get(username string) (string, error) {
+	password := os.Getenv(e.variable())
+	if password == "" {
+		return "", fmt.Errorf("$%s is not set", e.variable())
+	}
+	return password, nil
+}
+
+func (e *envBackend) Set(username string, password string) error {
+	return fmt.Errorf("the env password backend is read-only: export $%s instead", e.variable())
+}
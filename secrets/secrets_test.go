@@ -0,0 +1,144 @@
+package secrets
+
+import (
+	"aws-llama/config"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func setupConfig(t *testing.T, current *config.Config) {
+	previousConfig := config.Current()
+	config.SetCurrent(current)
+	t.Cleanup(func() { config.SetCurrent(previousConfig) })
+}
+
+func TestEnvBackend(t *testing.T) {
+	cases := []struct {
+		name     string
+		variable string
+		set      string
+		expected string
+		err      string
+	}{
+		{name: "default variable", set: DEFAULT_PASSWORD_ENV, expected: "hunter2"},
+		{name: "custom variable", variable: "IDP_PASSWORD", set: "IDP_PASSWORD", expected: "hunter2"},
+		{name: "unset", variable: "IDP_PASSWORD", set: DEFAULT_PASSWORD_ENV, err: "$IDP_PASSWORD is not set"},
+	}
+	for _, c := range cases {
+		t.Setenv(DEFAULT_PASSWORD_ENV, "")
+		t.Setenv("IDP_PASSWORD", "")
+		t.Setenv(c.set, "hunter2")
+
+		backend, err := NewBackend(config.PasswordBackend{Type: config.PasswordBackendEnv, Env: c.variable})
+		if err != nil {
+			t.Fatal(err)
+		}
+		password, err := backend.Get("me@example.com")
+		if c.err != "" {
+			if err == nil || !strings.Contains(err.Error(), c.err) {
+				t.Errorf("%s: expected an error containing %q, got %v", c.name, c.err, err)
+			}
+			continue
+		}
+		if err != nil || password != c.expected {
+			t.Errorf("%s: expected %q, got %q (%v)", c.name, c.expected, password, err)
+		}
+	}
+}
+
+func TestEnvBackendIsReadOnly(t *testing.T) {
+	backend := &envBackend{}
+	err := backend.Set("me@example.com", "hunter2")
+	if err == nil || !strings.Contains(err.Error(), DEFAULT_PASSWORD_ENV) {
+		t.Errorf("expected the env backend to refuse storing, got %v", err)
+	}
+}
+
+func TestFileBackendRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	passphraseFile := filepath.Join(dir, "passphrase")
+	err := os.WriteFile(passphraseFile, []byte("passphrase\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setupConfig(t, &config.Config{Encryption: config.Encryption{Mode: config.EncryptionModePassphrase, PassphraseFile: passphraseFile}})
+
+	path := filepath.Join(dir, "password")
+	backend, err := NewBackend(config.PasswordBackend{Type: config.PasswordBackendFile, File: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = backend.Set("me@example.com", "hunter2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(contents), "hunter2") {
+		t.Errorf("expected the password file to be encrypted")
+	}
+	info, err := os.Stat(path)
+	if err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("expected a 0600 password file, got %v (%v)", info, err)
+	}
+
+	password, err := backend.Get("me@example.com")
+	if err != nil || password != "hunter2" {
+		t.Errorf("expected the stored password, got %q (%v)", password, err)
+	}
+}
+
+func TestFileBackendRequiresEncryption(t *testing.T) {
+	setupConfig(t, &config.Config{})
+	path := filepath.Join(t.TempDir(), "password")
+	backend := &fileBackend{path: path}
+
+	err := backend.Set("me@example.com", "hunter2")
+	if err == nil || !strings.Contains(err.Error(), "encryption.mode") {
+		t.Errorf("expected storing to require encryption, got %v", err)
+	}
+
+	// A plaintext file isn't trusted either.
+	err = os.WriteFile(path, []byte("hunter2"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = backend.Get("me@example.com")
+	if err == nil || !strings.Contains(err.Error(), "not encrypted") {
+		t.Errorf("expected a plaintext password file to be rejected, got %v", err)
+	}
+}
+
+func TestLoginPassword(t *testing.T) {
+	t.Setenv(DEFAULT_PASSWORD_ENV, "from-env")
+
+	setupConfig(t, &config.Config{
+		Username:        "me@example.com",
+		Password:        "from-config",
+		PasswordBackend: config.PasswordBackend{Type: config.PasswordBackendEnv},
+	})
+	password, err := LoginPassword()
+	if err != nil || password != "from-config" {
+		t.Errorf("expected the configured password to win, got %q (%v)", password, err)
+	}
+
+	setupConfig(t, &config.Config{
+		Username:        "me@example.com",
+		PasswordBackend: config.PasswordBackend{Type: config.PasswordBackendEnv},
+	})
+	password, err = LoginPassword()
+	if err != nil || password != "from-env" {
+		t.Errorf("expected the backend's password, got %q (%v)", password, err)
+	}
+
+	setupConfig(t, &config.Config{Username: "me@example.com"})
+	_, err = LoginPassword()
+	if err == nil {
+		t.Errorf("expected an error without a password or backend")
+	}
+}